@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aescarias/apricot/torrent"
+	"github.com/aescarias/apricot/torrent/dht"
+)
+
+const (
+	METADATA_TIMEOUT    = 60 * time.Second // The time allowed for fetching the metadata of a magnet URI.
+	PEER_LOOKUP_TIMEOUT = 20 * time.Second // The time allowed for finding peers in the DHT.
+	METADATA_WORKERS    = 8                // The number of peers metadata is requested from at once.
+)
+
+// ShowMagnet fetches the metadata of the torrent described by a magnet URI from
+// its peers and prints it in the same way as ShowInfo.
+func ShowMagnet(uri string) {
+	torrentFile := OpenMagnet(uri)
+
+	ctx, cancel := context.WithTimeout(context.Background(), METADATA_TIMEOUT)
+	defer cancel()
+
+	info, err := FetchMagnetMetadata(ctx, torrentFile)
+	if err != nil {
+		log.Fatalf("could not fetch metadata: %s", err)
+	}
+
+	torrentFile.Info = *info
+	PrintInfo(torrentFile)
+}
+
+// FindPeers returns the peers of a torrent announced by its trackers and found
+// in the DHT. Sources that fail are skipped.
+func FindPeers(ctx context.Context, torrentFile *torrent.Torrent, infoHash [20]byte) []torrent.TrackerPeer {
+	var peers []torrent.TrackerPeer
+
+	if len(torrentFile.AnnounceURL) > 0 || len(torrentFile.AnnounceList) > 0 {
+		resp, err := torrentFile.GetPeersAnyContext(ctx, torrent.TrackerRequest{
+			InfoHash: infoHash,
+			PeerId:   MakePeerId(VERSION),
+			Port:     6881,
+			Compact:  1,
+		})
+		if err == nil {
+			peers = append(peers, resp.Peers...)
+		}
+	}
+
+	node, err := dht.NewNode(":0")
+	if err != nil {
+		return peers
+	}
+	defer node.Close()
+
+	lookupCtx, cancel := context.WithTimeout(ctx, PEER_LOOKUP_TIMEOUT)
+	defer cancel()
+
+	found, err := node.GetPeers(lookupCtx, infoHash)
+	if err == nil {
+		peers = append(peers, found...)
+	}
+
+	return peers
+}
+
+// FetchMagnetMetadata fetches the info dictionary of a torrent read from a magnet
+// URI from its peers, asking up to METADATA_WORKERS peers at once. The info is
+// verified against the info hash of the magnet URI.
+//
+// Returns the info of the first peer to serve it, or an error if no peer served
+// it before 'ctx' is done.
+func FetchMagnetMetadata(ctx context.Context, torrentFile *torrent.Torrent) (*torrent.Info, error) {
+	infoHash, err := torrentFile.Info.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("could not get info hash: %w", err)
+	}
+
+	peers := FindPeers(ctx, torrentFile, infoHash)
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers found")
+	}
+
+	queue := make(chan torrent.TrackerPeer, len(peers))
+	for _, peer := range peers {
+		queue <- peer
+	}
+	close(queue)
+
+	result := make(chan *torrent.Info, 1)
+	peerId := MakePeerId(VERSION)
+
+	var wg sync.WaitGroup
+	for range METADATA_WORKERS {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for peer := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+
+				client, err := torrent.NewTCPClient(string(infoHash[:]), peer, peerId, 0)
+				if err != nil {
+					continue
+				}
+
+				stop := context.AfterFunc(ctx, func() { client.Connection.Close() })
+				info, err := client.FetchMetadata(infoHash)
+				stop()
+				client.Connection.Close()
+
+				if err == nil {
+					select {
+					case result <- info:
+					default:
+					}
+
+					return
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case info := <-result:
+		return info, nil
+	case <-done:
+		select {
+		case info := <-result:
+			return info, nil
+		default:
+			return nil, fmt.Errorf("none of %d peers served the metadata", len(peers))
+		}
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("no peer served the metadata in time")
+		}
+
+		return nil, ctx.Err()
+	}
+}
@@ -3,13 +3,14 @@ package main
 import (
 	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/aescarias/apricot/torrent"
-	"github.com/aescarias/apricot/torrent/bencode"
 )
 
 const NAME = "Apricot"
@@ -26,33 +27,54 @@ func OpenTorrent(filename string) *torrent.Torrent {
 		}
 	}
 
-	tokens, err := bencode.DecodeBencode(string(contents))
+	torrentFile, err := torrent.NewTorrentFromBytes(contents)
 	if err != nil {
-		log.Fatalf("failed to decode torrent file: %s", err)
+		log.Fatalf("failed to read torrent file: %s", err)
 	}
 
-	metaInfo, ok := tokens[0].(map[string]any)
-	if !ok {
-		log.Fatalf("failed to read torrent file: expected meta info dictionary.")
-	}
+	return torrentFile
+}
 
-	torrentFile, err := torrent.NewTorrent(metaInfo)
+// OpenMagnet parses a magnet URI into a torrent without metadata.
+func OpenMagnet(uri string) *torrent.Torrent {
+	torrentFile, err := torrent.ParseMagnet(uri)
 	if err != nil {
-		log.Fatalf("failed to read torrent file: %s", err)
+		log.Fatalf("failed to read magnet uri: %s", err)
 	}
 
 	return torrentFile
 }
 
-func ShowPeers(filename string) {
-	torrentFile := OpenTorrent(filename)
+// trackerFlags collects the URLs of a repeated --tracker flag.
+type trackerFlags []string
+
+func (t *trackerFlags) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *trackerFlags) Set(value string) error {
+	*t = append(*t, value)
+	return nil
+}
+
+func ShowPeers(filename string, trackers []string) {
+	var torrentFile *torrent.Torrent
+	if strings.HasPrefix(filename, "magnet:") {
+		torrentFile = OpenMagnet(filename)
+	} else {
+		torrentFile = OpenTorrent(filename)
+	}
+
+	for _, tracker := range trackers {
+		torrentFile.AddTracker(0, tracker)
+	}
 
 	infoHash, err := torrentFile.Info.Hash()
 	if err != nil {
 		log.Fatalf("failed to generate info hash: %s", err)
 	}
 
-	resp, err := torrentFile.GetPeers(
+	resp, err := torrentFile.GetPeersAny(
 		torrent.TrackerRequest{
 			InfoHash:   infoHash,
 			PeerId:     MakePeerId(VERSION),
@@ -73,8 +95,18 @@ func ShowPeers(filename string) {
 		log.Fatalf("could not get peers: %v\n", err)
 	}
 
+	if len(resp.Warning) > 0 {
+		fmt.Println("tracker warning:", resp.Warning)
+	}
+
 	fmt.Printf("request interval: %d seconds\n", resp.Interval)
 
+	// Trackers omitting the counts leave both at zero.
+	if resp.Complete > 0 || resp.Incomplete > 0 {
+		fmt.Println("seeders: ", resp.Complete)
+		fmt.Println("leechers:", resp.Incomplete)
+	}
+
 	if len(resp.Peers) <= 0 {
 		fmt.Printf("no peers")
 		return
@@ -100,21 +132,40 @@ func ShowPieces(filename string) {
 }
 
 func ShowInfo(filename string) {
-	torrentFile := OpenTorrent(filename)
+	PrintInfo(OpenTorrent(filename))
+}
 
+// PrintInfo prints the meta info of a torrent whose metadata is known.
+func PrintInfo(torrentFile *torrent.Torrent) {
 	fmt.Println("announce url:", torrentFile.AnnounceURL)
 
+	if len(torrentFile.Comment) > 0 {
+		fmt.Println("comment:", torrentFile.Comment)
+	}
+
+	if len(torrentFile.CreatedBy) > 0 {
+		fmt.Println("created by:", torrentFile.CreatedBy)
+	}
+
+	if !torrentFile.CreationDate.IsZero() {
+		fmt.Println("creation date:", torrentFile.CreationDate.Format(time.RFC1123))
+	}
+
+	if len(torrentFile.Encoding) > 0 {
+		fmt.Println("encoding:", torrentFile.Encoding)
+	}
+
 	files := torrentFile.Info.Files
 	if len(files) > 0 {
-		fmt.Println("dirname:", torrentFile.Info.Name)
+		fmt.Println("dirname:", torrentFile.Info.PreferredName())
 	} else {
-		fmt.Println("filename:", torrentFile.Info.Name)
+		fmt.Println("filename:", torrentFile.Info.PreferredName())
 	}
 
 	if len(files) > 0 {
 		fmt.Printf("files [%d]:\n", len(files))
 		for _, file := range files {
-			fmt.Printf("  %s [%s]\n", strings.Join(file.Path, "/"), HumanBytes(file.Length))
+			fmt.Printf("  %s [%s]\n", strings.Join(file.PreferredPath(), "/"), HumanBytes(file.Length))
 		}
 		fmt.Println("total length:", HumanBytes(torrentFile.Info.TotalLength()))
 	} else {
@@ -123,15 +174,25 @@ func ShowInfo(filename string) {
 
 	fmt.Println("piece length:", HumanBytes(torrentFile.Info.PieceLength))
 
+	if err := torrentFile.Info.Validate(); errors.Is(err, torrent.ErrPieceLengthNotPowerOfTwo) {
+		fmt.Println("warning:", err)
+	}
+
+	if torrentFile.Info.Private {
+		fmt.Println("private: yes")
+	} else {
+		fmt.Println("private: no")
+	}
+
 	pieceHashes := torrentFile.Info.PieceHashes()
 
 	fmt.Printf("pieces [%d]: \n", len(pieceHashes))
 
-	for idx := range 2 {
-		fmt.Printf("  %x\n", pieceHashes[idx])
+	for _, hash := range pieceHashes[:min(2, len(pieceHashes))] {
+		fmt.Printf("  %x\n", hash)
 	}
 
-	if len(pieceHashes) > 3 {
+	if len(pieceHashes) > 2 {
 		fmt.Println("  (...)")
 	}
 
@@ -141,12 +202,21 @@ func ShowInfo(filename string) {
 	}
 
 	fmt.Printf("info hash: %x\n", infoHash)
+
+	if torrentFile.Info.IsV2() {
+		infoHashV2, err := torrentFile.Info.HashV2()
+		if err != nil {
+			log.Fatalf("could not get v2 info hash: %s", err)
+		}
+
+		fmt.Printf("info hash (v2): %x\n", infoHashV2)
+	}
 }
 
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Printf("%s %s\n", NAME, VERSION)
-		fmt.Printf("usage: %s {info,peers,pieces} <options>\n", os.Args[0])
+		fmt.Printf("usage: %s {info,magnet,peers,pieces} <options>\n", os.Args[0])
 		os.Exit(1)
 	}
 
@@ -158,6 +228,12 @@ func main() {
 			log.Fatalf("usage: %s info <filename>\n", os.Args[0])
 		}
 		ShowInfo(progArgs[1])
+	case "magnet":
+		if len(progArgs) < 2 {
+			log.Fatalf("usage: %s magnet <magnet uri>\n", os.Args[0])
+		}
+
+		ShowMagnet(progArgs[1])
 	case "pieces":
 		if len(progArgs) < 2 {
 			log.Fatalf("usage: %s pieces <filename>\n", os.Args[0])
@@ -165,14 +241,20 @@ func main() {
 
 		ShowPieces(progArgs[1])
 	case "peers":
-		if len(progArgs) < 2 {
-			log.Fatalf("usage: %s peers <filename>\n", os.Args[0])
+		var trackers trackerFlags
+
+		flags := flag.NewFlagSet("peers", flag.ExitOnError)
+		flags.Var(&trackers, "tracker", "an additional tracker URL to announce to (may be repeated)")
+		flags.Parse(progArgs[1:])
+
+		if flags.NArg() < 1 {
+			log.Fatalf("usage: %s peers [--tracker <url>]... <filename or magnet uri>\n", os.Args[0])
 		}
 
-		ShowPeers(progArgs[1])
+		ShowPeers(flags.Arg(0), trackers)
 	default:
 		fmt.Printf("invalid subcommand %q\n", progArgs[0])
-		fmt.Printf("subcommands: info, peers, pieces\n")
+		fmt.Printf("subcommands: info, magnet, peers, pieces\n")
 		os.Exit(1)
 	}
 }
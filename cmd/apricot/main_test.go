@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aescarias/apricot/torrent"
+)
+
+// captureStdout returns everything written to the standard output by 'fn'.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("could not create pipe: %v", err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		contents, _ := io.ReadAll(reader)
+		output <- string(contents)
+	}()
+
+	fn()
+	writer.Close()
+
+	return <-output
+}
+
+func TestPrintInfoPieceCounts(t *testing.T) {
+	hash := sha1.Sum(nil)
+
+	for _, numPieces := range []int{0, 1, 2} {
+		t.Run(fmt.Sprint(numPieces), func(t *testing.T) {
+			torrentFile := &torrent.Torrent{
+				AnnounceURL: "http://tracker.example.com/announce",
+				Info: torrent.Info{
+					Name:        "file",
+					PieceLength: 16384,
+					Pieces:      strings.Repeat(string(hash[:]), numPieces),
+					Length:      int64(numPieces) * 16384,
+				},
+			}
+
+			output := captureStdout(t, func() { PrintInfo(torrentFile) })
+
+			if !strings.Contains(output, fmt.Sprintf("pieces [%d]", numPieces)) {
+				t.Errorf("output does not list %d pieces:\n%s", numPieces, output)
+			}
+
+			if count := strings.Count(output, fmt.Sprintf("%x", hash)); count != numPieces {
+				t.Errorf("printed %d piece hashes, expected %d", count, numPieces)
+			}
+		})
+	}
+}
+
+func TestPrintInfoHundredBytes(t *testing.T) {
+	output := captureStdout(t, func() { ShowInfo("../../torrent/testdata/hundred.torrent") })
+
+	if !strings.Contains(output, "pieces [1]") {
+		t.Errorf("output does not list a single piece:\n%s", output)
+	}
+}
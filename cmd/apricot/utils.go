@@ -8,22 +8,58 @@ import (
 const STEP_SIZE = 1000                                     // Decimal unit step size
 var UNITS = [...]string{"B", "KB", "MB", "GB", "TB", "PB"} // Decimal units
 
+const IEC_STEP_SIZE = 1024                                          // Binary unit step size
+var IEC_UNITS = [...]string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"} // Binary units
+
+// A UnitSystem selects the units used by HumanBytesBase.
+type UnitSystem int
+
+const (
+	DecimalUnits UnitSystem = iota // Steps of STEP_SIZE named by UNITS.
+	BinaryUnits                    // Steps of IEC_STEP_SIZE named by IEC_UNITS.
+)
+
 // HumanBytes converts a number in bytes (via the bytes parameter)
 // to a human-readable size representation in decimal units.
 //
-// For example, HumanBytes(1000) will return "1 KB".
-func HumanBytes(bytes int) string {
-	number := float64(bytes)
+// For example, HumanBytes(1000) will return "1.00 KB".
+func HumanBytes(bytes int64) string {
+	return HumanBytesBase(bytes, DecimalUnits)
+}
+
+// HumanBytesIEC converts a number in bytes (via the bytes parameter)
+// to a human-readable size representation in binary units.
+//
+// For example, HumanBytesIEC(1024) will return "1.00 KiB".
+func HumanBytesIEC(bytes int64) string {
+	return HumanBytesBase(bytes, BinaryUnits)
+}
+
+// HumanBytesBase converts a number in bytes to a human-readable size representation
+// using the units of 'system'. Panics if 'system' is not a known UnitSystem.
+func HumanBytesBase(bytes int64, system UnitSystem) string {
+	var step float64
+	var units []string
+
+	switch system {
+	case DecimalUnits:
+		step, units = STEP_SIZE, UNITS[:]
+	case BinaryUnits:
+		step, units = IEC_STEP_SIZE, IEC_UNITS[:]
+	default:
+		panic(fmt.Sprintf("unknown unit system %d", system))
+	}
 
-	var unit string
-	for idx := range len(UNITS) {
-		unit = UNITS[idx]
+	number, unit := float64(bytes), units[0]
 
-		if number < STEP_SIZE {
+	// Sizes past the largest unit are given in multiples of it.
+	for _, next := range units[1:] {
+		if number < step {
 			break
 		}
 
-		number /= STEP_SIZE
+		number /= step
+		unit = next
 	}
 
 	return fmt.Sprintf("%.2f %s", number, unit)
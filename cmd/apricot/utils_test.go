@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestHumanBytes(t *testing.T) {
+	tests := []struct {
+		bytes   int64
+		decimal string
+		binary  string
+	}{
+		{0, "0.00 B", "0.00 B"},
+		{999, "999.00 B", "999.00 B"},
+		{1000, "1.00 KB", "1000.00 B"},
+		{1024, "1.02 KB", "1.00 KiB"},
+		{1536, "1.54 KB", "1.50 KiB"},
+		{5 << 30, "5.37 GB", "5.00 GiB"},
+		{3 << 50, "3.38 PB", "3.00 PiB"},
+		// Past the largest unit, the number keeps growing.
+		{1 << 62, "4611.69 PB", "4096.00 PiB"},
+	}
+
+	for _, test := range tests {
+		if decimal := HumanBytes(test.bytes); decimal != test.decimal {
+			t.Errorf("HumanBytes(%d) returned %q, expected %q", test.bytes, decimal, test.decimal)
+		}
+
+		if binary := HumanBytesIEC(test.bytes); binary != test.binary {
+			t.Errorf("HumanBytesIEC(%d) returned %q, expected %q", test.bytes, binary, test.binary)
+		}
+	}
+}
+
+func TestHumanBytesBaseUnknownSystem(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("HumanBytesBase accepted an unknown unit system")
+		}
+	}()
+
+	HumanBytesBase(1024, UnitSystem(512))
+}
@@ -0,0 +1,96 @@
+/* Periodic announces to the tracker of a torrent. */
+
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// The interval between announces used when the tracker does not specify one.
+	DEFAULT_ANNOUNCE_INTERVAL = 30 * time.Minute
+	// The time allowed for the final 'stopped' announce to complete.
+	STOPPED_ANNOUNCE_TIMEOUT = 10 * time.Second
+)
+
+// Announce keeps the client in the swarm of the torrent by announcing 'request'
+// to the tracker at the announce URL until 'ctx' is done.
+//
+// The first announce sends the 'started' event and subsequent announces send no
+// event. Each announce waits for the interval given by the previous response, or
+// its minimum interval if greater, and sends back the tracker ID if one was given.
+// The peers of every successful response are sent on 'peers'.
+//
+// Returns an error if the first announce fails. Later failures are retried after
+// the current interval. Once 'ctx' is done, the 'stopped' event is announced and
+// its error, if any, is returned.
+func (t *Torrent) Announce(ctx context.Context, request TrackerRequest, peers chan<- []TrackerPeer) error {
+	request.Event = EventStarted
+
+	resp, err := t.GetPeersContext(ctx, request)
+	if err != nil {
+		return fmt.Errorf("could not announce start: %w", err)
+	}
+
+	interval := DEFAULT_ANNOUNCE_INTERVAL
+
+	for {
+		interval = announceInterval(resp, interval)
+
+		if resp != nil {
+			if len(resp.TrackerId) > 0 {
+				request.TrackerId = resp.TrackerId
+			}
+
+			select {
+			case peers <- resp.Peers:
+			case <-ctx.Done():
+				return t.announceStopped(ctx, request)
+			}
+		}
+
+		timer := time.NewTimer(interval)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return t.announceStopped(ctx, request)
+		}
+
+		request.Event = ""
+
+		resp, err = t.GetPeersContext(ctx, request)
+		if err != nil {
+			loggerOrNop(t.Logger).Warn("announce failed", "url", t.AnnounceURL, "retry in", interval, "error", err)
+			resp = nil
+		}
+	}
+}
+
+// announceInterval returns the time to wait before the announce following 'resp',
+// or 'previous' if the announce failed or the tracker gave no interval.
+func announceInterval(resp *TrackerResponse, previous time.Duration) time.Duration {
+	if resp == nil || resp.Interval <= 0 {
+		return previous
+	}
+
+	return time.Duration(max(resp.Interval, resp.MinInterval)) * time.Second
+}
+
+// announceStopped announces the 'stopped' event after 'ctx' is done, allowing it
+// STOPPED_ANNOUNCE_TIMEOUT to complete.
+func (t *Torrent) announceStopped(ctx context.Context, request TrackerRequest) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), STOPPED_ANNOUNCE_TIMEOUT)
+	defer cancel()
+
+	request.Event = EventStopped
+
+	if _, err := t.GetPeersContext(ctx, request); err != nil {
+		return fmt.Errorf("could not announce stop: %w", err)
+	}
+
+	return nil
+}
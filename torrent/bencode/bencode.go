@@ -10,16 +10,25 @@
 		horizontal tab ('\t'), line feed ('\n'), vertical tab ('\v'),
 		form feed ('\f'), carriage return ('\r'), space (' '),
 		next line (U+0085; NEL), non-breaking space (U+00A0; NBSP)
+
+	Bencode strings are byte strings and may hold either text or raw binary data.
+	Both decode losslessly into a Go string, but DecodeBencodeBinary decodes them
+	as []byte so that callers can tell the two apart. In .torrent files and tracker
+	responses, the following values are binary: 'pieces' in the info dictionary,
+	'peers' and 'peers6' in compact form, and 'peer id' and info hash keys.
 */
 
 package bencode
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"reflect"
 	"slices"
 	"strconv"
+	"strings"
 	"unicode"
 )
 
@@ -34,19 +43,27 @@ func ParseBencodeString(scanner *Scanner) (string, error) {
 
 	if !found {
 		scanner.CurrentIndex = start
-		return "", fmt.Errorf("expected length specification")
+		return "", scanner.syntaxError(start, nil, "expected ':' in string length")
 	}
 
 	strLen, err := strconv.Atoi(digitStr)
 	if err != nil {
-		return "", fmt.Errorf("length conversion errored: %w", err)
+		return "", scanner.syntaxError(start, err, "invalid string length %q", digitStr)
+	}
+
+	if strLen < 0 {
+		return "", scanner.syntaxError(start, nil, "negative string length %d", strLen)
+	}
+
+	if strLen > scanner.maxStringLen() {
+		return "", scanner.syntaxError(start, ErrStringTooLong, "string length %d exceeds limit of %d", strLen, scanner.maxStringLen())
 	}
 
 	scanner.Advance(1) // past the ":"
 
 	strVal, err := scanner.Consume(strLen)
 	if err != nil {
-		return "", err
+		return "", scanner.syntaxError(scanner.CurrentIndex, err, "string of length %d exceeds input", strLen)
 	}
 
 	return strVal, nil
@@ -57,25 +74,57 @@ func ParseBencodeString(scanner *Scanner) (string, error) {
 // Integers are represented by an 'i' followed by the number in base 10 and ended
 // by an 'e'. For example i3e corresponds to 3 and i-3e corresponds to -3.
 //
-// Integers have no size limitation. i-0e is invalid. All encodings with a
+// Integers are decoded as int64. i-0e is invalid. All encodings with a
 // leading zero, such as i03e, are invalid, other than i0e, which is just zero.
-func ParseBencodeInteger(scanner *Scanner) (int, error) {
+func ParseBencodeInteger(scanner *Scanner) (int64, error) {
+	start := scanner.CurrentIndex
 	scanner.Advance(1) // past the 'i'
 	digitStr, found := scanner.ConsumeUntil('e')
 
 	if !found {
-		return 0, fmt.Errorf("expected end of integer")
+		return 0, scanner.syntaxError(start, nil, "expected 'e' to end integer")
 	}
 
-	number, err := strconv.Atoi(digitStr)
+	number, err := parseInteger(digitStr)
 	if err != nil {
-		return 0, fmt.Errorf("integer conversion errored: %s", err)
+		return 0, scanner.syntaxError(start, err, "%s", err)
 	}
 
 	scanner.Advance(1)
 	return number, nil
 }
 
+// parseInteger converts the body of a Bencode integer (the text between 'i'
+// and 'e') into an int64.
+//
+// Empty bodies, negative zero and leading zeros (other than in the body "0")
+// are rejected as required by the specification.
+func parseInteger(digitStr string) (int64, error) {
+	if len(digitStr) == 0 {
+		return 0, fmt.Errorf("empty integer")
+	}
+
+	digits := strings.TrimPrefix(digitStr, "-")
+	if len(digits) == 0 || strings.TrimLeft(digits, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid integer %q", digitStr)
+	}
+
+	if digits == "0" && len(digits) != len(digitStr) {
+		return 0, fmt.Errorf("invalid integer %q: negative zero", digitStr)
+	}
+
+	if len(digits) > 1 && digits[0] == '0' {
+		return 0, fmt.Errorf("invalid integer %q: leading zero", digitStr)
+	}
+
+	number, err := strconv.ParseInt(digitStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("integer conversion errored: %w", err)
+	}
+
+	return number, nil
+}
+
 // Parses a Bencode list of the form l...e
 //
 // Lists are encoded as an 'l' followed by Bencode elements and ended by an 'e'.
@@ -83,17 +132,18 @@ func ParseBencodeInteger(scanner *Scanner) (int, error) {
 func ParseBencodeList(scanner *Scanner) ([]any, error) {
 	var tokens []any
 
+	start := scanner.CurrentIndex
 	scanner.Advance(1) // past the "l"
 
-	for !scanner.Ended() {
+	for {
 		scanner.AdvanceWhitespace()
 
-		ch, err := scanner.Peek(1)
-		if err == io.EOF {
-			return nil, err
+		ch, ok := scanner.PeekByte()
+		if !ok {
+			return nil, scanner.syntaxError(scanner.CurrentIndex, io.EOF, "expected 'e' to end list starting at byte %d", start)
 		}
 
-		if ch[0] == 'e' {
+		if ch == 'e' {
 			scanner.Advance(1) // advance past the 'e'
 			break
 		}
@@ -118,34 +168,97 @@ func ParseBencodeList(scanner *Scanner) ([]any, error) {
 // and d4:spaml1:a1:bee corresponds to {'spam': ['a', 'b']}.
 //
 // Keys must be strings and appear in sorted order (sorted as raw strings, not alphanumerics).
+// Dictionaries with unsorted or duplicate keys are rejected.
 func ParseBencodeDictionary(scanner *Scanner) (map[string]any, error) {
-	dictionary := make(map[string]any)
+	return parseDictionary(scanner, nil, nil)
+}
 
-	scanner.Advance(1)
-	for !scanner.Ended() {
+// ParseBencodeOrderedDictionary parses a Bencode dictionary like ParseBencodeDictionary,
+// but returns its entries in the order they appear in the input.
+func ParseBencodeOrderedDictionary(scanner *Scanner) (Dict, error) {
+	return parseDictionaryEntries(scanner, nil, nil)
+}
+
+// parseDictionary parses a Bencode dictionary. If 'spans' is not nil, the span
+// of each value is recorded in it, keyed by the dictionary key. If 'keys' is not
+// nil, only the values of the keys it holds are decoded.
+func parseDictionary(scanner *Scanner, spans map[string]Span, keys map[string]bool) (map[string]any, error) {
+	entries, err := parseDictionaryEntries(scanner, spans, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	dictionary := make(map[string]any, len(entries))
+	for _, entry := range entries {
+		dictionary[entry.Key] = entry.Value
+	}
+
+	return dictionary, nil
+}
+
+// parseDictionaryEntries parses a Bencode dictionary into its entries, in input
+// order. If 'spans' is not nil, the span of each value is recorded in it. If
+// 'keys' is not nil, the values of other keys are skipped with SkipToken and
+// left out of the entries.
+func parseDictionaryEntries(scanner *Scanner, spans map[string]Span, keys map[string]bool) (Dict, error) {
+	dictionary := Dict{}
+	var lastKey string
+	first := true
+
+	start := scanner.CurrentIndex
+	scanner.Advance(1) // past the 'd'
+
+	for {
 		scanner.AdvanceWhitespace()
-		ch, err := scanner.Peek(1)
-		if err != nil {
-			return nil, err
+		ch, ok := scanner.PeekByte()
+		if !ok {
+			return nil, scanner.syntaxError(scanner.CurrentIndex, io.EOF, "expected 'e' to end dictionary starting at byte %d", start)
 		}
 
-		if ch[0] == 'e' {
+		if ch == 'e' {
 			scanner.Advance(1)
 			break
 		}
 
-		key, err := ParseBencodeToken(scanner)
+		if !unicode.IsDigit(rune(ch)) {
+			return nil, scanner.syntaxError(scanner.CurrentIndex, nil, "dictionary key must be a string, got %q", []byte{ch})
+		}
+
+		keyStart := scanner.CurrentIndex
+		key, err := ParseBencodeString(scanner)
 		if err != nil {
 			return nil, err
 		}
 
+		if !first && key <= lastKey {
+			return nil, scanner.syntaxError(keyStart, nil, "dictionary key %q is not in sorted order", key)
+		}
+		lastKey, first = key, false
+
 		scanner.AdvanceWhitespace()
-		value, err := ParseBencodeToken(scanner)
+
+		if keys != nil && !keys[key] {
+			valueStart := scanner.CurrentIndex
+			if err := SkipToken(scanner); err != nil {
+				return nil, err
+			}
+
+			if spans != nil {
+				spans[key] = Span{Start: valueStart, End: scanner.CurrentIndex}
+			}
+
+			continue
+		}
+
+		value, span, err := ParseBencodeTokenSpan(scanner)
 		if err != nil {
 			return nil, err
 		}
 
-		dictionary[key.(string)] = value
+		dictionary = append(dictionary, DictEntry{Key: key, Value: value})
+		if spans != nil {
+			spans[key] = span
+		}
 	}
 
 	return dictionary, nil
@@ -153,35 +266,246 @@ func ParseBencodeDictionary(scanner *Scanner) (map[string]any, error) {
 
 // Parses any valid Bencode token. The 4 data types supported by Bencode are
 // Integers, Strings, Lists and Dictionaries.
+//
+// Errors caused by invalid input are returned as a *SyntaxError.
 func ParseBencodeToken(scanner *Scanner) (any, error) {
-	ch, err := scanner.Peek(1)
-	if err == io.EOF {
-		return nil, err
+	ch, ok := scanner.PeekByte()
+	if !ok {
+		return nil, scanner.syntaxError(scanner.CurrentIndex, io.EOF, "unexpected end of input")
 	}
 
-	if unicode.IsDigit(rune(ch[0])) {
-		return ParseBencodeString(scanner)
-	} else if ch[0] == 'i' {
+	if unicode.IsDigit(rune(ch)) {
+		str, err := ParseBencodeString(scanner)
+		if err != nil || !scanner.BinaryStrings {
+			return str, err
+		}
+
+		return []byte(str), nil
+	} else if ch == 'i' {
 		return ParseBencodeInteger(scanner)
-	} else if ch[0] == 'l' {
+	} else if ch == 'l' {
 		return ParseBencodeList(scanner)
-	} else if ch[0] == 'd' {
+	} else if ch == 'd' {
+		if scanner.OrderedDicts {
+			return ParseBencodeOrderedDictionary(scanner)
+		}
+
 		return ParseBencodeDictionary(scanner)
 	}
 
-	return nil, fmt.Errorf("unexpected character %q", ch)
+	return nil, scanner.syntaxError(scanner.CurrentIndex, nil, "unexpected character %q", []byte{ch})
+}
+
+// SkipToken advances the scanner past any valid Bencode token without decoding
+// it. The token is checked in the same way as by ParseBencodeToken, but no
+// strings, lists or dictionaries are allocated.
+//
+// Errors caused by invalid input are returned as a *SyntaxError.
+func SkipToken(scanner *Scanner) error {
+	ch, ok := scanner.PeekByte()
+	if !ok {
+		return scanner.syntaxError(scanner.CurrentIndex, io.EOF, "unexpected end of input")
+	}
+
+	switch {
+	case unicode.IsDigit(rune(ch)):
+		_, err := ParseBencodeString(scanner)
+		return err
+	case ch == 'i':
+		_, err := ParseBencodeInteger(scanner)
+		return err
+	case ch == 'l' || ch == 'd':
+		return skipContainer(scanner, ch == 'd')
+	}
+
+	return scanner.syntaxError(scanner.CurrentIndex, nil, "unexpected character %q", []byte{ch})
+}
+
+// skipContainer advances the scanner past a list or, if 'dictionary' is set, a
+// dictionary, checking that dictionary keys are strings in sorted order.
+func skipContainer(scanner *Scanner, dictionary bool) error {
+	kind := "list"
+	if dictionary {
+		kind = "dictionary"
+	}
+
+	var lastKey string
+	first := true
+
+	start := scanner.CurrentIndex
+	scanner.Advance(1) // past the 'l' or 'd'
+
+	for {
+		scanner.AdvanceWhitespace()
+
+		ch, ok := scanner.PeekByte()
+		if !ok {
+			return scanner.syntaxError(scanner.CurrentIndex, io.EOF, "expected 'e' to end %s starting at byte %d", kind, start)
+		}
+
+		if ch == 'e' {
+			scanner.Advance(1)
+			return nil
+		}
+
+		if dictionary {
+			if !unicode.IsDigit(rune(ch)) {
+				return scanner.syntaxError(scanner.CurrentIndex, nil, "dictionary key must be a string, got %q", []byte{ch})
+			}
+
+			keyStart := scanner.CurrentIndex
+			key, err := ParseBencodeString(scanner)
+			if err != nil {
+				return err
+			}
+
+			if !first && key <= lastKey {
+				return scanner.syntaxError(keyStart, nil, "dictionary key %q is not in sorted order", key)
+			}
+			lastKey, first = key, false
+
+			scanner.AdvanceWhitespace()
+		}
+
+		if err := SkipToken(scanner); err != nil {
+			return err
+		}
+	}
+}
+
+// A Span represents the byte range [Start, End) occupied by a token in the input.
+type Span struct {
+	Start int
+	End   int
+}
+
+// ParseBencodeTokenSpan parses any valid Bencode token like ParseBencodeToken
+// and also returns the span of the token within the scanner contents.
+func ParseBencodeTokenSpan(scanner *Scanner) (any, Span, error) {
+	start := scanner.CurrentIndex
+
+	token, err := ParseBencodeToken(scanner)
+	if err != nil {
+		return nil, Span{}, err
+	}
+
+	return token, Span{Start: start, End: scanner.CurrentIndex}, nil
+}
+
+// ParseBencodeDictionarySpans parses a Bencode dictionary like ParseBencodeDictionary
+// and also returns the span of each value within the scanner contents, keyed
+// by the dictionary key.
+//
+// The spans allow callers to recover the exact encoded form of a value, such as
+// the 'info' dictionary of a .torrent file.
+func ParseBencodeDictionarySpans(scanner *Scanner) (map[string]any, map[string]Span, error) {
+	ch, ok := scanner.PeekByte()
+	if !ok {
+		return nil, nil, scanner.syntaxError(scanner.CurrentIndex, io.EOF, "unexpected end of input")
+	}
+
+	if ch != 'd' {
+		return nil, nil, scanner.syntaxError(scanner.CurrentIndex, nil, "expected dictionary, got %q", []byte{ch})
+	}
+
+	spans := make(map[string]Span)
+
+	dictionary, err := parseDictionary(scanner, spans, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dictionary, spans, nil
+}
+
+// ParseBencodeDictionaryKeys parses a Bencode dictionary like
+// ParseBencodeDictionarySpans, but only decodes the values of 'keys'. The values
+// of other keys are skipped with SkipToken and left out of the dictionary,
+// though their spans are still returned.
+//
+// This avoids building large values that the caller does not need, such as
+// unknown keys of a .torrent file.
+func ParseBencodeDictionaryKeys(scanner *Scanner, keys ...string) (map[string]any, map[string]Span, error) {
+	ch, ok := scanner.PeekByte()
+	if !ok {
+		return nil, nil, scanner.syntaxError(scanner.CurrentIndex, io.EOF, "unexpected end of input")
+	}
+
+	if ch != 'd' {
+		return nil, nil, scanner.syntaxError(scanner.CurrentIndex, nil, "expected dictionary, got %q", []byte{ch})
+	}
+
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+
+	spans := make(map[string]Span)
+
+	dictionary, err := parseDictionary(scanner, spans, wanted)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dictionary, spans, nil
 }
 
 // Decodes a Bencoded string into a Go object.
 func DecodeBencode(contents string) ([]any, error) {
+	return decodeScanner(&Scanner{Contents: contents, CurrentIndex: 0})
+}
+
+// DecodeBencodeBytes decodes Bencoded 'data' like DecodeBencode without copying
+// it into a string first, which avoids a copy of the whole input for large files.
+//
+// Decoded strings share memory with 'data', as described by NewScannerBytes, so
+// 'data' must not be modified or reused for as long as the result is reachable.
+func DecodeBencodeBytes(data []byte) ([]any, error) {
+	return decodeScanner(NewScannerBytes(data))
+}
+
+// Decodes a Bencoded string into a Go object like DecodeBencode, except that
+// Bencode strings are decoded as []byte. Dictionary keys remain strings.
+func DecodeBencodeBinary(contents string) ([]any, error) {
+	return decodeScanner(&Scanner{Contents: contents, CurrentIndex: 0, BinaryStrings: true})
+}
+
+// DecodeBencodeOrdered decodes a Bencoded string like DecodeBencode, but decodes
+// dictionaries as Dict values that keep their entries in input order.
+//
+// Re-encoding the result with EncodeBencode reproduces the input exactly, as
+// long as it is canonical and holds no whitespace between tokens.
+func DecodeBencodeOrdered(contents string) ([]any, error) {
+	return decodeScanner(&Scanner{Contents: contents, CurrentIndex: 0, OrderedDicts: true})
+}
+
+// DecodeBencodeSingle decodes a Bencoded string holding exactly one top-level
+// token, such as the dictionary of a .torrent file. Surrounding whitespace is
+// allowed, but any other data after the token returns an error.
+func DecodeBencodeSingle(contents string) (any, error) {
 	scanner := Scanner{Contents: contents, CurrentIndex: 0}
+	scanner.AdvanceWhitespace()
+
+	token, err := ParseBencodeToken(&scanner)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := scanner.ExpectEnd(); err != nil {
+		return nil, err
+	}
 
+	return token, nil
+}
+
+// decodeScanner decodes every top-level token available in 'scanner'.
+func decodeScanner(scanner *Scanner) ([]any, error) {
 	var tokens []any
 
 	for !scanner.Ended() {
 		scanner.AdvanceWhitespace()
 
-		token, err := ParseBencodeToken(&scanner)
+		token, err := ParseBencodeToken(scanner)
 		if err != nil {
 			return nil, err
 		}
@@ -193,52 +517,120 @@ func DecodeBencode(contents string) ([]any, error) {
 }
 
 // Encodes a Go object `contents` into a Bencode string provided that the object
-// is serializable (i.e. either an integer, string, map or list).
+// is serializable (i.e. either an integer, string, map or list). Byte slices are
+// encoded as Bencode strings and dictionary keys are sorted by their raw bytes.
+//
+// Dict values are encoded with their entries in order. Booleans are encoded as
+// the integers 1 and 0. Bencode has no null value, so nil values cannot be
+// serialized and return an error, as with Marshal.
 func EncodeBencode(contents any) (string, error) {
+	var builder strings.Builder
+
+	if err := encodeValue(&builder, contents); err != nil {
+		return "", err
+	}
+
+	return builder.String(), nil
+}
+
+// EncodeBencodeTo writes the Bencode encoding of `contents` to 'w' in the same
+// way as EncodeBencode, buffering the output. Returns an error if any.
+//
+// If an error occurs, part of the encoding may already have been written to 'w'.
+func EncodeBencodeTo(w io.Writer, contents any) error {
+	writer := bufio.NewWriter(w)
+
+	if err := encodeValue(writer, contents); err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+// An encodeWriter is written to by encodeValue. Write errors are expected to be
+// reported by the writer once encoding is done, as done by bufio.Writer.
+type encodeWriter interface {
+	io.StringWriter
+	io.ByteWriter
+}
+
+// encodeValue writes the Bencode encoding of `contents` to 'w'.
+func encodeValue(w encodeWriter, contents any) error {
+	switch value := contents.(type) {
+	case []byte:
+		encodeString(w, string(value))
+		return nil
+	case Dict:
+		w.WriteByte('d')
+		for _, entry := range value {
+			encodeString(w, entry.Key)
+
+			if err := encodeValue(w, entry.Value); err != nil {
+				return fmt.Errorf("error while encoding dict value: %w", err)
+			}
+		}
+		w.WriteByte('e')
+		return nil
+	}
+
 	switch token := reflect.ValueOf(contents); token.Kind() {
+	case reflect.Invalid:
+		return fmt.Errorf("cannot serialize nil value")
+	case reflect.Bool:
+		if token.Bool() {
+			w.WriteString("i1e")
+		} else {
+			w.WriteString("i0e")
+		}
 	case reflect.String:
-		str := token.String()
-		return fmt.Sprintf("%d:%s", len(str), str), nil
+		encodeString(w, token.String())
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return fmt.Sprintf("i%de", token.Int()), nil
+		w.WriteByte('i')
+		w.WriteString(strconv.FormatInt(token.Int(), 10))
+		w.WriteByte('e')
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return fmt.Sprintf("i%de", token.Uint()), nil
+		w.WriteByte('i')
+		w.WriteString(strconv.FormatUint(token.Uint(), 10))
+		w.WriteByte('e')
 	case reflect.Slice, reflect.Array:
-		var bencoded string
+		w.WriteByte('l')
 		for idx := range token.Len() {
-			itemCoded, err := EncodeBencode(token.Index(idx).Interface())
-			if err != nil {
-				return "", fmt.Errorf("error while encoding list item: %w", err)
+			if err := encodeValue(w, token.Index(idx).Interface()); err != nil {
+				return fmt.Errorf("error while encoding list item: %w", err)
 			}
-			bencoded += itemCoded
 		}
-		return "l" + bencoded + "e", nil
+		w.WriteByte('e')
 	case reflect.Map:
-		var bencoded string
-
-		orderedKeys := []string{}
-		for _, value := range token.MapKeys() {
-			orderedKeys = append(orderedKeys, value.String())
-		}
-		slices.Sort(orderedKeys)
-
-		for _, key := range orderedKeys {
-			keyCoded, err := EncodeBencode(key)
-			if err != nil {
-				return "", fmt.Errorf("error while encoding dict key: %w", err)
+		// Keys are sorted by their raw bytes as required by the specification,
+		// regardless of whether they hold valid UTF-8.
+		keys := token.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return bytes.Compare([]byte(a.String()), []byte(b.String()))
+		})
+
+		w.WriteByte('d')
+		for _, key := range keys {
+			if key.Kind() != reflect.String {
+				return fmt.Errorf("error while encoding dict key: cannot serialize key %v", key)
 			}
 
-			value := token.MapIndex(reflect.ValueOf(key))
+			encodeString(w, key.String())
 
-			valueCoded, err := EncodeBencode(value.Interface())
-			if err != nil {
-				return "", fmt.Errorf("error while encoding dict value: %w", err)
+			if err := encodeValue(w, token.MapIndex(key).Interface()); err != nil {
+				return fmt.Errorf("error while encoding dict value: %w", err)
 			}
-
-			bencoded += keyCoded + valueCoded
 		}
-		return "d" + bencoded + "e", nil
+		w.WriteByte('e')
 	default:
-		return "", fmt.Errorf("cannot serialize value %v", contents)
+		return fmt.Errorf("cannot serialize value %v", contents)
 	}
+
+	return nil
+}
+
+// encodeString writes 'str' to 'w' as a Bencode string.
+func encodeString(w encodeWriter, str string) {
+	w.WriteString(strconv.Itoa(len(str)))
+	w.WriteByte(':')
+	w.WriteString(str)
 }
@@ -0,0 +1,378 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+)
+
+// pieceHeavyInfo returns a Bencoded info dictionary whose pieces string is
+// 'size' bytes long.
+func pieceHeavyInfo(size int) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("d6:lengthi1e4:name4:test12:piece lengthi16384e6:pieces")
+	buf.WriteString(strconv.Itoa(size))
+	buf.WriteByte(':')
+	buf.Write(bytes.Repeat([]byte{'x'}, size))
+	buf.WriteByte('e')
+
+	return buf.Bytes()
+}
+
+func TestDecodeBencodeBytes(t *testing.T) {
+	data := pieceHeavyInfo(40)
+
+	fromBytes, err := DecodeBencodeBytes(data)
+	if err != nil {
+		t.Fatalf("could not decode bytes: %v", err)
+	}
+
+	fromString, err := DecodeBencode(string(data))
+	if err != nil {
+		t.Fatalf("could not decode string: %v", err)
+	}
+
+	if len(fromBytes) != 1 || len(fromString) != 1 {
+		t.Fatalf("expected a single token, got %d and %d", len(fromBytes), len(fromString))
+	}
+
+	dictionary := fromBytes[0].(map[string]any)
+	if dictionary["pieces"] != fromString[0].(map[string]any)["pieces"] {
+		t.Errorf("pieces decoded from bytes differ from those decoded from a string")
+	}
+}
+
+func TestSyntaxErrorContextIsCopied(t *testing.T) {
+	data := []byte("d4:spami1e3:egg")
+
+	_, err := DecodeBencodeBytes(data)
+
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("expected a SyntaxError, got %v", err)
+	}
+
+	context := syntaxErr.Context
+	for i := range data {
+		data[i] = '!'
+	}
+
+	if syntaxErr.Context != context || syntaxErr.Context == string(data[:len(context)]) {
+		t.Errorf("syntax error context changed with the input to %q", syntaxErr.Context)
+	}
+}
+
+// benchmarkDecode decodes a piece-heavy info dictionary of about 200 MB with the
+// scanner returned by 'newScanner'.
+func benchmarkDecode(b *testing.B, newScanner func(data []byte) *Scanner) {
+	const size = 200 << 20
+
+	data := pieceHeavyInfo(size)
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		scanner := newScanner(data)
+		scanner.MaxStringLen = size
+
+		if _, err := decodeScanner(scanner); err != nil {
+			b.Fatalf("could not decode: %v", err)
+		}
+	}
+}
+
+func BenchmarkDecodeCopy(b *testing.B) {
+	benchmarkDecode(b, func(data []byte) *Scanner {
+		return &Scanner{Contents: string(data)}
+	})
+}
+
+func BenchmarkDecodeBytes(b *testing.B) {
+	benchmarkDecode(b, NewScannerBytes)
+}
+
+func TestParseBencodeInteger(t *testing.T) {
+	valid := map[string]int64{
+		"i0e":    0,
+		"i3e":    3,
+		"i-3e":   -3,
+		"i10e":   10,
+		"i-120e": -120,
+	}
+
+	for encoded, expected := range valid {
+		t.Run(encoded, func(t *testing.T) {
+			number, err := ParseBencodeInteger(&Scanner{Contents: encoded})
+			if err != nil {
+				t.Fatalf("could not parse %q: %v", encoded, err)
+			}
+
+			if number != expected {
+				t.Errorf("parsed %q as %d, expected %d", encoded, number, expected)
+			}
+		})
+	}
+}
+
+func TestParseBencodeIntegerMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"negative zero", "i-0e"},
+		{"leading zero", "i03e"},
+		{"leading zeros", "i007e"},
+		{"negative leading zero", "i-03e"},
+		{"empty body", "ie"},
+		{"sign only", "i-e"},
+		{"plus sign", "i+3e"},
+		{"non-digit", "i3ae"},
+		{"unterminated", "i3"},
+		{"overflow", "i9223372036854775808e"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			number, err := ParseBencodeInteger(&Scanner{Contents: test.encoded})
+
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("parsed %q as %d instead of returning a syntax error (got %v)", test.encoded, number, err)
+			}
+
+			if _, err := NewDecoder(bytes.NewReader([]byte(test.encoded))).Decode(); !errors.As(err, &syntaxErr) {
+				t.Errorf("decoder returned %v for %q instead of a syntax error", err, test.encoded)
+			}
+		})
+	}
+}
+
+func TestDecodeLargeInteger(t *testing.T) {
+	const expected int64 = 5000000000
+
+	tokens, err := DecodeBencode("i5000000000e")
+	if err != nil {
+		t.Fatalf("could not decode: %v", err)
+	}
+
+	if number, ok := tokens[0].(int64); !ok || number != expected {
+		t.Errorf("decoded %v (%T), expected %d", tokens[0], tokens[0], expected)
+	}
+
+	token, err := NewDecoder(bytes.NewReader([]byte("i5000000000e"))).Decode()
+	if err != nil {
+		t.Fatalf("could not stream decode: %v", err)
+	}
+
+	if number, ok := token.(int64); !ok || number != expected {
+		t.Errorf("stream decoded %v (%T), expected %d", token, token, expected)
+	}
+
+	var length struct {
+		Length int64 `bencode:"length"`
+	}
+	if err := Unmarshal([]byte("d6:lengthi5000000000ee"), &length); err != nil {
+		t.Fatalf("could not unmarshal: %v", err)
+	}
+
+	if length.Length != expected {
+		t.Errorf("unmarshaled length %d, expected %d", length.Length, expected)
+	}
+}
+
+// largeInfo returns a bencodable info dictionary with 'numPieces' pieces.
+func largeInfo(numPieces int) map[string]any {
+	return map[string]any{
+		"name":         "large",
+		"piece length": 16384,
+		"pieces":       string(bytes.Repeat([]byte{0xab}, 20*numPieces)),
+		"length":       int64(numPieces) * 16384,
+	}
+}
+
+func TestEncodeBencodeTo(t *testing.T) {
+	contents := map[string]any{
+		"list": []any{1, "two", []byte("three")},
+		"dict": map[string]any{"b": 2, "a": 1},
+		"info": largeInfo(100),
+	}
+
+	expected, err := EncodeBencode(contents)
+	if err != nil {
+		t.Fatalf("could not encode: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeBencodeTo(&buf, contents); err != nil {
+		t.Fatalf("could not encode to writer: %v", err)
+	}
+
+	if buf.String() != expected {
+		t.Errorf("EncodeBencodeTo wrote %q, expected %q", buf.String(), expected)
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestEncodeBencodeToWriteError(t *testing.T) {
+	if err := EncodeBencodeTo(failingWriter{}, largeInfo(1000)); err == nil {
+		t.Errorf("EncodeBencodeTo did not report the write error")
+	}
+}
+
+func BenchmarkEncodeBencodeInfo(b *testing.B) {
+	info := largeInfo(50000)
+	b.ReportAllocs()
+
+	for range b.N {
+		if err := EncodeBencodeTo(io.Discard, info); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEncodeBencodeRawKeyOrder(t *testing.T) {
+	contents := map[string]any{
+		"\xff":  1,
+		"z":     2,
+		"é":     3, // 0xc3 0xa9
+		"\x80a": 4,
+		"A":     5,
+	}
+
+	expected := "d1:Ai5e1:zi2e2:\x80ai4e2:éi3e1:\xffi1ee"
+
+	encoded, err := EncodeBencode(contents)
+	if err != nil {
+		t.Fatalf("could not encode: %v", err)
+	}
+
+	if encoded != expected {
+		t.Errorf("encoded as %q, expected %q", encoded, expected)
+	}
+
+	marshaled, err := Marshal(contents)
+	if err != nil {
+		t.Fatalf("could not marshal: %v", err)
+	}
+
+	if string(marshaled) != expected {
+		t.Errorf("marshaled as %q, expected %q", marshaled, expected)
+	}
+}
+
+func TestEncodeBencodeBool(t *testing.T) {
+	encoded, err := EncodeBencode(map[string]any{"seed": true, "private": false, "flags": []any{true, false}})
+	if err != nil {
+		t.Fatalf("could not encode: %v", err)
+	}
+
+	if expected := "d5:flagsli1ei0ee7:privatei0e4:seedi1ee"; encoded != expected {
+		t.Errorf("encoded as %q, expected %q", encoded, expected)
+	}
+}
+
+func TestEncodeBencodeNil(t *testing.T) {
+	values := map[string]any{
+		"nil":            nil,
+		"nil in list":    []any{1, nil},
+		"nil dict value": map[string]any{"a": nil},
+	}
+
+	for name, value := range values {
+		t.Run(name, func(t *testing.T) {
+			if encoded, err := EncodeBencode(value); err == nil {
+				t.Errorf("encoded %v as %q instead of returning an error", value, encoded)
+			}
+		})
+	}
+}
+
+func TestSkipToken(t *testing.T) {
+	valid := []string{
+		"4:spam",
+		"0:",
+		"i-42e",
+		"le",
+		"l4:spami1eli2eee",
+		"d3:bar4:spam3:fooi42ee",
+		"d1:ad1:bl1:ceee",
+	}
+
+	for _, token := range valid {
+		t.Run(token, func(t *testing.T) {
+			scanner := &Scanner{Contents: token + "i7e"}
+
+			if err := SkipToken(scanner); err != nil {
+				t.Fatalf("could not skip %q: %v", token, err)
+			}
+
+			if scanner.CurrentIndex != len(token) {
+				t.Errorf("skipped to byte %d, expected %d", scanner.CurrentIndex, len(token))
+			}
+		})
+	}
+
+	invalid := []string{
+		"",
+		"x",
+		"5:spam",
+		"i03e",
+		"l4:spam",
+		"d3:fooi1e3:bari2ee", // unsorted keys
+		"d3:fooi1e3:fooi2ee", // duplicate keys
+		"di1ei2ee",           // integer key
+		"d3:fooe",            // missing value
+	}
+
+	for _, token := range invalid {
+		t.Run(token, func(t *testing.T) {
+			var syntaxErr *SyntaxError
+			if err := SkipToken(&Scanner{Contents: token}); !errors.As(err, &syntaxErr) {
+				t.Errorf("skipping %q returned %v, expected a syntax error", token, err)
+			}
+		})
+	}
+}
+
+func TestParseBencodeDictionaryKeys(t *testing.T) {
+	contents := "d8:announce3:url7:comment4:text4:infod4:name4:testee"
+
+	dictionary, spans, err := ParseBencodeDictionaryKeys(&Scanner{Contents: contents}, "announce", "info")
+	if err != nil {
+		t.Fatalf("could not parse dictionary: %v", err)
+	}
+
+	if dictionary["announce"] != "url" {
+		t.Errorf("announce decoded as %v", dictionary["announce"])
+	}
+
+	if info, ok := dictionary["info"].(map[string]any); !ok || info["name"] != "test" {
+		t.Errorf("info decoded as %v", dictionary["info"])
+	}
+
+	if _, ok := dictionary["comment"]; ok {
+		t.Errorf("decoded the unrequested comment key")
+	}
+
+	for key, raw := range map[string]string{"comment": "4:text", "info": "d4:name4:teste"} {
+		if span, ok := spans[key]; !ok || contents[span.Start:span.End] != raw {
+			t.Errorf("span of %q covers %q, expected %q", key, contents[span.Start:span.End], raw)
+		}
+	}
+
+	// Skipped values are still checked.
+	if _, _, err := ParseBencodeDictionaryKeys(&Scanner{Contents: "d7:commenti-0ee"}, "announce"); err == nil {
+		t.Errorf("accepted an invalid skipped value")
+	}
+}
@@ -0,0 +1,300 @@
+/* A streaming Bencode decoder. */
+
+package bencode
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The maximum number of characters of an integer or string length, enough for
+// any int64 and its sign.
+const maxDigits = 20
+
+// A Decoder reads and decodes Bencode values from an input stream.
+//
+// Unlike DecodeBencode, a Decoder does not require the entire input to be held
+// in memory before parsing. Bytes are pulled from the stream as they are needed.
+type Decoder struct {
+	reader        *bufio.Reader
+	offset        int // The number of bytes consumed from the stream.
+	binaryStrings bool
+	maxStringLen  int
+}
+
+// NewDecoder returns a new decoder that reads from 'r'.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{reader: bufio.NewReader(r), maxStringLen: MAX_STRING_LEN}
+}
+
+// UseBinaryStrings causes the Decoder to decode Bencode strings as []byte
+// rather than string. Dictionary keys are always decoded as strings.
+func (d *Decoder) UseBinaryStrings() {
+	d.binaryStrings = true
+}
+
+// SetMaxStringLen sets the maximum length in bytes of a Bencode string to 'n'.
+// Strings declaring a greater length return an error wrapping ErrStringTooLong
+// before any of their contents are read. A non-positive 'n' restores the default
+// of MAX_STRING_LEN.
+func (d *Decoder) SetMaxStringLen(n int) {
+	if n <= 0 {
+		n = MAX_STRING_LEN
+	}
+
+	d.maxStringLen = n
+}
+
+// Decode reads the next Bencode token from the input stream and returns it as
+// a Go object.
+//
+// When the stream ends between top-level tokens, Decode returns io.EOF. Input
+// that is not valid Bencode returns a *SyntaxError whose offset counts the bytes
+// consumed from the stream; if the stream ends in the middle of a token, the
+// error wraps io.ErrUnexpectedEOF.
+func (d *Decoder) Decode() (any, error) {
+	if err := d.skipWhitespace(); err != nil {
+		return nil, err
+	}
+
+	return d.decodeToken()
+}
+
+// readByte consumes the next byte of the stream.
+func (d *Decoder) readByte() (byte, error) {
+	ch, err := d.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	d.offset++
+	return ch, nil
+}
+
+// skipWhitespace discards all whitespace characters at the front of the stream.
+func (d *Decoder) skipWhitespace() error {
+	for {
+		ch, err := d.reader.Peek(1)
+		if err != nil {
+			return err
+		}
+
+		if !unicode.IsSpace(rune(ch[0])) {
+			return nil
+		}
+
+		d.readByte()
+	}
+}
+
+// peekByte returns the next byte of the stream without consuming it. The end of
+// the stream is reported as a SyntaxError wrapping io.ErrUnexpectedEOF.
+func (d *Decoder) peekByte() (byte, error) {
+	ch, err := d.reader.Peek(1)
+	if err != nil {
+		return 0, d.readError(err)
+	}
+
+	return ch[0], nil
+}
+
+// readError returns 'err', an error from the stream, as a SyntaxError wrapping
+// io.ErrUnexpectedEOF if the stream ended.
+func (d *Decoder) readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return d.syntaxError(d.offset, io.ErrUnexpectedEOF, "unexpected end of input")
+	}
+
+	return err
+}
+
+// readUntil consumes the stream up to and including 'delimiter' and returns
+// the contents before the delimiter, which may be at most maxDigits bytes long.
+func (d *Decoder) readUntil(delimiter byte) (string, error) {
+	start := d.offset
+	var contents []byte
+
+	for {
+		ch, err := d.readByte()
+		if err != nil {
+			return "", d.readError(err)
+		}
+
+		if ch == delimiter {
+			return string(contents), nil
+		}
+
+		if len(contents) == maxDigits {
+			return "", d.syntaxError(start, nil, "expected %q within %d bytes", delimiter, maxDigits)
+		}
+
+		contents = append(contents, ch)
+	}
+}
+
+// decodeToken decodes any valid Bencode token from the stream.
+func (d *Decoder) decodeToken() (any, error) {
+	ch, err := d.peekByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if unicode.IsDigit(rune(ch)) {
+		str, err := d.decodeString()
+		if err != nil || !d.binaryStrings {
+			return str, err
+		}
+
+		return []byte(str), nil
+	} else if ch == 'i' {
+		return d.decodeInteger()
+	} else if ch == 'l' {
+		return d.decodeList()
+	} else if ch == 'd' {
+		return d.decodeDictionary()
+	}
+
+	return nil, d.syntaxError(d.offset, nil, "unexpected character %q", []byte{ch})
+}
+
+// decodeString decodes a Bencode string of the form 'length:string' by reading
+// exactly 'length' bytes from the stream. The contents are read as they arrive,
+// so a stream ending early does not cost an allocation of the declared length.
+func (d *Decoder) decodeString() (string, error) {
+	start := d.offset
+
+	digitStr, err := d.readUntil(':')
+	if err != nil {
+		return "", err
+	}
+
+	strLen, err := strconv.Atoi(digitStr)
+	if err != nil {
+		return "", d.syntaxError(start, err, "invalid string length %q", digitStr)
+	}
+
+	if strLen < 0 {
+		return "", d.syntaxError(start, nil, "negative string length %d", strLen)
+	}
+
+	if strLen > d.maxStringLen {
+		return "", d.syntaxError(start, ErrStringTooLong, "string length %d exceeds limit of %d", strLen, d.maxStringLen)
+	}
+
+	var contents strings.Builder
+
+	read, err := io.CopyN(&contents, d.reader, int64(strLen))
+	d.offset += int(read)
+
+	if err != nil {
+		return "", d.readError(err)
+	}
+
+	return contents.String(), nil
+}
+
+// decodeInteger decodes a Bencode integer of the form 'i...e'.
+func (d *Decoder) decodeInteger() (int64, error) {
+	start := d.offset
+	d.readByte() // past the 'i'
+
+	digitStr, err := d.readUntil('e')
+	if err != nil {
+		return 0, err
+	}
+
+	number, err := parseInteger(digitStr)
+	if err != nil {
+		return 0, d.syntaxError(start, err, "%s", err)
+	}
+
+	return number, nil
+}
+
+// decodeList decodes a Bencode list of the form 'l...e'.
+func (d *Decoder) decodeList() ([]any, error) {
+	var tokens []any
+
+	d.readByte() // past the 'l'
+
+	for {
+		if err := d.skipWhitespace(); err != nil {
+			return nil, d.readError(err)
+		}
+
+		ch, err := d.peekByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if ch == 'e' {
+			d.readByte() // past the 'e'
+			break
+		}
+
+		token, err := d.decodeToken()
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+// decodeDictionary decodes a Bencode dictionary of the form 'd...e'.
+func (d *Decoder) decodeDictionary() (map[string]any, error) {
+	dictionary := make(map[string]any)
+	var lastKey string
+
+	d.readByte() // past the 'd'
+
+	for {
+		if err := d.skipWhitespace(); err != nil {
+			return nil, d.readError(err)
+		}
+
+		ch, err := d.peekByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if ch == 'e' {
+			d.readByte() // past the 'e'
+			break
+		}
+
+		if !unicode.IsDigit(rune(ch)) {
+			return nil, d.syntaxError(d.offset, nil, "dictionary key must be a string, got %q", []byte{ch})
+		}
+
+		keyStart := d.offset
+
+		keyStr, err := d.decodeString()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(dictionary) > 0 && keyStr <= lastKey {
+			return nil, d.syntaxError(keyStart, nil, "dictionary key %q is not in sorted order", keyStr)
+		}
+		lastKey = keyStr
+
+		if err := d.skipWhitespace(); err != nil {
+			return nil, d.readError(err)
+		}
+
+		value, err := d.decodeToken()
+		if err != nil {
+			return nil, err
+		}
+
+		dictionary[keyStr] = value
+	}
+
+	return dictionary, nil
+}
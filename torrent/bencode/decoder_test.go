@@ -0,0 +1,119 @@
+package bencode
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	decoder := NewDecoder(strings.NewReader("d3:bar4:spam3:fooi42ee l1:ai-1ee 4:last"))
+
+	expected := []any{
+		map[string]any{"bar": "spam", "foo": int64(42)},
+		[]any{"a", int64(-1)},
+		"last",
+	}
+
+	for _, value := range expected {
+		token, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("could not decode: %v", err)
+		}
+
+		if !reflect.DeepEqual(token, value) {
+			t.Errorf("decoded %#v, expected %#v", token, value)
+		}
+	}
+
+	if token, err := decoder.Decode(); err != io.EOF {
+		t.Errorf("decoded %v (%v) at the end of the stream, expected io.EOF", token, err)
+	}
+}
+
+func TestDecoderSyntaxError(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		offset  int
+		err     error
+	}{
+		{"unexpected character", "x", 0, nil},
+		{"unexpected character after whitespace", "li1e x", 5, nil},
+		{"non-string key", "di1ei2ee", 1, nil},
+		{"unsorted keys", "d3:fooi1e3:bari2ee", 9, nil},
+		{"invalid integer", "di0e", 1, nil},
+		{"leading zero", "i-0e", 0, nil},
+		{"invalid string length", "1x:a", 0, nil},
+		{"over-long integer", "i" + strings.Repeat("1", 30) + "e", 1, nil},
+		{"over-long string length", strings.Repeat("1", 30) + ":", 0, nil},
+		{"string too long", "104857601:", 0, ErrStringTooLong},
+		{"unterminated integer", "i12", 3, io.ErrUnexpectedEOF},
+		{"unterminated dictionary", "d3:foo", 6, io.ErrUnexpectedEOF},
+		{"unterminated list", "li1e ", 5, io.ErrUnexpectedEOF},
+		{"short string", "5:ab", 4, io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := NewDecoder(strings.NewReader(test.encoded)).Decode()
+
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("decoded %v (%v) instead of returning a syntax error", token, err)
+			}
+
+			if syntaxErr.Offset != test.offset {
+				t.Errorf("error %q at byte %d, expected byte %d", err, syntaxErr.Offset, test.offset)
+			}
+
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("error %q does not wrap %q", err, test.err)
+			}
+		})
+	}
+}
+
+// digits is an endless stream of digits.
+type digits struct{}
+
+func (digits) Read(p []byte) (int, error) {
+	for idx := range p {
+		p[idx] = '1'
+	}
+
+	return len(p), nil
+}
+
+func TestDecoderEndlessDigits(t *testing.T) {
+	for _, prefix := range []string{"", "i"} {
+		_, err := NewDecoder(io.MultiReader(strings.NewReader(prefix), digits{})).Decode()
+
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("decoding endless digits after %q returned %v, expected a syntax error", prefix, err)
+		}
+	}
+}
+
+func TestDecoderShortStringAllocation(t *testing.T) {
+	// A string declaring the maximum length but holding a few bytes only.
+	encoded := "104857600:abc"
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	_, err := NewDecoder(strings.NewReader(encoded)).Decode()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("decoded a short string with error %v, expected io.ErrUnexpectedEOF", err)
+	}
+
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("decoding a short string allocated %d bytes", allocated)
+	}
+}
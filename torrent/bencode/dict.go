@@ -0,0 +1,37 @@
+/* Dictionaries that keep the order of their entries. */
+
+package bencode
+
+// A DictEntry represents a key and its value within a Dict.
+type DictEntry struct {
+	Key   string
+	Value any
+}
+
+// A Dict represents a Bencode dictionary whose entries are kept in the order
+// they appear in the input, as decoded by DecodeBencodeOrdered.
+//
+// Unlike a map[string]any, a Dict can be encoded back to the exact bytes it was
+// decoded from, which allows callers to check that an input is canonical.
+type Dict []DictEntry
+
+// Get returns the value of the entry with 'key' and whether it exists.
+func (d Dict) Get(key string) (any, bool) {
+	for _, entry := range d {
+		if entry.Key == key {
+			return entry.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Keys returns the keys of the entries, in order.
+func (d Dict) Keys() []string {
+	keys := make([]string, len(d))
+	for idx, entry := range d {
+		keys[idx] = entry.Key
+	}
+
+	return keys
+}
@@ -0,0 +1,60 @@
+/* Errors reported while parsing Bencode. */
+
+package bencode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The default maximum length in bytes of a decoded Bencode string.
+const MAX_STRING_LEN = 100 << 20
+
+// ErrStringTooLong is returned when a Bencode string declares a length greater
+// than the maximum allowed by the Scanner or Decoder.
+var ErrStringTooLong = errors.New("string length exceeds limit")
+
+// The number of bytes on either side of the offset included in the context of
+// a SyntaxError.
+const syntaxContextSize = 10
+
+// A SyntaxError is returned when the input is not valid Bencode.
+type SyntaxError struct {
+	Offset  int    // The byte offset in the input at which the error was detected.
+	Msg     string // A description of the error.
+	Context string // A short snippet of the input surrounding the offset.
+	Err     error  // The underlying error, if any.
+}
+
+func (e *SyntaxError) Error() string {
+	if len(e.Context) == 0 {
+		return fmt.Sprintf("byte %d: %s", e.Offset, e.Msg)
+	}
+
+	return fmt.Sprintf("byte %d: %s (near %q)", e.Offset, e.Msg, e.Context)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// syntaxError returns a SyntaxError at 'offset' wrapping 'err', with a message
+// built from 'format' and 'args' and the surrounding contents as context.
+func (s *Scanner) syntaxError(offset int, err error, format string, args ...any) *SyntaxError {
+	start := max(0, min(offset, len(s.Contents))-syntaxContextSize)
+	end := min(len(s.Contents), offset+syntaxContextSize)
+
+	return &SyntaxError{
+		Offset:  offset,
+		Msg:     fmt.Sprintf(format, args...),
+		Context: strings.Clone(s.Contents[start:end]),
+		Err:     err,
+	}
+}
+
+// syntaxError returns a SyntaxError at 'offset' wrapping 'err', with a message
+// built from 'format' and 'args'. The stream is not kept, so there is no context.
+func (d *Decoder) syntaxError(offset int, err error, format string, args ...any) *SyntaxError {
+	return &SyntaxError{Offset: offset, Msg: fmt.Sprintf(format, args...), Err: err}
+}
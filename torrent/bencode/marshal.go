@@ -0,0 +1,145 @@
+/* Encoding of Go values into Bencode via reflection. */
+
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+)
+
+// Marshal returns the canonical Bencode encoding of 'v', in the manner of
+// encoding/json.
+//
+// Strings, byte slices and byte arrays are encoded as Bencode strings; integers
+// as Bencode integers; booleans as the integers 1 and 0; other slices and arrays
+// as lists; maps with string keys and structs as dictionaries. Struct fields are
+// encoded as described by their `bencode` tags (see Unmarshal) and nil pointers
+// and interfaces are only allowed in fields marked "omitempty".
+//
+// Dictionary keys are sorted by their raw bytes, so the same value is always
+// encoded to the same bytes.
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := marshalValue(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// marshalString writes 'str' to 'buf' as a Bencode string.
+func marshalString(buf *bytes.Buffer, str string) {
+	buf.WriteString(strconv.Itoa(len(str)))
+	buf.WriteByte(':')
+	buf.WriteString(str)
+}
+
+// marshalValue writes the Bencode encoding of 'value' to 'buf'.
+func marshalValue(buf *bytes.Buffer, value reflect.Value) error {
+	if !value.IsValid() {
+		return fmt.Errorf("cannot marshal nil value")
+	}
+
+	if value.Type() == reflect.TypeFor[Dict]() {
+		return encodeValue(buf, value.Interface())
+	}
+
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if value.IsNil() {
+			return fmt.Errorf("cannot marshal nil %s", value.Type())
+		}
+
+		return marshalValue(buf, value.Elem())
+	case reflect.Bool:
+		if value.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+	case reflect.String:
+		marshalString(buf, value.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(value.Int(), 10))
+		buf.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(value.Uint(), 10))
+		buf.WriteByte('e')
+	case reflect.Slice, reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			contents := make([]byte, value.Len())
+			reflect.Copy(reflect.ValueOf(contents), value)
+			marshalString(buf, string(contents))
+			return nil
+		}
+
+		buf.WriteByte('l')
+		for idx := range value.Len() {
+			if err := marshalValue(buf, value.Index(idx)); err != nil {
+				return fmt.Errorf("error while encoding list item: %w", err)
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("cannot marshal map with %s keys", value.Type().Key())
+		}
+
+		keys := value.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return bytes.Compare([]byte(a.String()), []byte(b.String()))
+		})
+
+		buf.WriteByte('d')
+		for _, key := range keys {
+			marshalString(buf, key.String())
+
+			if err := marshalValue(buf, value.MapIndex(key)); err != nil {
+				return fmt.Errorf("error while encoding dict value %q: %w", key.String(), err)
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Struct:
+		fields := structFields(value.Type())
+		slices.SortFunc(fields, func(a, b field) int {
+			return bytes.Compare([]byte(a.name), []byte(b.name))
+		})
+
+		buf.WriteByte('d')
+		for _, field := range fields {
+			fieldValue := value.Field(field.index)
+			if field.omitEmpty && isEmptyValue(fieldValue) {
+				continue
+			}
+
+			marshalString(buf, field.name)
+
+			if err := marshalValue(buf, fieldValue); err != nil {
+				return fmt.Errorf("error while encoding field %q: %w", field.name, err)
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("cannot marshal value of type %s", value.Type())
+	}
+
+	return nil
+}
+
+// isEmptyValue reports whether 'value' is omitted by the "omitempty" option,
+// that is, whether it is a zero number, an empty string, slice or map, or a
+// nil pointer or interface.
+func isEmptyValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return value.Len() == 0
+	default:
+		return value.IsZero()
+	}
+}
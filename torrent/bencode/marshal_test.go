@@ -0,0 +1,76 @@
+package bencode
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+type marshalTest struct {
+	Name     string            `bencode:"name"`
+	Pieces   []byte            `bencode:"pieces"`
+	Hash     [4]byte           `bencode:"hash"`
+	Length   int64             `bencode:"length,omitempty"`
+	Private  bool              `bencode:"private"`
+	Paths    [][]string        `bencode:"paths"`
+	Extra    map[string]int    `bencode:"extra,omitempty"`
+	Ignored  string            `bencode:"-"`
+	Optional *marshalTestInner `bencode:"optional,omitempty"`
+}
+
+type marshalTestInner struct {
+	Value string `bencode:"value"`
+}
+
+func TestMarshal(t *testing.T) {
+	value := marshalTest{
+		Name:    "test",
+		Pieces:  []byte{0x00, 0xff, 'e'},
+		Hash:    [4]byte{1, 2, 3, 4},
+		Private: true,
+		Paths:   [][]string{{"a", "b"}, {"c"}},
+		Extra:   map[string]int{"z": 1, "a": 2},
+		Ignored: "ignored",
+	}
+
+	encoded, err := Marshal(value)
+	if err != nil {
+		t.Fatalf("could not marshal: %v", err)
+	}
+
+	expected := "d5:extrad1:ai2e1:zi1ee4:hash4:\x01\x02\x03\x044:name4:test5:pathsll1:a1:bel1:cee" +
+		"6:pieces3:\x00\xffe7:privatei1ee"
+	if string(encoded) != expected {
+		t.Errorf("marshaled as %q, expected %q", encoded, expected)
+	}
+
+	// The encoding must not depend on map iteration order.
+	for range 20 {
+		again, err := Marshal(value)
+		if err != nil || !bytes.Equal(again, encoded) {
+			t.Fatalf("marshaling again returned %q (%v)", again, err)
+		}
+	}
+
+	var decoded marshalTest
+	if err := Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("could not unmarshal: %v", err)
+	}
+
+	value.Ignored = ""
+	if !reflect.DeepEqual(decoded, value) {
+		t.Errorf("round trip returned %+v, expected %+v", decoded, value)
+	}
+}
+
+func TestMarshalNil(t *testing.T) {
+	if _, err := Marshal(nil); err == nil {
+		t.Errorf("marshaled a nil value")
+	}
+
+	if _, err := Marshal(struct {
+		Inner *marshalTestInner `bencode:"inner"`
+	}{}); err == nil {
+		t.Errorf("marshaled a nil pointer in a field without omitempty")
+	}
+}
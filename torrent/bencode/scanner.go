@@ -2,13 +2,47 @@
 package bencode
 
 import (
+	"fmt"
 	"io"
+	"strings"
 	"unicode"
+	"unsafe"
 )
 
 type Scanner struct {
 	Contents     string
 	CurrentIndex int
+
+	// Whether Bencode strings are decoded as []byte rather than string. Dictionary
+	// keys are always decoded as strings.
+	BinaryStrings bool
+	// Whether Bencode dictionaries are decoded as Dict rather than map[string]any.
+	OrderedDicts bool
+	// The maximum length in bytes of a Bencode string. Defaults to MAX_STRING_LEN.
+	MaxStringLen int
+}
+
+// NewScannerBytes returns a scanner over 'data' without copying it into a string.
+//
+// The scanner's Contents and every string it produces, including dictionary keys,
+// strings nested in lists and dictionaries and slices of Contents taken by the
+// caller, share memory with 'data'. Modifying 'data' afterwards changes those
+// strings in place, breaking the immutability Go assumes of them, so 'data' must
+// not be modified or reused for as long as any of them remain reachable. Callers
+// which cannot guarantee this should use a Scanner over string(data) instead.
+//
+// String values decoded as []byte with BinaryStrings set, as well as the context
+// of syntax errors, are copied and do not share memory with 'data'.
+func NewScannerBytes(data []byte) *Scanner {
+	return &Scanner{Contents: unsafe.String(unsafe.SliceData(data), len(data))}
+}
+
+// maxStringLen returns the maximum length of a Bencode string.
+func (s *Scanner) maxStringLen() int {
+	if s.MaxStringLen <= 0 {
+		return MAX_STRING_LEN
+	}
+	return s.MaxStringLen
 }
 
 // Ended reports whether the scanner has reached the end of contents
@@ -18,22 +52,31 @@ func (s *Scanner) Ended() bool {
 
 // Peek gets 'n' characters from the scanner without advancing.
 func (s *Scanner) Peek(n int) (string, error) {
-	if s.CurrentIndex+n-1 >= len(s.Contents) {
+	if n > len(s.Contents)-s.CurrentIndex {
 		return "", io.EOF
 	}
 	return s.Contents[s.CurrentIndex : s.CurrentIndex+n], nil
 }
 
-// Consume consumes and returns at most 'n' characters.
+// PeekByte gets the next byte from the scanner without advancing. Returns
+// false if the scanner has ended.
+func (s *Scanner) PeekByte() (byte, bool) {
+	if s.Ended() {
+		return 0, false
+	}
+	return s.Contents[s.CurrentIndex], true
+}
+
+// Consume consumes and returns exactly 'n' characters. Returns an error wrapping
+// io.ErrUnexpectedEOF without advancing if fewer than 'n' characters remain.
 func (s *Scanner) Consume(n int) (string, error) {
 	consumed, err := s.Peek(n)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: wanted %d bytes, %d remaining", io.ErrUnexpectedEOF, n, len(s.Contents)-s.CurrentIndex)
 	}
-	if s.Advance(n) {
-		return consumed, nil
-	}
-	return "", nil
+
+	s.CurrentIndex += n
+	return consumed, nil
 }
 
 // Advance skips 'n' characters in the scanner. Returns whether the scanner was advanced.
@@ -53,12 +96,8 @@ func (s *Scanner) Advance(n int) bool {
 // space (' '), next line (U+0085; NEL) and non-breaking space (U+00A0; NBSP).
 func (s *Scanner) AdvanceWhitespace() {
 	for {
-		ch, err := s.Peek(1)
-		if err == io.EOF {
-			break
-		}
-
-		if !unicode.IsSpace(rune(ch[0])) {
+		ch, ok := s.PeekByte()
+		if !ok || !unicode.IsSpace(rune(ch)) {
 			break
 		}
 
@@ -66,6 +105,18 @@ func (s *Scanner) AdvanceWhitespace() {
 	}
 }
 
+// ExpectEnd skips through trailing whitespace and returns an error if any
+// contents remain after it.
+func (s *Scanner) ExpectEnd() error {
+	s.AdvanceWhitespace()
+
+	if !s.Ended() {
+		return fmt.Errorf("unexpected trailing data at byte %d", s.CurrentIndex)
+	}
+
+	return nil
+}
+
 // ConsumeUntil scans until 'delimiter' is reached.
 //
 // It returns a string of the contents before the delimiter and a boolean
@@ -77,23 +128,14 @@ func (s *Scanner) ConsumeUntil(delimiter byte) (string, bool) {
 		return "", false
 	}
 
-	delimiterFound := false
-	var accumulated string
+	rest := s.Contents[s.CurrentIndex:]
 
-	for !delimiterFound {
-		ch, err := s.Peek(1)
-		if err == io.EOF {
-			break
-		}
-
-		if ch[0] == delimiter {
-			delimiterFound = true
-			break
-		}
-
-		accumulated += ch
-		s.Advance(1)
+	end := strings.IndexByte(rest, delimiter)
+	if end < 0 {
+		s.CurrentIndex = len(s.Contents)
+		return rest, false
 	}
 
-	return accumulated, delimiterFound
+	s.CurrentIndex += end
+	return rest[:end], true
 }
@@ -0,0 +1,259 @@
+/* Decoding of Bencode into Go values via reflection. */
+
+package bencode
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// An UnmarshalTypeError describes a Bencode value that was not appropriate for
+// a value of a specific Go type.
+type UnmarshalTypeError struct {
+	Value string       // A description of the Bencode value, such as "string" or "list".
+	Type  reflect.Type // The type of the Go value it could not be assigned to.
+	Field string       // The path of the struct field holding the value, if any.
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if len(e.Field) > 0 {
+		return fmt.Sprintf("cannot unmarshal %s into field %s of type %s", e.Value, e.Field, e.Type)
+	}
+
+	return fmt.Sprintf("cannot unmarshal %s into value of type %s", e.Value, e.Type)
+}
+
+// A field represents a struct field that is encoded as a dictionary entry.
+type field struct {
+	name      string // The dictionary key of the field.
+	index     int    // The index of the field within the struct.
+	omitEmpty bool   // Whether the field is omitted when empty.
+}
+
+// structFields returns the fields of struct type 't' that are encoded as
+// dictionary entries.
+//
+// The key of a field is given by its `bencode:"name"` tag, or by the field name
+// if no tag is present. A tag of "-" excludes the field, as do unexported fields.
+// The "omitempty" option causes the field to be omitted from the output if it
+// holds the zero value of its type.
+func structFields(t reflect.Type) []field {
+	var fields []field
+
+	for idx := range t.NumField() {
+		structField := t.Field(idx)
+		if !structField.IsExported() {
+			continue
+		}
+
+		tag := structField.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+		if len(name) == 0 {
+			name = structField.Name
+		}
+
+		fields = append(fields, field{
+			name:      name,
+			index:     idx,
+			omitEmpty: options == "omitempty",
+		})
+	}
+
+	return fields
+}
+
+// Unmarshal decodes the Bencode value in 'data' and stores the result in the
+// value pointed to by 'v', in the manner of encoding/json.
+//
+// Strings are stored in strings, byte slices and byte arrays of the exact length;
+// integers in any integer type that can hold them and in booleans, where any
+// non-zero integer is true; lists in slices and arrays; dictionaries in maps with
+// string keys and structs. Struct fields are matched against dictionary keys as
+// described by their `bencode` tags. Keys with no matching field are ignored and
+// fields with no matching key are left untouched.
+//
+// Returns an error if 'data' is not a single Bencode value or if a value cannot
+// be stored in the corresponding Go value.
+func Unmarshal(data []byte, v any) error {
+	tokens, err := DecodeBencode(string(data))
+	if err != nil {
+		return err
+	}
+
+	if len(tokens) != 1 {
+		return fmt.Errorf("expected a single value, got %d", len(tokens))
+	}
+
+	return UnmarshalToken(tokens[0], v)
+}
+
+// UnmarshalToken stores an already decoded Bencode 'token', such as one returned
+// by DecodeBencode, in the value pointed to by 'v' in the same way as Unmarshal.
+func UnmarshalToken(token any, v any) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Pointer || value.IsNil() {
+		return fmt.Errorf("cannot unmarshal into non-pointer or nil value %T", v)
+	}
+
+	return unmarshalValue(token, value.Elem(), "")
+}
+
+// describeToken returns the name of the Bencode type of 'token'.
+func describeToken(token any) string {
+	switch token.(type) {
+	case string, []byte:
+		return "string"
+	case int64:
+		return "integer"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "dictionary"
+	default:
+		return fmt.Sprintf("%T", token)
+	}
+}
+
+// unmarshalValue stores 'token' in 'value'. 'path' is the path of the struct
+// field being decoded and is used for error reporting.
+func unmarshalValue(token any, value reflect.Value, path string) error {
+	mismatch := &UnmarshalTypeError{Value: describeToken(token), Type: value.Type(), Field: path}
+
+	if bytes, ok := token.([]byte); ok {
+		token = string(bytes)
+	}
+
+	switch value.Kind() {
+	case reflect.Pointer:
+		if value.IsNil() {
+			value.Set(reflect.New(value.Type().Elem()))
+		}
+
+		return unmarshalValue(token, value.Elem(), path)
+	case reflect.Interface:
+		if value.NumMethod() > 0 {
+			return mismatch
+		}
+
+		value.Set(reflect.ValueOf(token))
+	case reflect.Bool:
+		number, ok := token.(int64)
+		if !ok {
+			return mismatch
+		}
+
+		value.SetBool(number != 0)
+	case reflect.String:
+		str, ok := token.(string)
+		if !ok {
+			return mismatch
+		}
+
+		value.SetString(str)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, ok := token.(int64)
+		if !ok || value.OverflowInt(number) {
+			return mismatch
+		}
+
+		value.SetInt(number)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, ok := token.(int64)
+		if !ok || number < 0 || value.OverflowUint(uint64(number)) {
+			return mismatch
+		}
+
+		value.SetUint(uint64(number))
+	case reflect.Slice:
+		if str, ok := token.(string); ok && value.Type().Elem().Kind() == reflect.Uint8 {
+			value.SetBytes([]byte(str))
+			return nil
+		}
+
+		items, ok := token.([]any)
+		if !ok {
+			return mismatch
+		}
+
+		slice := reflect.MakeSlice(value.Type(), len(items), len(items))
+		for idx, item := range items {
+			if err := unmarshalValue(item, slice.Index(idx), fmt.Sprintf("%s[%d]", path, idx)); err != nil {
+				return err
+			}
+		}
+
+		value.Set(slice)
+	case reflect.Array:
+		if str, ok := token.(string); ok && value.Type().Elem().Kind() == reflect.Uint8 {
+			if len(str) != value.Len() {
+				return mismatch
+			}
+
+			reflect.Copy(value, reflect.ValueOf([]byte(str)))
+			return nil
+		}
+
+		items, ok := token.([]any)
+		if !ok || len(items) != value.Len() {
+			return mismatch
+		}
+
+		for idx, item := range items {
+			if err := unmarshalValue(item, value.Index(idx), fmt.Sprintf("%s[%d]", path, idx)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		dictionary, ok := token.(map[string]any)
+		if !ok || value.Type().Key().Kind() != reflect.String {
+			return mismatch
+		}
+
+		if value.IsNil() {
+			value.Set(reflect.MakeMap(value.Type()))
+		}
+
+		for key, item := range dictionary {
+			elem := reflect.New(value.Type().Elem()).Elem()
+			if err := unmarshalValue(item, elem, joinPath(path, key)); err != nil {
+				return err
+			}
+
+			value.SetMapIndex(reflect.ValueOf(key).Convert(value.Type().Key()), elem)
+		}
+	case reflect.Struct:
+		dictionary, ok := token.(map[string]any)
+		if !ok {
+			return mismatch
+		}
+
+		for _, field := range structFields(value.Type()) {
+			item, ok := dictionary[field.name]
+			if !ok {
+				continue
+			}
+
+			if err := unmarshalValue(item, value.Field(field.index), joinPath(path, field.name)); err != nil {
+				return err
+			}
+		}
+	default:
+		return mismatch
+	}
+
+	return nil
+}
+
+// joinPath appends the dictionary 'key' to the field 'path'.
+func joinPath(path string, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+
+	return path + "." + key
+}
@@ -0,0 +1,237 @@
+/*
+Choking of peers when uploading, following the tit-for-tat algorithm.
+
+See https://bittorrent.org/beps/bep_0003.html and "Choking and Optimistic
+Unchoking" in https://wiki.theory.org/BitTorrentSpecification
+
+Every CHOKE_INTERVAL, the interested peers with the highest rates are unchoked
+and every other peer is choked. Every OPTIMISTIC_UNCHOKE_INTERVAL, a random
+choked peer is also unchoked so that new peers get a chance to prove their rate.
+*/
+
+package torrent
+
+import (
+	"context"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	CHOKE_INTERVAL              = 10 * time.Second // The interval between choking decisions.
+	OPTIMISTIC_UNCHOKE_INTERVAL = 30 * time.Second // The interval between optimistic unchoke rotations.
+	UNCHOKE_SLOTS               = 4                // The default number of peers unchoked by rate.
+)
+
+// A ChokeDecision represents a change in whether a peer is choked. Message is
+// either MessageChoke or MessageUnchoke.
+type ChokeDecision struct {
+	Client  *TCPClient
+	Message MessageId
+}
+
+// A ChokeManager decides which peers to upload to, unchoking up to Slots
+// interested peers with the highest rates plus one optimistic unchoke.
+//
+// Peers are ranked by the rate at which they send us data while downloading,
+// and by the rate at which we send them data while seeding. Rates are measured
+// over the time between choking decisions. A ChokeManager is safe for use by
+// multiple goroutines.
+type ChokeManager struct {
+	// The number of peers unchoked by rate. Defaults to UNCHOKE_SLOTS.
+	Slots int
+	// Whether we are seeding, in which case peers are ranked by upload rate.
+	Seeding bool
+
+	mu             sync.Mutex
+	peers          map[*TCPClient]*chokePeer
+	optimistic     *TCPClient
+	lastOptimistic time.Time
+	lastRechoke    time.Time
+}
+
+// chokePeer holds the choking state of a single peer.
+type chokePeer struct {
+	unchoked   bool
+	interested bool
+
+	received int64   // Bytes received since the last decision.
+	sent     int64   // Bytes sent since the last decision.
+	rate     float64 // Bytes per second measured at the last decision.
+}
+
+// NewChokeManager creates a choke manager with no peers.
+func NewChokeManager() *ChokeManager {
+	return &ChokeManager{
+		Slots:       UNCHOKE_SLOTS,
+		peers:       make(map[*TCPClient]*chokePeer),
+		lastRechoke: time.Now(),
+	}
+}
+
+// AddPeer starts tracking the peer of 'client', which is initially choked and
+// not interested.
+func (m *ChokeManager) AddPeer(client *TCPClient) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.peers[client]; !ok {
+		m.peers[client] = &chokePeer{}
+	}
+}
+
+// RemovePeer stops tracking the peer of 'client', such as once it disconnects.
+func (m *ChokeManager) RemovePeer(client *TCPClient) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.peers, client)
+
+	if m.optimistic == client {
+		m.optimistic = nil
+	}
+}
+
+// SetInterested records whether the peer of 'client' is interested in our pieces,
+// as reported by its interested and not interested messages. Only interested
+// peers are unchoked.
+func (m *ChokeManager) SetInterested(client *TCPClient, interested bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if peer, ok := m.peers[client]; ok {
+		peer.interested = interested
+	}
+}
+
+// Received records that 'n' bytes of piece data were received from the peer
+// of 'client'.
+func (m *ChokeManager) Received(client *TCPClient, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if peer, ok := m.peers[client]; ok {
+		peer.received += int64(n)
+	}
+}
+
+// Sent records that 'n' bytes of piece data were sent to the peer of 'client'.
+func (m *ChokeManager) Sent(client *TCPClient, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if peer, ok := m.peers[client]; ok {
+		peer.sent += int64(n)
+	}
+}
+
+// Rechoke measures the rate of every peer since the previous call and decides
+// which peers are unchoked at 'now'. Returns the peers whose state changed along
+// with the message that must be sent to them.
+//
+// The optimistic unchoke is rotated to a random choked peer if it is unset, if
+// it was unchoked by rate, or if OPTIMISTIC_UNCHOKE_INTERVAL has passed.
+func (m *ChokeManager) Rechoke(now time.Time) []ChokeDecision {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elapsed := now.Sub(m.lastRechoke).Seconds()
+	m.lastRechoke = now
+
+	var candidates []*TCPClient
+
+	for client, peer := range m.peers {
+		transferred := peer.received
+		if m.Seeding {
+			transferred = peer.sent
+		}
+
+		peer.rate = 0
+		if elapsed > 0 {
+			peer.rate = float64(transferred) / elapsed
+		}
+
+		peer.received, peer.sent = 0, 0
+
+		if peer.interested {
+			candidates = append(candidates, client)
+		}
+	}
+
+	slices.SortFunc(candidates, func(a, b *TCPClient) int {
+		if m.peers[a].rate > m.peers[b].rate {
+			return -1
+		} else if m.peers[a].rate < m.peers[b].rate {
+			return 1
+		}
+
+		return 0
+	})
+
+	slots := m.Slots
+	if slots <= 0 {
+		slots = UNCHOKE_SLOTS
+	}
+
+	unchoke := make(map[*TCPClient]bool)
+	for _, client := range candidates[:min(slots, len(candidates))] {
+		unchoke[client] = true
+	}
+
+	if m.optimistic == nil || unchoke[m.optimistic] || !m.peers[m.optimistic].interested ||
+		now.Sub(m.lastOptimistic) >= OPTIMISTIC_UNCHOKE_INTERVAL {
+		m.optimistic = nil
+
+		choked := candidates[min(slots, len(candidates)):]
+		if len(choked) > 0 {
+			m.optimistic = choked[rand.Intn(len(choked))]
+			m.lastOptimistic = now
+		}
+	}
+
+	if m.optimistic != nil {
+		unchoke[m.optimistic] = true
+	}
+
+	var decisions []ChokeDecision
+
+	for client, peer := range m.peers {
+		if unchoke[client] == peer.unchoked {
+			continue
+		}
+
+		peer.unchoked = unchoke[client]
+
+		message := MessageChoke
+		if peer.unchoked {
+			message = MessageUnchoke
+		}
+
+		decisions = append(decisions, ChokeDecision{Client: client, Message: message})
+	}
+
+	return decisions
+}
+
+// Run calls Rechoke every CHOKE_INTERVAL and sends the resulting choke and
+// unchoke messages until 'ctx' is done. Peers that cannot be sent a message are
+// removed from the manager.
+func (m *ChokeManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(CHOKE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, decision := range m.Rechoke(now) {
+				if err := decision.Client.SendMessage(Message{Id: decision.Message}); err != nil {
+					m.RemovePeer(decision.Client)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/* Creation of torrents from files on disk. */
+
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	minAutoPieceLength = 16 * 1024        // Smallest piece length chosen automatically (16 KiB).
+	maxAutoPieceLength = 16 * 1024 * 1024 // Largest piece length chosen automatically (16 MiB).
+	targetPieceCount   = 1500             // Number of pieces aimed for when choosing a piece length.
+)
+
+// A TorrentPlan represents the layout of a torrent created from a path on disk by
+// CreateTorrent, which is computed without reading or hashing any file contents.
+type TorrentPlan struct {
+	// The suggested name of the file or directory.
+	Name string
+	// In case of a multiple file torrent, the files that would be included in the torrent.
+	Files []InfoFile
+	// Number of bytes in each piece.
+	PieceLength int64
+	// Number of pieces the contents would be split into.
+	NumPieces int
+	// Total amount of bytes contained in the torrent.
+	TotalLength int64
+	// Whether the plan describes a single file torrent.
+	SingleFile bool
+
+	// The paths on disk of each file, in the same order as the torrent contents.
+	sources []string
+}
+
+// ChoosePieceLength returns a piece length suitable for a torrent containing
+// 'totalLength' bytes.
+//
+// The piece length is a power of two between 16 KiB and 16 MiB chosen so that
+// the torrent has roughly 1500 pieces.
+func ChoosePieceLength(totalLength int64) int64 {
+	var pieceLength int64 = minAutoPieceLength
+
+	for pieceLength < maxAutoPieceLength && totalLength/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+
+	return pieceLength
+}
+
+// planTorrent walks the file or directory at 'root' and computes the layout of
+// the torrent that would be created from it without reading file contents.
+//
+// If 'pieceLength' is zero or negative, a piece length is chosen via ChoosePieceLength.
+func planTorrent(root string, pieceLength int64) (*TorrentPlan, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("could not stat root: %w", err)
+	}
+
+	plan := &TorrentPlan{Name: filepath.Base(filepath.Clean(root))}
+
+	if !stat.IsDir() {
+		plan.SingleFile = true
+		plan.TotalLength = stat.Size()
+		plan.sources = []string{root}
+	} else {
+		err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if entry.IsDir() {
+				return nil
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			relPath, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+
+			plan.Files = append(plan.Files, InfoFile{
+				Length: info.Size(),
+				Path:   strings.Split(filepath.ToSlash(relPath), "/"),
+			})
+			plan.sources = append(plan.sources, path)
+			plan.TotalLength += info.Size()
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not walk directory: %w", err)
+		}
+	}
+
+	if pieceLength <= 0 {
+		pieceLength = ChoosePieceLength(plan.TotalLength)
+	}
+
+	plan.PieceLength = pieceLength
+	plan.NumPieces = int((plan.TotalLength + pieceLength - 1) / pieceLength)
+
+	return plan, nil
+}
+
+// CreateOptions configures how CreateTorrent builds a torrent.
+type CreateOptions struct {
+	// (optional) The number of bytes in each piece. If zero or negative, a piece
+	// length is chosen via ChoosePieceLength.
+	PieceLength int64
+	// (optional) The announce URL of the torrent tracker.
+	Announce string
+	// Whether to only compute the layout of the torrent (file list, piece length,
+	// piece count and total size) without reading or hashing any file contents.
+	DryRun bool
+}
+
+// CreateTorrent creates a torrent from the file or directory at 'root' as
+// configured by 'options'.
+//
+// A file produces a single file torrent and a directory produces a multiple file
+// torrent including every regular file within it. Zero-length files are included.
+//
+// Returns the torrent, the plan describing its layout and an error if any. In a
+// dry run, only the plan is returned and the torrent is nil. An error is returned
+// if 'root' is a directory with no files in it, or if the announce URL is not
+// empty and not valid as described by ValidateAnnounceURL.
+func CreateTorrent(root string, options CreateOptions) (*Torrent, *TorrentPlan, error) {
+	if len(options.Announce) > 0 {
+		if err := ValidateAnnounceURL(options.Announce); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	plan, err := planTorrent(root, options.PieceLength)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !plan.SingleFile && len(plan.Files) == 0 {
+		return nil, nil, fmt.Errorf("directory %q contains no files", root)
+	}
+
+	if options.DryRun {
+		return nil, plan, nil
+	}
+
+	pieces, err := hashSources(plan.sources, plan.PieceLength)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := Info{
+		Name:        plan.Name,
+		PieceLength: plan.PieceLength,
+		Pieces:      pieces,
+		Files:       plan.Files,
+	}
+
+	if plan.SingleFile {
+		info.Length = plan.TotalLength
+	}
+
+	return &Torrent{Info: info, AnnounceURL: options.Announce}, plan, nil
+}
+
+// hashSources reads the files at 'sources' as one concatenated stream and
+// returns the concatenated SHA1 hashes of each 'pieceLength' chunk. The final
+// chunk may be shorter than 'pieceLength'.
+func hashSources(sources []string, pieceLength int64) (string, error) {
+	var pieces []byte
+
+	piece := make([]byte, pieceLength)
+	var filled int64
+
+	for _, source := range sources {
+		file, err := os.Open(source)
+		if err != nil {
+			return "", fmt.Errorf("could not open file: %w", err)
+		}
+
+		for {
+			read, err := file.Read(piece[filled:])
+			filled += int64(read)
+
+			if filled == pieceLength {
+				sum := sha1.Sum(piece)
+				pieces = append(pieces, sum[:]...)
+				filled = 0
+			}
+
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				file.Close()
+				return "", fmt.Errorf("could not read file: %w", err)
+			}
+		}
+
+		file.Close()
+	}
+
+	if filled > 0 {
+		sum := sha1.Sum(piece[:filled])
+		pieces = append(pieces, sum[:]...)
+	}
+
+	return string(pieces), nil
+}
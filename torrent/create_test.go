@@ -0,0 +1,80 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFiles creates the files mapped by their slash-separated path to their
+// length under 'root'.
+func writeFiles(t *testing.T, root string, files map[string]int) {
+	t.Helper()
+
+	for name, length := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("could not create directory: %v", err)
+		}
+
+		if err := os.WriteFile(path, bytes.Repeat([]byte{'a'}, length), 0o644); err != nil {
+			t.Fatalf("could not write file: %v", err)
+		}
+	}
+}
+
+func TestCreateTorrentDryRun(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "content")
+	writeFiles(t, root, map[string]int{
+		"a.txt":       40000,
+		"empty":       0,
+		"sub/b.bin":   16384,
+		"sub/c/d.bin": 1,
+	})
+
+	singleFile := filepath.Join(root, "a.txt")
+
+	for _, path := range []string{root, singleFile} {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			options := CreateOptions{PieceLength: 16384}
+
+			torrent, plan, err := CreateTorrent(path, CreateOptions{PieceLength: options.PieceLength, DryRun: true})
+			if err != nil {
+				t.Fatalf("could not plan torrent: %v", err)
+			}
+
+			if torrent != nil {
+				t.Errorf("dry run created a torrent")
+			}
+
+			torrent, _, err = CreateTorrent(path, options)
+			if err != nil {
+				t.Fatalf("could not create torrent: %v", err)
+			}
+
+			if !reflect.DeepEqual(plan.Files, torrent.Info.Files) {
+				t.Errorf("planned files %+v, torrent has %+v", plan.Files, torrent.Info.Files)
+			}
+
+			if plan.NumPieces != torrent.Info.NumPieces() {
+				t.Errorf("planned %d pieces, torrent has %d", plan.NumPieces, torrent.Info.NumPieces())
+			}
+
+			if plan.TotalLength != torrent.Info.TotalLength() {
+				t.Errorf("planned %d bytes, torrent has %d", plan.TotalLength, torrent.Info.TotalLength())
+			}
+
+			if plan.PieceLength != torrent.Info.PieceLength || plan.Name != torrent.Info.Name {
+				t.Errorf("plan %+v does not match torrent info", plan)
+			}
+		})
+	}
+}
+
+func TestCreateTorrentEmptyDirectory(t *testing.T) {
+	if _, _, err := CreateTorrent(t.TempDir(), CreateOptions{DryRun: true}); err == nil {
+		t.Errorf("planned a torrent of an empty directory")
+	}
+}
@@ -0,0 +1,346 @@
+/*
+Client implementation of the BitTorrent distributed hash table (DHT).
+
+See https://bittorrent.org/beps/bep_0005.html
+
+This implementation performs read-only lookups: it finds peers of a torrent
+through iterative get_peers queries but neither announces itself nor answers
+queries from other nodes.
+*/
+
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aescarias/apricot/torrent"
+	"github.com/aescarias/apricot/torrent/bencode"
+)
+
+const (
+	ALPHA         = 3               // The number of queries sent concurrently during a lookup.
+	K             = 8               // The number of closest nodes a lookup converges on.
+	QUERY_TIMEOUT = 5 * time.Second // The time allowed for a node to respond to a query.
+	maxQueries    = 200             // The most nodes queried in a single lookup.
+)
+
+// The nodes used to join the DHT when no other nodes are known.
+var BootstrapNodes = []string{"router.bittorrent.com:6881"}
+
+// A NodeId represents the 160-bit identifier of a DHT node or an info hash.
+type NodeId [20]byte
+
+// distance returns the XOR distance between 'id' and 'other'.
+func (id NodeId) distance(other NodeId) NodeId {
+	var result NodeId
+	for idx := range id {
+		result[idx] = id[idx] ^ other[idx]
+	}
+
+	return result
+}
+
+// A Node represents a local DHT node bound to a UDP socket.
+type Node struct {
+	Id NodeId // The identifier of the node, chosen randomly.
+
+	// The nodes used to join the DHT. Defaults to BootstrapNodes.
+	Bootstrap []string
+
+	conn    net.PacketConn
+	mu      sync.Mutex
+	pending map[string]chan *krpcMessage
+	nextTid uint16
+}
+
+// NewNode creates a DHT node listening for UDP packets on 'addr', such as ":0"
+// for any available port. Returns the node or an error if any.
+func NewNode(addr string) (*Node, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen: %w", err)
+	}
+
+	node := &Node{
+		Bootstrap: BootstrapNodes,
+		conn:      conn,
+		pending:   make(map[string]chan *krpcMessage),
+	}
+
+	if _, err := rand.Read(node.Id[:]); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not generate node id: %w", err)
+	}
+
+	go node.readLoop()
+
+	return node, nil
+}
+
+// Close stops the node and closes its socket.
+func (n *Node) Close() error {
+	return n.conn.Close()
+}
+
+// readLoop reads packets from the socket and delivers responses to the queries
+// waiting for them until the socket is closed.
+func (n *Node) readLoop() {
+	buf := make([]byte, 65536)
+
+	for {
+		read, _, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			continue
+		}
+
+		var message krpcMessage
+		if err := bencode.Unmarshal(buf[:read], &message); err != nil {
+			continue
+		}
+
+		if message.Type != "r" && message.Type != "e" {
+			continue // queries from other nodes are not answered
+		}
+
+		n.mu.Lock()
+		response, ok := n.pending[message.TransactionId]
+		delete(n.pending, message.TransactionId)
+		n.mu.Unlock()
+
+		if ok {
+			response <- &message
+		}
+	}
+}
+
+// query sends a query for 'method' with 'args' to the node at 'addr' and waits
+// for its response. Returns the response or an error if any.
+func (n *Node) query(ctx context.Context, addr *net.UDPAddr, method string, args krpcArgs) (*krpcResponse, error) {
+	response := make(chan *krpcMessage, 1)
+
+	n.mu.Lock()
+	n.nextTid++
+	tid := string(binary.BigEndian.AppendUint16(nil, n.nextTid))
+	n.pending[tid] = response
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, tid)
+		n.mu.Unlock()
+	}()
+
+	args.Id = string(n.Id[:])
+
+	packet, err := bencode.Marshal(krpcMessage{TransactionId: tid, Type: "q", Method: method, Args: &args})
+	if err != nil {
+		return nil, fmt.Errorf("could not encode query: %w", err)
+	}
+
+	if _, err := n.conn.WriteTo(packet, addr); err != nil {
+		return nil, fmt.Errorf("could not send query: %w", err)
+	}
+
+	timer := time.NewTimer(QUERY_TIMEOUT)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, fmt.Errorf("node %s did not respond", addr)
+	case message := <-response:
+		if message.Type == "e" {
+			return nil, fmt.Errorf("node %s returned error: %v", addr, message.Error)
+		}
+
+		if message.Response == nil {
+			return nil, fmt.Errorf("node %s sent an empty response", addr)
+		}
+
+		return message.Response, nil
+	}
+}
+
+// getPeers sends a get_peers query for 'infoHash' to the node at 'addr'.
+// Returns the peers and the closer nodes returned by the node or an error if any.
+func (n *Node) getPeers(ctx context.Context, addr *net.UDPAddr, infoHash NodeId) ([]torrent.TrackerPeer, []remoteNode, error) {
+	response, err := n.query(ctx, addr, "get_peers", krpcArgs{InfoHash: string(infoHash[:])})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var peers []torrent.TrackerPeer
+	for _, value := range response.Values {
+		peer, err := decodeCompactPeer(value)
+		if err != nil {
+			continue
+		}
+
+		peers = append(peers, peer)
+	}
+
+	nodes, err := decodeCompactNodes(response.Nodes, net.IPv4len)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nodes6, err := decodeCompactNodes(response.Nodes6, net.IPv6len)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return peers, append(nodes, nodes6...), nil
+}
+
+// bootstrapNodes resolves the addresses of the bootstrap nodes. Addresses that
+// cannot be resolved are skipped.
+func (n *Node) bootstrapNodes() []remoteNode {
+	var nodes []remoteNode
+
+	for _, host := range n.Bootstrap {
+		addr, err := net.ResolveUDPAddr("udp", host)
+		if err != nil {
+			continue
+		}
+
+		nodes = append(nodes, remoteNode{Addr: addr})
+	}
+
+	return nodes
+}
+
+// GetPeers looks up the peers of the torrent identified by 'infoHash' by
+// iteratively querying the nodes closest to it, starting from the bootstrap
+// nodes, with at most ALPHA queries in flight.
+//
+// The lookup ends when the K closest known nodes have all been queried, when
+// 'ctx' is done or after a bounded number of queries. Returns the peers found
+// or an error if no node could be queried.
+func (n *Node) GetPeers(ctx context.Context, infoHash [20]byte) ([]torrent.TrackerPeer, error) {
+	target := NodeId(infoHash)
+
+	candidates := n.bootstrapNodes()
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("could not resolve any bootstrap node")
+	}
+
+	queried := make(map[string]bool)
+	seenPeers := make(map[string]bool)
+
+	var mu sync.Mutex
+	var peers []torrent.TrackerPeer
+	var closest []remoteNode
+	var errs []error
+
+	responded := 0
+
+	for len(queried) < maxQueries && ctx.Err() == nil {
+		var batch []remoteNode
+		for _, node := range candidates {
+			if len(batch) == ALPHA {
+				break
+			}
+
+			if !queried[node.Addr.String()] {
+				queried[node.Addr.String()] = true
+				batch = append(batch, node)
+			}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, node := range batch {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				found, nodes, err := n.getPeers(ctx, node.Addr, target)
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if err != nil {
+					errs = append(errs, err)
+					return
+				}
+
+				responded++
+
+				for _, peer := range found {
+					if !seenPeers[peer.String()] {
+						seenPeers[peer.String()] = true
+						peers = append(peers, peer)
+					}
+				}
+
+				for _, other := range nodes {
+					if !queried[other.Addr.String()] {
+						closest = append(closest, other)
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		// Continue with those of the K closest nodes that have not been queried yet.
+		slices.SortFunc(closest, func(a, b remoteNode) int {
+			distA, distB := a.Id.distance(target), b.Id.distance(target)
+			return bytes.Compare(distA[:], distB[:])
+		})
+		closest = slices.CompactFunc(closest, func(a, b remoteNode) bool {
+			return a.Addr.String() == b.Addr.String()
+		})
+
+		candidates = nil
+		for _, node := range closest[:min(len(closest), K)] {
+			if !queried[node.Addr.String()] {
+				candidates = append(candidates, node)
+			}
+		}
+	}
+
+	if responded == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("no node responded: %w", errors.Join(errs...))
+	}
+
+	return peers, nil
+}
+
+// LookupTorrent looks up the peers of 't' in the same way as GetPeers. Returns
+// torrent.ErrPrivateTorrent if the torrent is private, as the peers of private
+// torrents must only be obtained from their trackers.
+func (n *Node) LookupTorrent(ctx context.Context, t *torrent.Torrent) ([]torrent.TrackerPeer, error) {
+	if t.Info.Private {
+		return nil, torrent.ErrPrivateTorrent
+	}
+
+	infoHash, err := t.Info.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("could not get info hash: %w", err)
+	}
+
+	return n.GetPeers(ctx, infoHash)
+}
@@ -0,0 +1,82 @@
+/* KRPC messages exchanged between DHT nodes. */
+
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/aescarias/apricot/torrent"
+)
+
+// A krpcMessage represents a bencoded KRPC query, response or error.
+type krpcMessage struct {
+	TransactionId string        `bencode:"t"`
+	Type          string        `bencode:"y"`           // "q" for queries, "r" for responses and "e" for errors.
+	Method        string        `bencode:"q,omitempty"` // The name of the query method.
+	Args          *krpcArgs     `bencode:"a,omitempty"` // The arguments of a query.
+	Response      *krpcResponse `bencode:"r,omitempty"` // The return values of a response.
+	Error         []any         `bencode:"e,omitempty"` // The error code and message of an error.
+}
+
+// A krpcArgs represents the arguments of a query.
+type krpcArgs struct {
+	Id       string `bencode:"id"`
+	InfoHash string `bencode:"info_hash,omitempty"`
+	Target   string `bencode:"target,omitempty"`
+}
+
+// A krpcResponse represents the return values of a response.
+type krpcResponse struct {
+	Id     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`  // Compact node info of IPv4 nodes.
+	Nodes6 string   `bencode:"nodes6,omitempty"` // Compact node info of IPv6 nodes.
+	Values []string `bencode:"values,omitempty"` // Compact peer info of peers of the torrent.
+	Token  string   `bencode:"token,omitempty"`
+}
+
+// A remoteNode represents another node of the DHT.
+type remoteNode struct {
+	Id   NodeId
+	Addr *net.UDPAddr
+}
+
+// decodeCompactNodes decodes a compact node info list where each address is
+// 'ipLen' bytes long. Each entry holds a 20-byte node ID, the address and a
+// 2-byte port.
+func decodeCompactNodes(compact string, ipLen int) ([]remoteNode, error) {
+	entryLen := 20 + ipLen + 2
+	if len(compact)%entryLen != 0 {
+		return nil, fmt.Errorf("compact node list length %d is not a multiple of %d", len(compact), entryLen)
+	}
+
+	var nodes []remoteNode
+
+	for idx := 0; idx < len(compact); idx += entryLen {
+		entry := []byte(compact[idx : idx+entryLen])
+
+		nodes = append(nodes, remoteNode{
+			Id: NodeId(entry[:20]),
+			Addr: &net.UDPAddr{
+				IP:   net.IP(entry[20 : 20+ipLen]),
+				Port: int(binary.BigEndian.Uint16(entry[20+ipLen:])),
+			},
+		})
+	}
+
+	return nodes, nil
+}
+
+// decodeCompactPeer decodes the compact peer info of a single peer, which is
+// either 6 bytes (IPv4) or 18 bytes (IPv6) long.
+func decodeCompactPeer(compact string) (torrent.TrackerPeer, error) {
+	if len(compact) != 6 && len(compact) != 18 {
+		return torrent.TrackerPeer{}, fmt.Errorf("invalid compact peer length %d", len(compact))
+	}
+
+	ip := net.IP([]byte(compact[:len(compact)-2]))
+	port := binary.BigEndian.Uint16([]byte(compact[len(compact)-2:]))
+
+	return torrent.TrackerPeer{Ip: ip.String(), Port: int(port)}, nil
+}
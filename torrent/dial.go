@@ -0,0 +1,424 @@
+/*
+Dialing of peer connections, either directly or through a SOCKS5 proxy.
+
+See https://datatracker.ietf.org/doc/html/rfc1928 and
+https://datatracker.ietf.org/doc/html/rfc1929 for the SOCKS5 protocol and its
+username/password authentication.
+*/
+
+package torrent
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	// The default time allowed for connecting to a peer.
+	DIAL_TIMEOUT = 10 * time.Second
+	// The time given to the addresses of the preferred family of a peer before the
+	// other family is dialed concurrently, as in RFC 8305 (Happy Eyeballs).
+	FALLBACK_DELAY = 300 * time.Millisecond
+)
+
+// An IPPreference selects the address family tried first when connecting to peers.
+type IPPreference int
+
+const (
+	PreferAny  IPPreference = iota // Addresses are tried in the order given by the resolver.
+	PreferIPv4                     // IPv4 addresses are tried first.
+	PreferIPv6                     // IPv6 addresses are tried first.
+)
+
+// prefers reports whether 'ip' belongs to the preferred family.
+func (p IPPreference) prefers(ip net.IP) bool {
+	switch p {
+	case PreferIPv4:
+		return ip.To4() != nil
+	case PreferIPv6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// PreferPeers returns a copy of 'peers' with the peers whose IP address belongs
+// to the family selected by 'preference' moved first, keeping their relative
+// order. Peers given by host name are kept after those of the preferred family.
+func PreferPeers(peers []TrackerPeer, preference IPPreference) []TrackerPeer {
+	sorted := slices.Clone(peers)
+	if preference == PreferAny {
+		return sorted
+	}
+
+	rank := func(peer TrackerPeer) int {
+		if ip := net.ParseIP(peer.Ip); ip != nil && preference.prefers(ip) {
+			return 0
+		}
+
+		return 1
+	}
+
+	slices.SortStableFunc(sorted, func(a, b TrackerPeer) int {
+		return cmp.Compare(rank(a), rank(b))
+	})
+
+	return sorted
+}
+
+const (
+	socksVersion      = 0x05
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthRefused  = 0xff
+	socksConnect      = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+)
+
+// DialOptions control how connections to peers are established.
+type DialOptions struct {
+	// The time allowed for connecting to the peer, including the SOCKS5 handshake
+	// if a proxy is used. Defaults to DIAL_TIMEOUT.
+	Timeout time.Duration
+
+	// (optional) The address of a SOCKS5 proxy in the form 'host:port' through
+	// which peers are connected to. DNS names of peers are resolved by the proxy.
+	Proxy string
+	// (optional) The username and password used to authenticate with the proxy.
+	// Authentication is only offered if the username is not empty.
+	ProxyUsername string
+	ProxyPassword string
+
+	// (optional) The reserved bytes sent in the handshake, advertising the
+	// extensions we support. Defaults to DEFAULT_RESERVED.
+	Reserved *Reserved
+
+	// (optional) The address family tried first. For peers given by host name,
+	// the addresses of the preferred family are dialed first and those of the
+	// other family are dialed concurrently after FALLBACK_DELAY, the first
+	// connection to succeed being used. Downloads and peer pools also dial peers
+	// given by IP address in this order. Ignored when a proxy is used.
+	PreferIP IPPreference
+}
+
+// The reserved bytes sent in handshakes by default, advertising the extension
+// protocol.
+var DEFAULT_RESERVED = NewReserved(RESERVED_BIT_EXTENSIONS)
+
+// preference returns the address family tried first.
+func (o *DialOptions) preference() IPPreference {
+	if o == nil {
+		return PreferAny
+	}
+
+	return o.PreferIP
+}
+
+// reserved returns the reserved bytes sent in the handshake.
+func (o *DialOptions) reserved() Reserved {
+	if o == nil || o.Reserved == nil {
+		return DEFAULT_RESERVED
+	}
+
+	return *o.Reserved
+}
+
+// DialPeer connects to 'peer' over TCP as described by 'options'. If 'options'
+// is nil, the peer is connected to directly with a timeout of DIAL_TIMEOUT.
+//
+// Returns the connection or an error if any.
+func DialPeer(peer TrackerPeer, options *DialOptions) (net.Conn, error) {
+	if options == nil {
+		options = &DialOptions{}
+	}
+
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = DIAL_TIMEOUT
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+
+	if len(options.Proxy) == 0 {
+		if options.PreferIP == PreferAny || net.ParseIP(peer.Ip) != nil {
+			return dialer.Dial("tcp", peer.String())
+		}
+
+		return dialPreferred(&dialer, peer, options.PreferIP)
+	}
+
+	conn, err := dialer.Dial("tcp", options.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to proxy: %w", err)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not set deadline: %w", err)
+	}
+
+	if err := socksConnectTo(conn, peer, options); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not connect through proxy: %w", err)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not clear deadline: %w", err)
+	}
+
+	return conn, nil
+}
+
+// A dialResult is the outcome of dialing the addresses of one family.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialPreferred resolves the host name of 'peer' and races connections to its
+// addresses, giving those of the family selected by 'preference' a head start
+// of FALLBACK_DELAY. The other family is dialed at once if the preferred one
+// fails early. Returns the first connection established or the errors of both
+// families.
+func dialPreferred(dialer *net.Dialer, peer TrackerPeer, preference IPPreference) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialer.Timeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, peer.Ip)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s: %w", peer.Ip, err)
+	}
+
+	var primary, fallback []net.IP
+	for _, addr := range addrs {
+		if preference.prefers(addr.IP) {
+			primary = append(primary, addr.IP)
+		} else {
+			fallback = append(fallback, addr.IP)
+		}
+	}
+
+	if len(primary) == 0 {
+		primary, fallback = fallback, nil
+	}
+
+	port := strconv.Itoa(peer.Port)
+	results := make(chan dialResult, 2)
+
+	dialFamily := func(ips []net.IP) {
+		var errs []error
+
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				results <- dialResult{conn: conn}
+				return
+			}
+
+			errs = append(errs, err)
+		}
+
+		results <- dialResult{err: errors.Join(errs...)}
+	}
+
+	go dialFamily(primary)
+	racing := 1
+
+	fallbackTimer := time.NewTimer(FALLBACK_DELAY)
+	defer fallbackTimer.Stop()
+
+	startFallback := func() {
+		if len(fallback) > 0 {
+			go dialFamily(fallback)
+			racing++
+			fallback = nil
+		}
+	}
+
+	var errs []error
+
+	for racing > 0 {
+		select {
+		case <-fallbackTimer.C:
+			startFallback()
+		case result := <-results:
+			racing--
+
+			if result.err == nil {
+				// Close the connection of the other family should it succeed too.
+				go func(pending int) {
+					for range pending {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(racing)
+
+				return result.conn, nil
+			}
+
+			errs = append(errs, result.err)
+			startFallback()
+		}
+	}
+
+	return nil, fmt.Errorf("could not connect to %s: %w", peer, errors.Join(errs...))
+}
+
+// socksConnectTo authenticates with the SOCKS5 proxy over 'conn' and asks it to
+// connect to 'peer'.
+func socksConnectTo(conn net.Conn, peer TrackerPeer, options *DialOptions) error {
+	methods := []byte{socksAuthNone}
+	if len(options.ProxyUsername) > 0 {
+		methods = append(methods, socksAuthPassword)
+	}
+
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("could not send greeting: %w", err)
+	}
+
+	choice, err := ReadN(2, conn)
+	if err != nil {
+		return fmt.Errorf("could not read authentication method: %w", err)
+	}
+
+	if choice[0] != socksVersion {
+		return fmt.Errorf("proxy uses SOCKS version %d", choice[0])
+	}
+
+	switch choice[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if len(options.ProxyUsername) == 0 {
+			return fmt.Errorf("proxy selected an authentication method that was not offered")
+		}
+
+		if err := socksAuthenticate(conn, options.ProxyUsername, options.ProxyPassword); err != nil {
+			return err
+		}
+	case socksAuthRefused:
+		return fmt.Errorf("proxy refused the offered authentication methods")
+	default:
+		return fmt.Errorf("proxy selected unsupported authentication method %#x", choice[1])
+	}
+
+	request := []byte{socksVersion, socksConnect, 0}
+
+	if ip := net.ParseIP(peer.Ip); ip == nil {
+		if len(peer.Ip) > 255 {
+			return fmt.Errorf("peer host %q is too long", peer.Ip)
+		}
+
+		request = append(request, socksAddrDomain, byte(len(peer.Ip)))
+		request = append(request, peer.Ip...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socksAddrIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socksAddrIPv6)
+		request = append(request, ip.To16()...)
+	}
+
+	request = binary.BigEndian.AppendUint16(request, uint16(peer.Port))
+
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("could not send connect request: %w", err)
+	}
+
+	reply, err := ReadN(4, conn)
+	if err != nil {
+		return fmt.Errorf("could not read connect reply: %w", err)
+	}
+
+	if reply[1] != 0 {
+		return fmt.Errorf("proxy could not connect to %s: %s", peer, socksReplyMessage(reply[1]))
+	}
+
+	// Skip the address the proxy bound for the connection.
+	var addrLen int
+	switch reply[3] {
+	case socksAddrIPv4:
+		addrLen = net.IPv4len
+	case socksAddrIPv6:
+		addrLen = net.IPv6len
+	case socksAddrDomain:
+		length, err := ReadN(1, conn)
+		if err != nil {
+			return fmt.Errorf("could not read bound address: %w", err)
+		}
+
+		addrLen = int(length[0])
+	default:
+		return fmt.Errorf("proxy replied with unknown address type %#x", reply[3])
+	}
+
+	if _, err := ReadN(addrLen+2, conn); err != nil {
+		return fmt.Errorf("could not read bound address: %w", err)
+	}
+
+	return nil
+}
+
+// socksAuthenticate performs the username/password authentication of RFC 1929
+// over 'conn'.
+func socksAuthenticate(conn net.Conn, username, password string) error {
+	if len(username) > 255 || len(password) > 255 {
+		return fmt.Errorf("proxy username and password must be at most 255 bytes")
+	}
+
+	request := []byte{0x01, byte(len(username))}
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("could not send credentials: %w", err)
+	}
+
+	status, err := ReadN(2, conn)
+	if err != nil {
+		return fmt.Errorf("could not read authentication status: %w", err)
+	}
+
+	if status[1] != 0 {
+		return fmt.Errorf("proxy rejected the credentials")
+	}
+
+	return nil
+}
+
+// socksReplyMessage returns a description of the SOCKS5 reply code 'code'.
+func socksReplyMessage(code byte) string {
+	switch code {
+	case 0x01:
+		return "general failure"
+	case 0x02:
+		return "connection not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	case 0x07:
+		return "command not supported"
+	case 0x08:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("unknown error %#x", code)
+	}
+}
@@ -0,0 +1,307 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDialPeerTimeout(t *testing.T) {
+	// An address reserved for documentation, which is never routed.
+	peer := TrackerPeer{Ip: "192.0.2.1", Port: 6881}
+
+	start := time.Now()
+
+	conn, err := DialPeer(peer, &DialOptions{Timeout: 200 * time.Millisecond})
+	if err == nil {
+		conn.Close()
+		t.Fatalf("connected to unroutable address %s", peer)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("dial failed after %s, expected the timeout to apply", elapsed)
+	}
+}
+
+// serveSocks5 answers a single SOCKS5 connect request on 'listener' without
+// authentication, sending the requested address to 'target' and then 'greeting'
+// to the client.
+func serveSocks5(t *testing.T, listener net.Listener, target chan<- string, greeting string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	header, err := ReadN(2, conn)
+	if err != nil {
+		t.Errorf("could not read greeting: %v", err)
+		return
+	}
+
+	if _, err := ReadN(int(header[1]), conn); err != nil {
+		t.Errorf("could not read methods: %v", err)
+		return
+	}
+
+	conn.Write([]byte{socksVersion, socksAuthNone})
+
+	request, err := ReadN(4, conn)
+	if err != nil {
+		t.Errorf("could not read connect request: %v", err)
+		return
+	}
+
+	var host string
+	switch request[3] {
+	case 1:
+		addr, _ := ReadN(4, conn)
+		host = net.IP(addr).String()
+	case 3:
+		length, _ := ReadN(1, conn)
+		addr, _ := ReadN(int(length[0]), conn)
+		host = string(addr)
+	case 4:
+		addr, _ := ReadN(16, conn)
+		host = net.IP(addr).String()
+	}
+
+	port, err := ReadN(2, conn)
+	if err != nil {
+		t.Errorf("could not read port: %v", err)
+		return
+	}
+
+	target <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	// Succeeded, bound to 0.0.0.0:0.
+	conn.Write([]byte{socksVersion, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	conn.Write([]byte(greeting))
+}
+
+func TestDialPeerSocks5(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	target := make(chan string, 1)
+
+	peers := []TrackerPeer{
+		{Ip: "192.0.2.1", Port: 6881},
+		{Ip: "peer.example.com", Port: 51413},
+	}
+
+	for _, peer := range peers {
+		go serveSocks5(t, listener, target, "hello")
+
+		conn, err := DialPeer(peer, &DialOptions{Proxy: listener.Addr().String(), Timeout: time.Second})
+		if err != nil {
+			t.Fatalf("could not dial %s through proxy: %v", peer, err)
+		}
+
+		if requested := <-target; requested != peer.String() {
+			t.Errorf("proxy was asked for %s, expected %s", requested, peer)
+		}
+
+		greeting, err := io.ReadAll(conn)
+		if err != nil || string(greeting) != "hello" {
+			t.Errorf("read %q through proxy (%v)", greeting, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestDialPeerSocks5Timeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	// The proxy accepts connections but never answers.
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	start := time.Now()
+
+	_, err = DialPeer(TrackerPeer{Ip: "192.0.2.1", Port: 6881}, &DialOptions{
+		Proxy:   listener.Addr().String(),
+		Timeout: 200 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatalf("connected through a silent proxy")
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("dial failed after %s, expected the timeout to apply", elapsed)
+	}
+}
+
+func TestPreferPeers(t *testing.T) {
+	peers := []TrackerPeer{
+		{Ip: "::1", Port: 1},
+		{Ip: "127.0.0.1", Port: 2},
+		{Ip: "peer.example.com", Port: 3},
+		{Ip: "2001:db8::1", Port: 4},
+		{Ip: "192.0.2.1", Port: 5},
+	}
+
+	tests := []struct {
+		preference IPPreference
+		ports      []int
+	}{
+		{PreferAny, []int{1, 2, 3, 4, 5}},
+		{PreferIPv4, []int{2, 5, 1, 3, 4}},
+		{PreferIPv6, []int{1, 4, 2, 3, 5}},
+	}
+
+	for _, test := range tests {
+		sorted := PreferPeers(peers, test.preference)
+
+		var ports []int
+		for _, peer := range sorted {
+			ports = append(ports, peer.Port)
+		}
+
+		if !slices.Equal(ports, test.ports) {
+			t.Errorf("preference %d ordered peers as %v, expected %v", test.preference, ports, test.ports)
+		}
+	}
+
+	if peers[0].Port != 1 || peers[1].Port != 2 {
+		t.Errorf("PreferPeers modified its argument")
+	}
+}
+
+// listenDualStack listens on the same port of both loopback addresses and
+// returns the IPv4 and IPv6 listeners. Skips the test if 'localhost' does not
+// resolve to both of them.
+func listenDualStack(t *testing.T) (net.Listener, net.Listener) {
+	addrs, err := net.LookupIP("localhost")
+	if err != nil || !slices.ContainsFunc(addrs, func(ip net.IP) bool { return ip.Equal(net.IPv4(127, 0, 0, 1)) }) ||
+		!slices.ContainsFunc(addrs, func(ip net.IP) bool { return ip.Equal(net.IPv6loopback) }) {
+		t.Skip("localhost does not resolve to both loopback addresses")
+	}
+
+	v4, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("could not listen on IPv4: %v", err)
+	}
+	t.Cleanup(func() { v4.Close() })
+
+	port := strconv.Itoa(v4.Addr().(*net.TCPAddr).Port)
+
+	v6, err := net.Listen("tcp6", net.JoinHostPort("::1", port))
+	if err != nil {
+		t.Skipf("could not listen on IPv6: %v", err)
+	}
+	t.Cleanup(func() { v6.Close() })
+
+	return v4, v6
+}
+
+// acceptOn reports the listener that accepts the next connection, closing it.
+func acceptOn(listeners ...net.Listener) <-chan net.Listener {
+	accepted := make(chan net.Listener, len(listeners))
+
+	for _, listener := range listeners {
+		go func() {
+			if conn, err := listener.Accept(); err == nil {
+				conn.Close()
+				accepted <- listener
+			}
+		}()
+	}
+
+	return accepted
+}
+
+func TestDialPeerPreferIP(t *testing.T) {
+	v4, v6 := listenDualStack(t)
+	accepted := acceptOn(v4, v6)
+
+	peer := TrackerPeer{Ip: "localhost", Port: v4.Addr().(*net.TCPAddr).Port}
+
+	for _, test := range []struct {
+		preference IPPreference
+		listener   net.Listener
+	}{
+		{PreferIPv6, v6},
+		{PreferIPv4, v4},
+	} {
+		conn, err := DialPeer(peer, &DialOptions{PreferIP: test.preference, Timeout: time.Second})
+		if err != nil {
+			t.Fatalf("could not dial %s: %v", peer, err)
+		}
+
+		if remote := conn.RemoteAddr().String(); remote != test.listener.Addr().String() {
+			t.Errorf("preference %d connected to %s, expected %s", test.preference, remote, test.listener.Addr())
+		}
+		conn.Close()
+
+		if listener := <-accepted; listener != test.listener {
+			t.Errorf("preference %d was accepted on %s", test.preference, listener.Addr())
+		}
+	}
+}
+
+func TestDialPeerFallback(t *testing.T) {
+	v4, v6 := listenDualStack(t)
+
+	// Nothing listens on IPv6 anymore, so the preferred family fails at once.
+	v6.Close()
+	accepted := acceptOn(v4)
+
+	peer := TrackerPeer{Ip: "localhost", Port: v4.Addr().(*net.TCPAddr).Port}
+
+	start := time.Now()
+
+	conn, err := DialPeer(peer, &DialOptions{PreferIP: PreferIPv6, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("could not fall back to IPv4: %v", err)
+	}
+	conn.Close()
+
+	if remote := conn.RemoteAddr().String(); remote != v4.Addr().String() {
+		t.Errorf("connected to %s, expected %s", remote, v4.Addr())
+	}
+
+	if elapsed := time.Since(start); elapsed >= FALLBACK_DELAY {
+		t.Errorf("fell back after %s, expected the failure of IPv6 to start IPv4 at once", elapsed)
+	}
+
+	<-accepted
+}
+
+func TestDialPeerPreferIPSingleFamily(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := acceptOn(listener)
+
+	// localhost has an IPv4 address everywhere, which is dialed even when IPv6
+	// is preferred but unavailable.
+	peer := TrackerPeer{Ip: "localhost", Port: listener.Addr().(*net.TCPAddr).Port}
+
+	conn, err := DialPeer(peer, &DialOptions{PreferIP: PreferIPv6, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("could not dial %s: %v", peer, err)
+	}
+	conn.Close()
+
+	<-accepted
+}
@@ -0,0 +1,479 @@
+/* Downloading of pieces from peers. */
+
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	BLOCK_SIZE     = 16 * 1024 // The size of each block requested from a peer (16 KiB).
+	PIPELINE_DEPTH = 5         // The number of block requests kept outstanding at once.
+	MAX_WORKERS    = 8         // The default number of peers downloaded from at once.
+)
+
+// A PieceEvent reports the outcome of an attempt to download a piece.
+type PieceEvent struct {
+	Index int  // The zero-based piece index.
+	Ok    bool // Whether the piece was downloaded, verified and written.
+}
+
+// A Download coordinates downloading a torrent from multiple peers at once.
+//
+// Piece indices are distributed to a bounded pool of workers, each connected to
+// a single peer. Completed pieces are written to Output at their byte offset and
+// failed pieces are queued again for another worker to retry.
+type Download struct {
+	Info     *Info         // The info of the torrent to download.
+	InfoHash [20]byte      // The info hash of the torrent.
+	PeerId   string        // The 20-byte peer ID used in handshakes.
+	Peers    []TrackerPeer // The peers to download from.
+	Output   io.WriterAt   // Where the concatenated contents of the torrent are written.
+
+	// The number of peers downloaded from at once. Defaults to MAX_WORKERS.
+	Workers int
+	// (optional) Receives an event for every piece download attempt. Sends are
+	// blocking, so the channel must be drained. It is closed when Run returns.
+	Progress chan<- PieceEvent
+	// (optional) The progress of a previous download of the torrent. Pieces it
+	// holds are skipped and pieces completed by Run are added to it.
+	Resume *ResumeState
+	// (optional) How peers are dialed. Defaults to a direct connection with a
+	// timeout of DIAL_TIMEOUT.
+	Dial *DialOptions
+	// (optional) Receives messages about peers and pieces, and is set as the
+	// logger of every peer connection. If nil, nothing is logged.
+	Logger Logger
+	// (optional) Limits the rate at which pieces are downloaded, both in total
+	// and for each peer. If nil, the rate is not limited.
+	Limiter *BandwidthLimiter
+
+	mu        sync.Mutex
+	remaining int
+	have      BitField            // The pieces verified and written, including those of Resume.
+	seeders   map[*TCPClient]bool // Whether each connected peer has every piece.
+	done      chan struct{}
+	work      chan int
+	peers     chan TrackerPeer
+	counters  counters // The transfer counters of every peer connection.
+}
+
+// NewDownload creates a download of the torrent described by 'info' from 'peers',
+// writing its contents to 'output'. Returns the download or an error if any.
+func NewDownload(info *Info, peers []TrackerPeer, output io.WriterAt, peerId string) (*Download, error) {
+	infoHash, err := info.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("could not get info hash: %w", err)
+	}
+
+	return &Download{
+		Info:     info,
+		InfoHash: infoHash,
+		PeerId:   peerId,
+		Peers:    peers,
+		Output:   output,
+		Workers:  MAX_WORKERS,
+	}, nil
+}
+
+// report sends an event for the piece at 'index' to the progress channel, if any.
+func (d *Download) report(index int, ok bool) {
+	if d.Progress != nil {
+		d.Progress <- PieceEvent{Index: index, Ok: ok}
+	}
+}
+
+// complete marks the piece at 'index' as done and stops the download once every
+// piece is done.
+func (d *Download) complete(index int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.have.SetPiece(index)
+
+	if d.Resume != nil {
+		d.Resume.Pieces.SetPiece(index)
+		d.Resume.Downloaded += int64(d.Info.PieceSize(index))
+	}
+
+	d.remaining--
+	if d.remaining == 0 {
+		close(d.done)
+	}
+}
+
+// Run downloads every piece of the torrent and blocks until all of them are
+// verified and written or no usable peers remain. Returns an error if the
+// download could not be completed.
+//
+// If Resume is set, it must belong to the torrent being downloaded, otherwise
+// ErrResumeMismatch is returned.
+func (d *Download) Run() error {
+	if d.Progress != nil {
+		defer close(d.Progress)
+	}
+
+	numPieces := d.Info.NumPieces()
+
+	if d.Resume != nil {
+		if err := d.Resume.Check(d.InfoHash, numPieces); err != nil {
+			return err
+		}
+	}
+
+	have := NewBitField(numPieces)
+
+	d.work = make(chan int, numPieces)
+	for index := range numPieces {
+		if d.Resume == nil || !d.Resume.Pieces.HasPiece(index) {
+			d.work <- index
+		} else {
+			have.SetPiece(index)
+		}
+	}
+
+	d.mu.Lock()
+	d.have = have
+	d.mu.Unlock()
+
+	d.remaining = len(d.work)
+	if d.remaining == 0 {
+		return nil
+	}
+
+	d.done = make(chan struct{})
+	d.seeders = make(map[*TCPClient]bool)
+
+	d.peers = make(chan TrackerPeer, len(d.Peers))
+	for _, peer := range PreferPeers(d.Peers, d.Dial.preference()) {
+		d.peers <- peer
+	}
+	close(d.peers)
+
+	workers := d.Workers
+	if workers <= 0 {
+		workers = MAX_WORKERS
+	}
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			d.worker()
+		}()
+	}
+
+	wg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.remaining > 0 {
+		return fmt.Errorf("ran out of peers with %d pieces remaining", d.remaining)
+	}
+
+	return nil
+}
+
+// SaveResume writes the progress of the download to the file at 'path', as
+// described by ResumeState.Save. It may be called while the download is running.
+// Returns an error if Resume is not set or the file could not be written.
+func (d *Download) SaveResume(path string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.Resume == nil {
+		return fmt.Errorf("download has no resume state")
+	}
+
+	return d.Resume.Save(path)
+}
+
+// SwarmStats returns the number of connected peers that have every piece of the
+// torrent (seeders) and that are missing pieces (leechers), as last reported by
+// their bitfield and have messages. Peers that have not sent a bitfield yet are
+// counted as leechers. It may be called while the download is running.
+func (d *Download) SwarmStats() (seeders, leechers int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, seeder := range d.seeders {
+		if seeder {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+
+	return seeders, leechers
+}
+
+// FileProgress returns the progress of each file of the torrent, as described
+// by Info.FileProgress, from the pieces completed by Run and those held by
+// Resume. It may be called while the download is running.
+func (d *Download) FileProgress() []FileProgress {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pieces := d.have
+	if pieces.Field == nil && d.Resume != nil {
+		pieces = d.Resume.Pieces
+	}
+
+	return d.Info.FileProgress(pieces)
+}
+
+// trackPeer records whether the connected peer of 'client' is a seeder. It must
+// be called from the goroutine reading from the client.
+func (d *Download) trackPeer(client *TCPClient) {
+	seeder := client.BitField.Field != nil && client.BitField.Complete()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.seeders[client] = seeder
+}
+
+// untrackPeer forgets the peer of 'client' once it is disconnected.
+func (d *Download) untrackPeer(client *TCPClient) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.seeders, client)
+}
+
+// worker connects to peers from the peer queue one at a time and downloads
+// pieces from them until the download is done or no peers remain.
+func (d *Download) worker() {
+	for peer := range d.peers {
+		client, err := NewTCPClientWithOptions(string(d.InfoHash[:]), peer, d.PeerId, d.Info.NumPieces(), d.Dial)
+		if err != nil {
+			loggerOrNop(d.Logger).Debug("could not connect to peer", "peer", peer, "error", err)
+			continue
+		}
+
+		client.Info = d.Info
+		client.Logger = d.Logger
+		client.parentCounters = &d.counters
+
+		if d.Limiter != nil {
+			client.DownloadLimiter = d.Limiter.NewPeer()
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		client.StartKeepAlive(ctx, KEEP_ALIVE_INTERVAL)
+		d.trackPeer(client)
+
+		finished := d.downloadFrom(client)
+		d.untrackPeer(client)
+		cancel()
+		client.Close()
+
+		if client.DownloadLimiter != nil {
+			client.DownloadLimiter.Close()
+		}
+
+		if finished {
+			return
+		}
+	}
+}
+
+// downloadFrom downloads pieces from 'client' until the download is done or the
+// peer fails. Returns whether the download is done.
+func (d *Download) downloadFrom(client *TCPClient) bool {
+	skipped := 0
+
+	for {
+		var index int
+
+		select {
+		case <-d.done:
+			return true
+		case index = <-d.work:
+		}
+
+		if client.BitField.Field != nil && !client.BitField.HasPiece(index) {
+			d.work <- index
+
+			// Give up on a peer that has none of the remaining pieces.
+			skipped++
+			if skipped > len(d.work) {
+				return false
+			}
+
+			continue
+		}
+
+		skipped = 0
+
+		piece, err := client.DownloadPiece(index, d.Info.PieceSize(index))
+		d.trackPeer(client)
+
+		if err == nil {
+			_, err = d.Output.WriteAt(piece, int64(index)*d.Info.PieceLength)
+		}
+
+		if err != nil {
+			loggerOrNop(d.Logger).Info("dropping peer", "peer", client.Peer, "piece", index, "error", err)
+
+			d.work <- index
+			d.report(index, false)
+			return false
+		}
+
+		d.report(index, true)
+		d.complete(index)
+	}
+}
+
+// handleStateMessage updates the connection state from a 'message' that is not
+// part of a piece exchange, such as choke, unchoke, have and bitfield messages.
+func (c *TCPClient) handleStateMessage(message *Message) {
+	if message.KeepAlive {
+		return
+	}
+
+	switch message.Id {
+	case MessageChoke:
+		c.Choked = true
+	case MessageUnchoke:
+		c.Choked = false
+	case MessageBitfield:
+		c.BitField = message.BitField
+	case MessageHave:
+		if c.BitField.Field == nil {
+			c.BitField = NewBitField(c.Pieces)
+		}
+		c.BitField.SetPiece(int(message.PieceIndex))
+	case MessagePort:
+		c.DHTPort = message.Port
+	case MessageExtended:
+		c.handleExtendedMessage(message)
+	}
+}
+
+// DownloadPiece downloads the piece at 'index', which is 'pieceLength' bytes long,
+// from the peer. Returns the contents of the piece or an error if any.
+//
+// The peer is sent an interested message and, once it unchokes us, requests for
+// blocks of BLOCK_SIZE bytes are pipelined, keeping up to PIPELINE_DEPTH requests
+// outstanding. The assembled piece is verified against its SHA1 hash, which
+// requires the Info field of the client to be set.
+func (c *TCPClient) DownloadPiece(index int, pieceLength int) ([]byte, error) {
+	return c.DownloadPieceProgress(index, pieceLength, nil)
+}
+
+// DownloadPieceProgress downloads the piece at 'index' like DownloadPiece and
+// calls 'progress', if not nil, after each new block is received with the number
+// of bytes of the piece received so far.
+//
+// The callback is called from the goroutine reading from the peer, so it must
+// return quickly, for instance by handing the count to another goroutine without
+// blocking. A slow callback delays the download and may cause the peer to time out.
+func (c *TCPClient) DownloadPieceProgress(index int, pieceLength int, progress func(received int)) ([]byte, error) {
+	if c.Info == nil {
+		return nil, fmt.Errorf("cannot verify piece %d without torrent info", index)
+	}
+
+	if err := c.SendMessage(Message{Id: MessageInterested}); err != nil {
+		return nil, fmt.Errorf("could not send interested: %w", err)
+	}
+
+	for c.Choked {
+		message, err := c.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("could not wait for unchoke: %w", err)
+		}
+
+		c.handleStateMessage(message)
+	}
+
+	piece := make([]byte, pieceLength)
+	numBlocks := (pieceLength + BLOCK_SIZE - 1) / BLOCK_SIZE
+	received := make([]bool, numBlocks)
+
+	requested, completed, outstanding, receivedBytes := 0, 0, 0, 0
+
+	for completed < numBlocks {
+		for outstanding < PIPELINE_DEPTH && requested < numBlocks {
+			begin := requested * BLOCK_SIZE
+			length := min(BLOCK_SIZE, pieceLength-begin)
+
+			err := c.SendMessage(Message{
+				Id: MessageRequest,
+				Request: Request{
+					Index:  uint32(index),
+					Begin:  uint32(begin),
+					Length: uint32(length),
+				},
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			requested++
+			outstanding++
+		}
+
+		message, err := c.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("could not read block: %w", err)
+		}
+
+		if message.KeepAlive || message.Id != MessagePiece {
+			c.handleStateMessage(message)
+
+			if c.Choked {
+				return nil, fmt.Errorf("peer choked us while downloading piece %d", index)
+			}
+
+			continue
+		}
+
+		block := message.Block
+		if int(block.Index) != index || block.Begin%BLOCK_SIZE != 0 {
+			continue // not a block we requested
+		}
+
+		blockIndex := int(block.Begin / BLOCK_SIZE)
+		if blockIndex >= numBlocks || int(block.Begin)+len(block.Block) > pieceLength {
+			return nil, fmt.Errorf("peer sent block out of bounds for piece %d", index)
+		}
+
+		if received[blockIndex] {
+			continue
+		}
+
+		copy(piece[block.Begin:], block.Block)
+		received[blockIndex] = true
+		completed++
+		outstanding--
+
+		receivedBytes += len(block.Block)
+		if progress != nil {
+			progress(receivedBytes)
+		}
+	}
+
+	valid, err := c.Info.VerifyPiece(index, piece)
+	if err != nil {
+		return nil, err
+	}
+
+	if !valid {
+		c.count(func(counters *counters) { counters.piecesFailed.Add(1) })
+
+		loggerOrNop(c.Logger).Warn("piece failed hash verification", "peer", c.Peer, "piece", index)
+		return nil, fmt.Errorf("piece %d failed hash verification", index)
+	}
+
+	c.count(func(counters *counters) { counters.piecesCompleted.Add(1) })
+
+	return piece, nil
+}
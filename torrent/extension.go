@@ -0,0 +1,133 @@
+/*
+Torrent implementation dealing with the extension protocol.
+
+See https://bittorrent.org/beps/bep_0010.html
+*/
+
+package torrent
+
+import (
+	"fmt"
+
+	"github.com/aescarias/apricot/torrent/bencode"
+)
+
+// The extended message ID of the extended handshake.
+const EXTENDED_HANDSHAKE_ID = 0
+
+// An ExtendedHandshake represents the dictionary sent in an extended handshake.
+type ExtendedHandshake struct {
+	// The extensions supported by the peer, mapped to the extended message ID
+	// the peer expects for each of them. An ID of zero disables the extension.
+	Extensions map[string]int `bencode:"m"`
+	// (optional) The name and version of the client.
+	Client string `bencode:"v,omitempty"`
+	// (optional) The local TCP listen port of the peer.
+	Port int `bencode:"p,omitempty"`
+	// (optional) The number of outstanding requests the peer accepts.
+	RequestQueue int `bencode:"reqq,omitempty"`
+	// (optional) The size of the info dictionary in bytes (BEP 9).
+	MetadataSize int `bencode:"metadata_size,omitempty"`
+}
+
+// localExtendedHandshake returns the extended handshake sent to the peer,
+// advertising the extensions supported by this client. Peer exchange is not
+// advertised for private torrents.
+func (c *TCPClient) localExtendedHandshake() ExtendedHandshake {
+	extensions := map[string]int{utMetadataName: utMetadataId}
+	if c.Info == nil || !c.Info.Private {
+		extensions[utPexName] = utPexId
+	}
+
+	return ExtendedHandshake{Extensions: extensions}
+}
+
+// SupportsExtensions reports whether the peer advertised support for the
+// extension protocol in its handshake.
+func (c *TCPClient) SupportsExtensions() bool {
+	return c.PeerReserved.Has(RESERVED_BIT_EXTENSIONS)
+}
+
+// SendExtendedHandshake sends 'handshake' to the peer as an extended handshake.
+// Returns an error if the peer does not support the extension protocol.
+func (c *TCPClient) SendExtendedHandshake(handshake ExtendedHandshake) error {
+	if !c.SupportsExtensions() {
+		return fmt.Errorf("peer does not support the extension protocol")
+	}
+
+	payload, err := bencode.Marshal(handshake)
+	if err != nil {
+		return fmt.Errorf("could not encode extended handshake: %w", err)
+	}
+
+	return c.SendMessage(Message{
+		Id:       MessageExtended,
+		Extended: Extended{Id: EXTENDED_HANDSHAKE_ID, Payload: payload},
+	})
+}
+
+// ExchangeExtendedHandshake sends 'handshake' to the peer and waits for the
+// extended handshake of the peer, handling any other state messages received
+// in the meantime. Returns the handshake of the peer or an error if any.
+func (c *TCPClient) ExchangeExtendedHandshake(handshake ExtendedHandshake) (*ExtendedHandshake, error) {
+	if err := c.SendExtendedHandshake(handshake); err != nil {
+		return nil, err
+	}
+
+	for c.Extensions == nil {
+		message, err := c.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("could not wait for extended handshake: %w", err)
+		}
+
+		if message.Id == MessageExtended && message.Extended.Id == EXTENDED_HANDSHAKE_ID {
+			if err := c.parseExtendedHandshake(message.Extended.Payload); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		c.handleStateMessage(message)
+	}
+
+	return c.Extensions, nil
+}
+
+// parseExtendedHandshake decodes the extended handshake 'payload' of the peer
+// into Extensions.
+func (c *TCPClient) parseExtendedHandshake(payload []byte) error {
+	var handshake ExtendedHandshake
+	if err := bencode.Unmarshal(payload, &handshake); err != nil {
+		return fmt.Errorf("could not decode extended handshake: %w", err)
+	}
+
+	c.Extensions = &handshake
+	return nil
+}
+
+// handleExtendedMessage updates the connection state from an extended 'message'.
+// Malformed messages are ignored.
+func (c *TCPClient) handleExtendedMessage(message *Message) {
+	switch message.Extended.Id {
+	case EXTENDED_HANDSHAKE_ID:
+		c.parseExtendedHandshake(message.Extended.Payload)
+	case utPexId:
+		c.handlePexMessage(message.Extended.Payload)
+	}
+}
+
+// ExtensionId returns the extended message ID the peer expects for the extension
+// named 'name' and whether the peer supports it.
+func (c *TCPClient) ExtensionId(name string) (byte, bool) {
+	if c.Extensions == nil {
+		return 0, false
+	}
+
+	id, ok := c.Extensions.Extensions[name]
+	if !ok || id <= 0 || id > 255 {
+		return 0, false
+	}
+
+	return byte(id), true
+}
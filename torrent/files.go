@@ -0,0 +1,92 @@
+/* Mapping between the files of a torrent and its pieces. */
+
+package torrent
+
+// A FileRange represents the position of a file within the concatenated
+// contents of a torrent.
+type FileRange struct {
+	File   InfoFile // The file.
+	Offset int64    // The offset of the first byte of the file in the torrent contents.
+	Length int64    // The length of the file in bytes.
+}
+
+// FileRanges returns the position of each file of the torrent within its
+// concatenated contents, in torrent order.
+//
+// For single file torrents, a single range is returned whose path is the name
+// of the torrent, as returned by PreferredName.
+func (i *Info) FileRanges() []FileRange {
+	if len(i.Files) == 0 {
+		return []FileRange{{
+			File:   InfoFile{Length: i.Length, Path: []string{i.PreferredName()}},
+			Length: i.Length,
+		}}
+	}
+
+	ranges := make([]FileRange, len(i.Files))
+
+	var offset int64
+	for idx, file := range i.Files {
+		ranges[idx] = FileRange{File: file, Offset: offset, Length: file.Length}
+		offset += file.Length
+	}
+
+	return ranges
+}
+
+// PiecesForFile returns the range [start, end) of the indices of the pieces
+// holding the contents of the file at 'index' of FileRanges. The first and
+// last pieces may be shared with neighboring files. For empty files, start and
+// end are equal.
+//
+// Returns (0, 0) if the index is out of range or the piece length is unknown.
+func (i *Info) PiecesForFile(index int) (int, int) {
+	ranges := i.FileRanges()
+	if index < 0 || index >= len(ranges) || i.PieceLength <= 0 {
+		return 0, 0
+	}
+
+	fileRange := ranges[index]
+
+	start := int(fileRange.Offset / i.PieceLength)
+	if fileRange.Length == 0 {
+		return start, start
+	}
+
+	end := int((fileRange.Offset + fileRange.Length + i.PieceLength - 1) / i.PieceLength)
+	return start, end
+}
+
+// A FileProgress reports how much of a file of a torrent has been downloaded.
+type FileProgress struct {
+	Path      []string // The path of the file, as returned by InfoFile.PreferredPath.
+	Completed int64    // The number of bytes of the file within completed pieces.
+	Total     int64    // The length of the file in bytes.
+}
+
+// FileProgress returns the progress of each file of FileRanges given the
+// completed 'pieces'. Pieces shared by neighboring files count towards each of
+// them by the bytes they hold of it.
+func (i *Info) FileProgress(pieces BitField) []FileProgress {
+	ranges := i.FileRanges()
+	progress := make([]FileProgress, len(ranges))
+
+	for idx, fileRange := range ranges {
+		progress[idx] = FileProgress{Path: fileRange.File.PreferredPath(), Total: fileRange.Length}
+
+		start, end := i.PiecesForFile(idx)
+		for index := start; index < end; index++ {
+			if !pieces.HasPiece(index) {
+				continue
+			}
+
+			pieceStart := int64(index) * i.PieceLength
+			pieceEnd := pieceStart + int64(i.PieceSize(index))
+
+			overlap := min(pieceEnd, fileRange.Offset+fileRange.Length) - max(pieceStart, fileRange.Offset)
+			progress[idx].Completed += max(overlap, 0)
+		}
+	}
+
+	return progress
+}
@@ -0,0 +1,199 @@
+/* Acceptance of incoming peer connections. */
+
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The time allowed for a peer connecting to us to complete its handshake.
+const HANDSHAKE_TIMEOUT = 30 * time.Second
+
+// A Listener accepts connections from peers for the torrents it serves.
+//
+// Connections are handshaked in the background: the peer must send its handshake
+// first, naming the info hash of a served torrent, after which our handshake is
+// sent back. Connections for other torrents are closed. A Listener is safe for
+// use by multiple goroutines.
+type Listener struct {
+	PeerId string // The 20-byte peer ID used in handshakes.
+
+	// The reserved bytes sent in handshakes, advertising the extensions we support.
+	// Defaults to DEFAULT_RESERVED.
+	Reserved Reserved
+
+	listener net.Listener
+	accepted chan *TCPClient
+	closed   chan struct{}
+	close    sync.Once
+
+	mu       sync.Mutex
+	torrents map[string]*Info // The served torrents, keyed by info hash.
+}
+
+// Listen listens for peer connections on the TCP 'address', such as ":6881",
+// using 'peerId' in handshakes. No torrents are served until Serve is called.
+//
+// Returns the listener or an error if any.
+func Listen(address string, peerId string) (*Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %w", address, err)
+	}
+
+	l := &Listener{
+		PeerId:   peerId,
+		Reserved: DEFAULT_RESERVED,
+		listener: listener,
+		accepted: make(chan *TCPClient),
+		closed:   make(chan struct{}),
+		torrents: make(map[string]*Info),
+	}
+
+	go l.acceptLoop()
+
+	return l, nil
+}
+
+// Addr returns the address the listener is listening on.
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Port returns the TCP port the listener is listening on, as sent to trackers.
+func (l *Listener) Port() int {
+	_, port, _ := net.SplitHostPort(l.listener.Addr().String())
+	portInt, _ := strconv.Atoi(port)
+
+	return portInt
+}
+
+// Serve accepts connections for the torrent described by 'info' from now on.
+// Returns an error if its info hash cannot be computed.
+func (l *Listener) Serve(info *Info) error {
+	infoHash, err := info.Hash()
+	if err != nil {
+		return fmt.Errorf("could not get info hash: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.torrents[string(infoHash[:])] = info
+	return nil
+}
+
+// Remove stops accepting connections for the torrent identified by 'infoHash'.
+// Connections already accepted are left open.
+func (l *Listener) Remove(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.torrents, string(infoHash[:]))
+}
+
+// Accept waits for a peer to connect and complete its handshake for one of the
+// served torrents. The returned client has its Info field set to the torrent
+// requested by the peer.
+//
+// Returns net.ErrClosed once the listener is closed.
+func (l *Listener) Accept() (*TCPClient, error) {
+	select {
+	case client := <-l.accepted:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening for connections. Connections being handshaked are closed,
+// while connections already accepted are left open.
+func (l *Listener) Close() error {
+	var err error
+
+	l.close.Do(func() {
+		close(l.closed)
+		err = l.listener.Close()
+	})
+
+	return err
+}
+
+// acceptLoop accepts connections and handshakes each of them in the background
+// until the listener is closed.
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.Close()
+			return
+		}
+
+		go func() {
+			client, err := l.handshake(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+
+			select {
+			case l.accepted <- client:
+			case <-l.closed:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// handshake performs the inbound handshake over 'conn', answering a peer that
+// requested a served torrent. Returns the client or an error if any.
+func (l *Listener) handshake(conn net.Conn) (*TCPClient, error) {
+	if err := conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT)); err != nil {
+		return nil, fmt.Errorf("could not set deadline: %w", err)
+	}
+
+	peerHandshake, err := ParseHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	info, ok := l.torrents[peerHandshake.InfoHash]
+	l.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("ending handshake with %s: %w", conn.RemoteAddr(), ErrInfoHashMismatch)
+	}
+
+	handshake := Handshake{
+		Protocol: PROTOCOL_STRING,
+		Reserved: l.Reserved[:],
+		InfoHash: peerHandshake.InfoHash,
+		PeerId:   l.PeerId,
+	}
+
+	if _, err := conn.Write(handshake.Serialized()); err != nil {
+		return nil, fmt.Errorf("could not send handshake message: %w", err)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("could not clear deadline: %w", err)
+	}
+
+	host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, fmt.Errorf("could not get peer address: %w", err)
+	}
+
+	portInt, _ := strconv.Atoi(port)
+	peer := TrackerPeer{Ip: host, Port: portInt, PeerId: peerHandshake.PeerId}
+
+	client := newTCPClient(conn, peerHandshake.InfoHash, peer, l.PeerId, info.NumPieces(), peerHandshake)
+	client.Info = info
+
+	return client, nil
+}
@@ -0,0 +1,33 @@
+/* Logging of the internal state of the torrent package. */
+
+package torrent
+
+// A Logger receives messages about the internal state of the package, such as
+// failed peer connections and retried tracker requests. Arguments following the
+// message are alternating keys and values.
+//
+// The method set matches that of *slog.Logger, so a slog logger may be used
+// directly.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// nopLogger is a Logger discarding every message.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...any) {}
+func (nopLogger) Info(msg string, args ...any)  {}
+func (nopLogger) Warn(msg string, args ...any)  {}
+func (nopLogger) Error(msg string, args ...any) {}
+
+// loggerOrNop returns 'logger', or a Logger discarding every message if it is nil.
+func loggerOrNop(logger Logger) Logger {
+	if logger == nil {
+		return nopLogger{}
+	}
+
+	return logger
+}
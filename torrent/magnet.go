@@ -0,0 +1,108 @@
+/* Parsing of magnet URIs. */
+
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The URN namespace prefix identifying a BitTorrent info hash in a magnet 'xt' parameter.
+const btihPrefix = "urn:btih:"
+
+// ParseInfoHashURN parses an 'xt' (exact topic) value of the form 'urn:btih:<hash>'
+// into a 20-byte info hash.
+//
+// The hash may be either 40 hexadecimal characters or 32 base32 characters.
+// Base32 hashes are accepted in any case and without padding. Any other length
+// or any invalid character is rejected.
+func ParseInfoHashURN(xt string) ([20]byte, error) {
+	if len(xt) < len(btihPrefix) || !strings.EqualFold(xt[:len(btihPrefix)], btihPrefix) {
+		return [20]byte{}, fmt.Errorf("exact topic %q is not a btih urn", xt)
+	}
+
+	encoded := xt[len(btihPrefix):]
+
+	var decoded []byte
+	var err error
+
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+		if err != nil {
+			return [20]byte{}, fmt.Errorf("invalid hex info hash %q: %w", encoded, err)
+		}
+	case 32:
+		encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+		decoded, err = encoding.DecodeString(strings.ToUpper(encoded))
+		if err != nil {
+			return [20]byte{}, fmt.Errorf("invalid base32 info hash %q: %w", encoded, err)
+		}
+	default:
+		return [20]byte{}, fmt.Errorf(
+			"info hash %q has length %d, expected 40 (hex) or 32 (base32)", encoded, len(encoded),
+		)
+	}
+
+	return [20]byte(decoded), nil
+}
+
+// ParseMagnet parses a magnet URI of the form 'magnet:?xt=urn:btih:...' into a
+// Torrent skeleton. Returns the torrent or an error if any.
+//
+// The info hash is read from the 'xt' parameter, the name from 'dn' and the
+// trackers from every 'tr' parameter, each placed in its own tier of the announce
+// list. The first tracker is also used as the announce URL.
+//
+// The returned torrent carries no metadata (see Info.HasMetadata) until the info
+// dictionary is fetched from peers, but Info.Hash reports the magnet's info hash.
+func ParseMagnet(uri string) (*Torrent, error) {
+	magnet, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse magnet uri: %w", err)
+	}
+
+	if magnet.Scheme != "magnet" {
+		return nil, fmt.Errorf("expected magnet scheme, got %q", magnet.Scheme)
+	}
+
+	query := magnet.Query()
+
+	var infoHash *[20]byte
+	for _, xt := range query["xt"] {
+		if len(xt) < len(btihPrefix) || !strings.EqualFold(xt[:len(btihPrefix)], btihPrefix) {
+			continue // some other kind of exact topic
+		}
+
+		hash, err := ParseInfoHashURN(xt)
+		if err != nil {
+			return nil, err
+		}
+
+		infoHash = &hash
+		break
+	}
+
+	if infoHash == nil {
+		return nil, fmt.Errorf("magnet uri has no btih exact topic")
+	}
+
+	var announceList [][]string
+	for _, tracker := range query["tr"] {
+		announceList = append(announceList, []string{tracker})
+	}
+
+	var announceURL string
+	if len(announceList) > 0 {
+		announceURL = announceList[0][0]
+	}
+
+	return &Torrent{
+		Info:         Info{Name: query.Get("dn"), infoHash: infoHash},
+		AnnounceURL:  announceURL,
+		AnnounceList: announceList,
+	}, nil
+}
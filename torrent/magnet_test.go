@@ -0,0 +1,76 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseInfoHashURN(t *testing.T) {
+	expected, _ := hex.DecodeString("a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3")
+
+	valid := map[string]string{
+		"hex":              "urn:btih:a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3",
+		"uppercase hex":    "urn:btih:A0A1A2A3A4A5A6A7A8A9AAABACADAEAFB0B1B2B3",
+		"base32":           "urn:btih:UCQ2FI5EUWTKPKFJVKV2ZLNOV6YLDMVT",
+		"lowercase base32": "urn:btih:ucq2fi5euwtkpkfjvkv2zlnov6yldmvt",
+	}
+
+	for name, xt := range valid {
+		t.Run(name, func(t *testing.T) {
+			hash, err := ParseInfoHashURN(xt)
+			if err != nil {
+				t.Fatalf("could not parse %q: %v", xt, err)
+			}
+
+			if string(hash[:]) != string(expected) {
+				t.Errorf("parsed %q as %x, expected %x", xt, hash, expected)
+			}
+		})
+	}
+
+	invalid := map[string]string{
+		"truncated hex":  "urn:btih:a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2",
+		"invalid hex":    "urn:btih:g0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3",
+		"invalid base32": "urn:btih:UCQ2FI5EUWTKPKFJVKV2ZLNOV6YLDM01",
+		"padded base32":  "urn:btih:UCQ2FI5EUWTKPKFJVKV2ZLNOV6YLDM==",
+		"not a btih urn": "urn:sha1:a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3",
+		"empty hash":     "urn:btih:",
+	}
+
+	for name, xt := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if hash, err := ParseInfoHashURN(xt); err == nil {
+				t.Errorf("accepted %q as %x", xt, hash)
+			}
+		})
+	}
+}
+
+func TestParseMagnet(t *testing.T) {
+	torrent, err := ParseMagnet("magnet:?xt=urn:btih:UCQ2FI5EUWTKPKFJVKV2ZLNOV6YLDMVT&dn=test" +
+		"&tr=http%3A%2F%2Ftracker.example.com%2Fannounce&tr=udp%3A%2F%2Ftracker.example.org%3A6969")
+	if err != nil {
+		t.Fatalf("could not parse magnet: %v", err)
+	}
+
+	hash, err := torrent.Info.Hash()
+	if err != nil {
+		t.Fatalf("could not get info hash: %v", err)
+	}
+
+	if hex.EncodeToString(hash[:]) != "a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3" {
+		t.Errorf("magnet has info hash %x", hash)
+	}
+
+	if torrent.Info.Name != "test" || torrent.AnnounceURL != "http://tracker.example.com/announce" {
+		t.Errorf("magnet parsed as name %q and announce url %q", torrent.Info.Name, torrent.AnnounceURL)
+	}
+
+	if len(torrent.AnnounceList) != 2 {
+		t.Errorf("magnet has %d tiers, expected 2", len(torrent.AnnounceList))
+	}
+
+	if _, err := ParseMagnet("magnet:?xt=urn:btih:a0a1a2"); err == nil {
+		t.Errorf("accepted a magnet with a truncated info hash")
+	}
+}
@@ -1,5 +1,14 @@
 package torrent
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
 type MessageId int
 
 const (
@@ -12,6 +21,9 @@ const (
 	MessageRequest
 	MessagePiece
 	MessageCancel
+	MessagePort // DHT port message (BEP 5).
+
+	MessageExtended MessageId = 20 // Extension protocol message (BEP 10).
 )
 
 // A Message represents a peer message sent over the BitTorrent protocol.
@@ -43,6 +55,10 @@ type Message struct {
 	Request Request
 	// If message ID is piece (7), the contents of the piece.
 	Block Block
+	// If message ID is port (9), the UDP port of the DHT node of the peer.
+	Port uint16
+	// If message ID is extended (20), the contents of the extended message.
+	Extended Extended
 }
 
 // A BitField represents the contents of a bitfield (5) peer message.
@@ -51,19 +67,25 @@ type BitField struct {
 	Length int
 }
 
+// NewBitField returns an empty bit field able to hold 'pieces' pieces.
+func NewBitField(pieces int) BitField {
+	return BitField{Field: make([]byte, (pieces+7)/8), Length: pieces}
+}
+
 // HasPiece reports whether the piece at 'index' is contained in the bit field.
 func (bf *BitField) HasPiece(index int) bool {
-	if index >= bf.Length {
+	if index < 0 || index >= bf.Length {
 		return false
 	}
 
 	pieceByte := int(bf.Field[index/8])
 	offset := index % 8
-	return pieceByte&(1<<7-offset) != 0
+	return pieceByte&(1<<(7-offset)) != 0
 }
 
+// SetPiece marks the piece at 'index' as contained in the bit field.
 func (bf *BitField) SetPiece(index int) {
-	if index >= bf.Length {
+	if index < 0 || index >= bf.Length {
 		return
 	}
 
@@ -71,6 +93,77 @@ func (bf *BitField) SetPiece(index int) {
 	bf.Field[index/8] |= 1 << (7 - offset)
 }
 
+// Count returns the number of pieces contained in the bit field.
+func (bf *BitField) Count() int {
+	count := 0
+
+	for idx, pieceByte := range bf.Field {
+		if idx*8 >= bf.Length {
+			break
+		}
+
+		// Ignore the spare bits after the last piece.
+		if spare := (idx+1)*8 - bf.Length; spare > 0 {
+			pieceByte &= 0xff << spare
+		}
+
+		count += bits.OnesCount8(pieceByte)
+	}
+
+	return count
+}
+
+// Valid reports whether the bit field is well-formed, that is, whether it holds
+// exactly enough bytes for Length pieces and all spare bits after the last piece
+// are zero.
+func (bf *BitField) Valid() bool {
+	if len(bf.Field) != (bf.Length+7)/8 {
+		return false
+	}
+
+	if spare := len(bf.Field)*8 - bf.Length; spare > 0 {
+		return bf.Field[len(bf.Field)-1]&(1<<spare-1) == 0
+	}
+
+	return true
+}
+
+// Complete reports whether every piece is contained in the bit field.
+func (bf *BitField) Complete() bool {
+	return bf.Count() == bf.Length
+}
+
+// MarshalBinary encodes the bit field as its 4-byte big-endian piece count
+// followed by the bytes of the field.
+func (bf BitField) MarshalBinary() ([]byte, error) {
+	if !bf.Valid() {
+		return nil, fmt.Errorf("malformed bit field of %d bytes for %d pieces", len(bf.Field), bf.Length)
+	}
+
+	buf := binary.BigEndian.AppendUint32(nil, uint32(bf.Length))
+	return append(buf, bf.Field...), nil
+}
+
+// UnmarshalBinary decodes a bit field encoded by MarshalBinary from 'data'.
+// Returns an error if the field is truncated or malformed.
+func (bf *BitField) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("bit field of %d bytes is too short", len(data))
+	}
+
+	field := BitField{
+		Length: int(binary.BigEndian.Uint32(data[:4])),
+		Field:  bytes.Clone(data[4:]),
+	}
+
+	if !field.Valid() {
+		return fmt.Errorf("malformed bit field of %d bytes for %d pieces", len(field.Field), field.Length)
+	}
+
+	*bf = field
+	return nil
+}
+
 // A Request represents the contents of a request (6) and cancel (8) message.
 type Request struct {
 	Index  uint32 // The zero-based piece index.
@@ -85,14 +178,117 @@ type Block struct {
 	Block []byte // A block of data representing a subset of the piece.
 }
 
+// An Extended represents the contents of an extended (20) message.
+type Extended struct {
+	Id      byte   // The extended message ID. Zero for the extended handshake.
+	Payload []byte // The contents of the message, usually a bencoded dictionary.
+}
+
+// The bits of the reserved bytes of a handshake advertising support for an
+// extension, counting from the right of the last byte.
+const (
+	RESERVED_BIT_DHT        = 0  // The DHT protocol (BEP 5).
+	RESERVED_BIT_FAST       = 2  // The Fast Extension (BEP 6).
+	RESERVED_BIT_EXTENSIONS = 20 // The extension protocol (BEP 10).
+)
+
+// A Reserved represents the 8 reserved bytes of a handshake, in which peers
+// advertise the extensions they support.
+type Reserved [8]byte
+
+// NewReserved returns reserved bytes with each of 'bits' set.
+func NewReserved(bits ...int) Reserved {
+	var reserved Reserved
+	for _, bit := range bits {
+		reserved.Set(bit)
+	}
+
+	return reserved
+}
+
+// Set sets 'bit', counting from the right of the last byte. Bits out of range
+// are ignored.
+func (r *Reserved) Set(bit int) {
+	if bit < 0 || bit >= 64 {
+		return
+	}
+
+	r[7-bit/8] |= 1 << (bit % 8)
+}
+
+// Has reports whether 'bit' is set, counting from the right of the last byte.
+func (r Reserved) Has(bit int) bool {
+	if bit < 0 || bit >= 64 {
+		return false
+	}
+
+	return r[7-bit/8]&(1<<(bit%8)) != 0
+}
+
+// The protocol string sent at the start of every handshake.
+const PROTOCOL_STRING = "BitTorrent protocol"
+
+// ErrProtocolMismatch is returned when a peer starts its handshake with a
+// protocol string other than PROTOCOL_STRING. The peer does not speak the
+// BitTorrent protocol.
+var ErrProtocolMismatch = errors.New("protocol mismatch")
+
 // A Handshake represents a peer handshake.
 type Handshake struct {
-	Protocol string // The handshake protocol, usually "BitTorrent protocol"
+	Protocol string // The handshake protocol, PROTOCOL_STRING
 	Reserved []byte // Reserved bytes. Used by extensions, otherwise zeroed.
 	InfoHash string // The 20-byte info hash
 	PeerId   string // The 20-char peer ID
 }
 
+// ParseHandshake reads a peer handshake from 'r', the inverse of Serialized.
+// Returns the handshake or an error if any.
+//
+// Returns an error wrapping ErrProtocolMismatch if the protocol string is not
+// PROTOCOL_STRING. A protocol string of the wrong length is rejected before the
+// rest of the handshake is read.
+func ParseHandshake(r io.Reader) (*Handshake, error) {
+	pStrLen, err := ReadN(1, r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read peer handshake: %w", err)
+	}
+
+	if int(pStrLen[0]) != len(PROTOCOL_STRING) {
+		return nil, fmt.Errorf("%w: protocol string of %d bytes", ErrProtocolMismatch, pStrLen[0])
+	}
+
+	protocol, err := ReadN(int(pStrLen[0]), r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read peer handshake protocol: %w", err)
+	}
+
+	if string(protocol) != PROTOCOL_STRING {
+		return nil, fmt.Errorf("%w: got %q", ErrProtocolMismatch, protocol)
+	}
+
+	reserved, err := ReadN(8, r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read reserved bytes: %w", err)
+	}
+
+	infoHash, err := ReadN(20, r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read info hash: %w", err)
+	}
+
+	peerId, err := ReadN(20, r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read peer id: %w", err)
+	}
+
+	return &Handshake{
+		Protocol: string(protocol),
+		Reserved: reserved,
+		InfoHash: string(infoHash),
+		PeerId:   string(peerId),
+	}, nil
+}
+
 func (h *Handshake) Serialized() []byte {
 	message := []byte{}
 	message = append(message, byte(len(h.Protocol)))
@@ -0,0 +1,171 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBitFieldSetPiece(t *testing.T) {
+	const pieces = 20
+
+	for index := range pieces {
+		field := NewBitField(pieces)
+		field.SetPiece(index)
+
+		for other := range pieces {
+			if field.HasPiece(other) != (other == index) {
+				t.Errorf("after setting piece %d, HasPiece(%d) returned %t", index, other, field.HasPiece(other))
+			}
+		}
+
+		if field.Count() != 1 {
+			t.Errorf("after setting piece %d, the bit field counts %d pieces", index, field.Count())
+		}
+	}
+}
+
+func TestBitFieldHasPiece(t *testing.T) {
+	// Pieces 0, 7, 9 and 17 set, across three bytes.
+	field := BitField{Field: []byte{0b10000001, 0b01000000, 0b01000000}, Length: 20}
+
+	for index := range field.Length {
+		expected := index == 0 || index == 7 || index == 9 || index == 17
+		if field.HasPiece(index) != expected {
+			t.Errorf("HasPiece(%d) returned %t, expected %t", index, field.HasPiece(index), expected)
+		}
+	}
+
+	if field.HasPiece(field.Length) {
+		t.Errorf("HasPiece reported a piece past the end")
+	}
+}
+
+func TestBitFieldValid(t *testing.T) {
+	tests := []struct {
+		name  string
+		field BitField
+		valid bool
+	}{
+		{"exact", BitField{Field: []byte{0xff, 0xc0}, Length: 10}, true},
+		{"whole bytes", BitField{Field: []byte{0xff, 0xff}, Length: 16}, true},
+		{"empty", BitField{Field: []byte{}, Length: 0}, true},
+		{"over-long", BitField{Field: []byte{0xff, 0xc0, 0x00}, Length: 10}, false},
+		{"short", BitField{Field: []byte{0xff}, Length: 10}, false},
+		{"dirty padding", BitField{Field: []byte{0xff, 0xc1}, Length: 10}, false},
+		{"dirty padding only", BitField{Field: []byte{0x00, 0x20}, Length: 10}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.field.Valid() != test.valid {
+				t.Errorf("Valid returned %t for %x of %d pieces", !test.valid, test.field.Field, test.field.Length)
+			}
+		})
+	}
+}
+
+func TestParseHandshake(t *testing.T) {
+	handshake := Handshake{
+		Protocol: PROTOCOL_STRING,
+		Reserved: DEFAULT_RESERVED[:],
+		InfoHash: strings.Repeat("h", 20),
+		PeerId:   strings.Repeat("p", 20),
+	}
+
+	parsed, err := ParseHandshake(bytes.NewReader(handshake.Serialized()))
+	if err != nil {
+		t.Fatalf("could not parse handshake: %v", err)
+	}
+
+	if !reflect.DeepEqual(*parsed, handshake) {
+		t.Errorf("parsed %+v, expected %+v", *parsed, handshake)
+	}
+}
+
+func TestParseHandshakeMismatch(t *testing.T) {
+	rest := strings.Repeat("\x00", 8+20+20)
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"wrong protocol", "\x13" + "BitTorrent protocoL" + rest},
+		{"other protocol", "\x13" + "Gnutella protocol!!" + rest},
+		// Only the length is read, as nothing follows it.
+		{"zero length", "\x00"},
+		{"short length", "\x0aBitTorrent"},
+		{"long length", "\xff"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handshake, err := ParseHandshake(strings.NewReader(test.data))
+			if !errors.Is(err, ErrProtocolMismatch) {
+				t.Errorf("parsed %+v with error %v, expected ErrProtocolMismatch", handshake, err)
+			}
+		})
+	}
+}
+
+func TestParseHandshakeTruncated(t *testing.T) {
+	handshake := Handshake{
+		Protocol: PROTOCOL_STRING,
+		Reserved: make([]byte, 8),
+		InfoHash: strings.Repeat("h", 20),
+		PeerId:   strings.Repeat("p", 20),
+	}
+	data := handshake.Serialized()
+
+	for _, length := range []int{0, 10, 20, 30, 50, len(data) - 1} {
+		_, err := ParseHandshake(bytes.NewReader(data[:length]))
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("handshake truncated to %d bytes returned %v, expected an EOF", length, err)
+		}
+	}
+}
+
+func TestBitFieldMarshalBinary(t *testing.T) {
+	field := NewBitField(10)
+	field.SetPiece(0)
+	field.SetPiece(9)
+
+	data, err := field.MarshalBinary()
+	if err != nil {
+		t.Fatalf("could not marshal bit field: %v", err)
+	}
+
+	var decoded BitField
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("could not unmarshal bit field: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, field) {
+		t.Errorf("round trip returned %+v, expected %+v", decoded, field)
+	}
+}
+
+func TestBitFieldUnmarshalBinaryMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated length", []byte{0x00, 0x00, 0x0a}},
+		{"short", []byte{0x00, 0x00, 0x00, 0x0a, 0xff}},
+		{"over-long", []byte{0x00, 0x00, 0x00, 0x0a, 0xff, 0xc0, 0x00}},
+		{"dirty padding", []byte{0x00, 0x00, 0x00, 0x0a, 0xff, 0xc1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var field BitField
+			if err := field.UnmarshalBinary(test.data); err == nil {
+				t.Errorf("UnmarshalBinary accepted %x as %+v", test.data, field)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+/* Assembly of torrent metadata (the info dictionary) received from peers. */
+
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+
+	"github.com/aescarias/apricot/torrent/bencode"
+)
+
+// The size of each metadata piece exchanged between peers (16 KiB).
+const METADATA_PIECE_SIZE = 16 * 1024
+
+// A MetadataAssembler collects the pieces of a torrent's info dictionary as
+// they are received from peers.
+//
+// Pieces are retained across interruptions so that a fetch can be resumed by
+// only requesting the pieces reported by Missing. An assembler may be persisted
+// to disk with Save and restored with LoadMetadataAssembler.
+type MetadataAssembler struct {
+	InfoHash [20]byte // The info hash the assembled metadata must match.
+	Size     int      // The total size of the metadata in bytes. Zero if not yet known.
+
+	pieces [][]byte
+}
+
+// NewMetadataAssembler creates an empty assembler for the metadata identified
+// by 'infoHash'.
+func NewMetadataAssembler(infoHash [20]byte) *MetadataAssembler {
+	return &MetadataAssembler{InfoHash: infoHash}
+}
+
+// SetSize sets the total size of the metadata as advertised by a peer.
+//
+// If the size differs from a previously known size, all retained pieces are
+// discarded. Returns an error if the size is not positive.
+func (m *MetadataAssembler) SetSize(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid metadata size %d", size)
+	}
+
+	if size == m.Size {
+		return nil
+	}
+
+	m.Size = size
+	m.pieces = make([][]byte, m.NumPieces())
+
+	return nil
+}
+
+// NumPieces returns the number of pieces the metadata is split into.
+func (m *MetadataAssembler) NumPieces() int {
+	return (m.Size + METADATA_PIECE_SIZE - 1) / METADATA_PIECE_SIZE
+}
+
+// pieceLength returns the expected length of the piece at 'index'.
+func (m *MetadataAssembler) pieceLength(index int) int {
+	if index == m.NumPieces()-1 {
+		return m.Size - index*METADATA_PIECE_SIZE
+	}
+
+	return METADATA_PIECE_SIZE
+}
+
+// AddPiece stores the metadata piece at 'index'. Returns an error if the index
+// is out of range or the piece has an unexpected length.
+func (m *MetadataAssembler) AddPiece(index int, data []byte) error {
+	if index < 0 || index >= len(m.pieces) {
+		return fmt.Errorf("metadata piece index %d out of range", index)
+	}
+
+	if expected := m.pieceLength(index); len(data) != expected {
+		return fmt.Errorf("metadata piece %d has length %d, expected %d", index, len(data), expected)
+	}
+
+	m.pieces[index] = data
+	return nil
+}
+
+// Missing returns the indices of the pieces that have not been received yet.
+func (m *MetadataAssembler) Missing() []int {
+	var missing []int
+
+	for idx, piece := range m.pieces {
+		if piece == nil {
+			missing = append(missing, idx)
+		}
+	}
+
+	return missing
+}
+
+// Complete reports whether every piece of the metadata has been received.
+func (m *MetadataAssembler) Complete() bool {
+	return m.Size > 0 && len(m.Missing()) == 0
+}
+
+// Assemble concatenates the received pieces and verifies the result against
+// the info hash. Returns the bencoded info dictionary or an error if any.
+//
+// If the assembled metadata does not match the info hash, all retained pieces
+// are discarded since there is no way to tell which of them is corrupt.
+func (m *MetadataAssembler) Assemble() ([]byte, error) {
+	if !m.Complete() {
+		return nil, fmt.Errorf("metadata is incomplete: %d pieces missing", len(m.Missing()))
+	}
+
+	metadata := make([]byte, 0, m.Size)
+	for _, piece := range m.pieces {
+		metadata = append(metadata, piece...)
+	}
+
+	if sha1.Sum(metadata) != m.InfoHash {
+		m.pieces = make([][]byte, m.NumPieces())
+		return nil, fmt.Errorf("assembled metadata does not match info hash")
+	}
+
+	return metadata, nil
+}
+
+// Save writes the state of the assembler to the file at 'path' so that the
+// fetch may be resumed later. Returns an error if any.
+func (m *MetadataAssembler) Save(path string) error {
+	pieces := make([]string, len(m.pieces))
+	for idx, piece := range m.pieces {
+		pieces[idx] = string(piece)
+	}
+
+	encoded, err := bencode.EncodeBencode(map[string]any{
+		"info hash":     string(m.InfoHash[:]),
+		"metadata size": m.Size,
+		"pieces":        pieces,
+	})
+	if err != nil {
+		return fmt.Errorf("could not encode metadata state: %w", err)
+	}
+
+	return os.WriteFile(path, []byte(encoded), 0o644)
+}
+
+// LoadMetadataAssembler restores an assembler previously written by Save
+// from the file at 'path'. Returns the assembler or an error if any.
+func LoadMetadataAssembler(path string) (*MetadataAssembler, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := bencode.DecodeBencode(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode metadata state: %w", err)
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("metadata state is empty")
+	}
+
+	state, ok := tokens[0].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("expected metadata state dictionary")
+	}
+
+	infoHash, ok := state["info hash"].(string)
+	if !ok || len(infoHash) != 20 {
+		return nil, fmt.Errorf("invalid info hash in metadata state")
+	}
+
+	size, ok := state["metadata size"].(int64)
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata size in metadata state")
+	}
+
+	rawPieces, ok := state["pieces"].([]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid pieces in metadata state")
+	}
+
+	assembler := NewMetadataAssembler([20]byte([]byte(infoHash)))
+	if size <= 0 {
+		return assembler, nil
+	}
+
+	if err := assembler.SetSize(int(size)); err != nil {
+		return nil, err
+	}
+
+	if len(rawPieces) != assembler.NumPieces() {
+		return nil, fmt.Errorf("metadata state has %d pieces, expected %d", len(rawPieces), assembler.NumPieces())
+	}
+
+	for idx, rawPiece := range rawPieces {
+		piece, ok := rawPiece.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid piece %d in metadata state", idx)
+		}
+
+		if len(piece) == 0 {
+			continue
+		}
+
+		if err := assembler.AddPiece(idx, []byte(piece)); err != nil {
+			return nil, err
+		}
+	}
+
+	return assembler, nil
+}
+
+const (
+	utMetadataName  = "ut_metadata"    // The name of the metadata extension (BEP 9).
+	utMetadataId    = 1                // The extended message ID we expect for metadata messages.
+	maxMetadataSize = 16 * 1024 * 1024 // The largest metadata size accepted from a peer (16 MiB).
+)
+
+// The types of metadata messages.
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// A metadataMessage represents the dictionary of a ut_metadata message.
+type metadataMessage struct {
+	Type      int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// FetchMetadata downloads the info dictionary of the torrent identified by
+// 'infoHash' from the peer using the metadata extension (BEP 9), performing
+// the extended handshake first if needed.
+//
+// The metadata is requested one piece at a time and verified against the info
+// hash once assembled. Returns the parsed info or an error if any.
+func (c *TCPClient) FetchMetadata(infoHash [20]byte) (*Info, error) {
+	return c.FetchMetadataInto(NewMetadataAssembler(infoHash))
+}
+
+// FetchMetadataInto downloads the info dictionary like FetchMetadata, collecting
+// the pieces into 'assembler' and only requesting those reported by its Missing
+// method. Pieces received before an error are kept in the assembler, so that an
+// interrupted fetch can be resumed from the same or another peer, or from an
+// assembler restored with LoadMetadataAssembler.
+//
+// Returns the parsed info or an error if any.
+func (c *TCPClient) FetchMetadataInto(assembler *MetadataAssembler) (*Info, error) {
+	if c.Extensions == nil {
+		if _, err := c.ExchangeExtendedHandshake(c.localExtendedHandshake()); err != nil {
+			return nil, err
+		}
+	}
+
+	peerId, ok := c.ExtensionId(utMetadataName)
+	if !ok {
+		return nil, fmt.Errorf("peer does not support the metadata extension")
+	}
+
+	if size := c.Extensions.MetadataSize; size > maxMetadataSize {
+		return nil, fmt.Errorf("metadata size %d exceeds the limit of %d", size, maxMetadataSize)
+	}
+
+	if err := assembler.SetSize(c.Extensions.MetadataSize); err != nil {
+		return nil, err
+	}
+
+	for _, index := range assembler.Missing() {
+		piece, err := c.fetchMetadataPiece(peerId, index)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := assembler.AddPiece(index, piece); err != nil {
+			return nil, err
+		}
+	}
+
+	metadata, err := assembler.Assemble()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewInfoFromBencode(string(metadata))
+}
+
+// fetchMetadataPiece requests the metadata piece at 'index' from the peer, which
+// expects metadata messages with the extended message ID 'peerId'. Returns the
+// contents of the piece or an error if any.
+func (c *TCPClient) fetchMetadataPiece(peerId byte, index int) ([]byte, error) {
+	request, err := bencode.Marshal(metadataMessage{Type: metadataRequest, Piece: index})
+	if err != nil {
+		return nil, fmt.Errorf("could not encode metadata request: %w", err)
+	}
+
+	err = c.SendMessage(Message{Id: MessageExtended, Extended: Extended{Id: peerId, Payload: request}})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		message, err := c.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("could not read metadata piece: %w", err)
+		}
+
+		if message.Id != MessageExtended || message.Extended.Id != utMetadataId {
+			c.handleStateMessage(message)
+			continue
+		}
+
+		// The dictionary of a data message is followed by the contents of the piece.
+		payload := string(message.Extended.Payload)
+		scanner := bencode.Scanner{Contents: payload, CurrentIndex: 0}
+
+		dictionary, _, err := bencode.ParseBencodeDictionarySpans(&scanner)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode metadata message: %w", err)
+		}
+
+		var response metadataMessage
+		if err := bencode.UnmarshalToken(dictionary, &response); err != nil {
+			return nil, fmt.Errorf("could not decode metadata message: %w", err)
+		}
+
+		if response.Piece != index {
+			continue
+		}
+
+		switch response.Type {
+		case metadataData:
+			return []byte(payload[scanner.CurrentIndex:]), nil
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected request for metadata piece %d", index)
+		}
+	}
+}
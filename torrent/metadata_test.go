@@ -0,0 +1,155 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aescarias/apricot/torrent/bencode"
+)
+
+// metadataPeer serves the metadata extension over the connection of a client,
+// recording the pieces requested from it. If 'limit' is positive, the connection
+// is closed once that many pieces were served.
+type metadataPeer struct {
+	client   *TCPClient
+	metadata []byte
+	limit    int
+
+	mu        sync.Mutex
+	requested []int
+}
+
+func (p *metadataPeer) serve() {
+	defer p.client.Connection.Close()
+
+	for served := 0; p.limit <= 0 || served < p.limit; served++ {
+		message, err := p.client.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var request metadataMessage
+		if err := bencode.Unmarshal(message.Extended.Payload, &request); err != nil {
+			return
+		}
+
+		p.mu.Lock()
+		p.requested = append(p.requested, request.Piece)
+		p.mu.Unlock()
+
+		start := request.Piece * METADATA_PIECE_SIZE
+		end := min(start+METADATA_PIECE_SIZE, len(p.metadata))
+
+		header, _ := bencode.Marshal(metadataMessage{Type: metadataData, Piece: request.Piece, TotalSize: len(p.metadata)})
+		payload := append(header, p.metadata[start:end]...)
+
+		err = p.client.SendMessage(Message{Id: MessageExtended, Extended: Extended{Id: utMetadataId, Payload: payload}})
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *metadataPeer) requests() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return slices.Clone(p.requested)
+}
+
+// newMetadataClient connects a client to a peer serving 'metadata', the peer
+// closing the connection after serving 'limit' pieces if positive.
+func newMetadataClient(t *testing.T, metadata []byte, limit int) (*TCPClient, *metadataPeer) {
+	client, remote := newClientPair(t, 0)
+	client.Extensions = &ExtendedHandshake{
+		Extensions:   map[string]int{utMetadataName: 3},
+		MetadataSize: len(metadata),
+	}
+
+	peer := &metadataPeer{client: remote, metadata: metadata, limit: limit}
+	go peer.serve()
+
+	return client, peer
+}
+
+// testMetadata returns an info dictionary spanning three metadata pieces.
+func testMetadata(t *testing.T) []byte {
+	t.Helper()
+
+	numPieces := 2*METADATA_PIECE_SIZE/20 + 100
+
+	metadata, err := bencode.Marshal(Info{
+		Name:        "metadata",
+		PieceLength: 16384,
+		Pieces:      strings.Repeat("x", 20*numPieces),
+		Length:      int64(numPieces) * 16384,
+	})
+	if err != nil {
+		t.Fatalf("could not encode info: %v", err)
+	}
+
+	return metadata
+}
+
+func TestFetchMetadataResume(t *testing.T) {
+	metadata := testMetadata(t)
+	infoHash := sha1.Sum(metadata)
+	assembler := NewMetadataAssembler(infoHash)
+
+	// The first peer disconnects after serving a single piece.
+	client, _ := newMetadataClient(t, metadata, 1)
+	if _, err := client.FetchMetadataInto(assembler); err == nil {
+		t.Fatalf("fetch from a peer disconnecting early succeeded")
+	}
+
+	if missing := assembler.Missing(); !slices.Equal(missing, []int{1, 2}) {
+		t.Fatalf("expected pieces 1 and 2 missing after interruption, got %v", missing)
+	}
+
+	path := filepath.Join(t.TempDir(), "metadata.state")
+	if err := assembler.Save(path); err != nil {
+		t.Fatalf("could not save assembler: %v", err)
+	}
+
+	restored, err := LoadMetadataAssembler(path)
+	if err != nil {
+		t.Fatalf("could not load assembler: %v", err)
+	}
+
+	client, peer := newMetadataClient(t, metadata, 0)
+
+	info, err := client.FetchMetadataInto(restored)
+	if err != nil {
+		t.Fatalf("could not resume fetch: %v", err)
+	}
+
+	if requested := peer.requests(); !slices.Equal(requested, []int{1, 2}) {
+		t.Errorf("resumed fetch requested pieces %v, expected only [1 2]", requested)
+	}
+
+	if hash, _ := info.Hash(); hash != infoHash {
+		t.Errorf("fetched info has hash %x, expected %x", hash, infoHash)
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	metadata := testMetadata(t)
+	client, peer := newMetadataClient(t, metadata, 0)
+
+	info, err := client.FetchMetadata(sha1.Sum(metadata))
+	if err != nil {
+		t.Fatalf("could not fetch metadata: %v", err)
+	}
+
+	if info.Name != "metadata" {
+		t.Errorf("fetched info has name %q", info.Name)
+	}
+
+	if requested := peer.requests(); !slices.Equal(requested, []int{0, 1, 2}) {
+		t.Errorf("fetch requested pieces %v", requested)
+	}
+}
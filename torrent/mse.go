@@ -0,0 +1,286 @@
+/*
+Torrent implementation dealing with Message Stream Encryption (MSE), also known
+as Protocol Encryption (PE).
+
+See https://wiki.vuze.com/w/Message_Stream_Encryption
+
+Only the initiating side of the handshake is implemented. Peers first agree on
+a shared secret through a Diffie-Hellman key exchange, then use it together
+with the info hash to derive RC4 keys for each direction.
+*/
+
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+// The time allowed for the encryption handshake to complete.
+const MSE_TIMEOUT = 30 * time.Second
+
+const (
+	mseKeyLength = 96   // The length of the public keys and shared secret in bytes.
+	mseMaxPad    = 512  // The maximum length of the random padding in bytes.
+	mseDiscard   = 1024 // The number of bytes discarded from the start of each RC4 key stream.
+
+	cryptoPlaintext = 0x01 // The crypto method sending the payload unencrypted.
+	cryptoRC4       = 0x02 // The crypto method sending the payload encrypted with RC4.
+)
+
+var (
+	msePrime = func() *big.Int {
+		prime, _ := new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+		return prime
+	}()
+	mseGenerator = big.NewInt(2)
+)
+
+// An EncryptionPolicy controls how NewTCPClientEncrypted negotiates encryption
+// with a peer.
+type EncryptionPolicy int
+
+const (
+	// Prefer RC4 encryption, but accept an unencrypted payload and fall back to
+	// an unencrypted connection if the peer does not support encryption.
+	EncryptionPreferred EncryptionPolicy = iota
+	// Require RC4 encryption and never fall back to an unencrypted connection.
+	EncryptionRequired
+)
+
+// An mseConn represents a connection whose payload is encrypted with RC4.
+type mseConn struct {
+	net.Conn
+	encrypt *rc4.Cipher
+	decrypt *rc4.Cipher
+}
+
+// Read reads and decrypts data from the connection.
+func (c *mseConn) Read(p []byte) (int, error) {
+	read, err := c.Conn.Read(p)
+	c.decrypt.XORKeyStream(p[:read], p[:read])
+
+	return read, err
+}
+
+// Write encrypts and writes data to the connection.
+func (c *mseConn) Write(p []byte) (int, error) {
+	encrypted := make([]byte, len(p))
+	c.encrypt.XORKeyStream(encrypted, p)
+
+	return c.Conn.Write(encrypted)
+}
+
+// NewTCPClientEncrypted creates a TCP connection with 'peer' in the same way as
+// NewTCPClient, but performs an encryption handshake before the BitTorrent
+// handshake, according to 'policy'.
+//
+// With EncryptionPreferred, a peer that fails the encryption handshake is dialed
+// again and connected to without encryption. The peer is dialed directly with a
+// timeout of DIAL_TIMEOUT.
+func NewTCPClientEncrypted(infoHash string, peer TrackerPeer, peerId string, pieces int, policy EncryptionPolicy) (*TCPClient, error) {
+	conn, err := DialPeer(peer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := mseHandshake(conn, []byte(infoHash), policy)
+	if err != nil {
+		conn.Close()
+
+		if policy == EncryptionRequired {
+			return nil, fmt.Errorf("could not perform encryption handshake: %w", err)
+		}
+
+		return NewTCPClient(infoHash, peer, peerId, pieces)
+	}
+
+	client, err := performHandshake(encrypted, infoHash, peer, peerId, pieces, DEFAULT_RESERVED)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// mseHash returns the SHA1 hash of the concatenation of 'parts'.
+func mseHash(parts ...[]byte) []byte {
+	hash := sha1.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+
+	return hash.Sum(nil)
+}
+
+// mseCipher returns an RC4 cipher keyed with 'key' with the first 1024 bytes of
+// its key stream discarded.
+func mseCipher(key []byte) (*rc4.Cipher, error) {
+	cipher, err := rc4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	discard := make([]byte, mseDiscard)
+	cipher.XORKeyStream(discard, discard)
+
+	return cipher, nil
+}
+
+// msePad returns between zero and mseMaxPad random bytes.
+func msePad() ([]byte, error) {
+	length, err := rand.Int(rand.Reader, big.NewInt(mseMaxPad+1))
+	if err != nil {
+		return nil, err
+	}
+
+	pad := make([]byte, length.Int64())
+	if _, err := rand.Read(pad); err != nil {
+		return nil, err
+	}
+
+	return pad, nil
+}
+
+// mseHandshake performs the initiating side of the encryption handshake over
+// 'conn' for the torrent identified by 'infoHash', offering the crypto methods
+// allowed by 'policy'.
+//
+// Returns the connection the BitTorrent handshake should be performed over,
+// which is either an encrypted wrapper of 'conn' or 'conn' itself if the peer
+// selected an unencrypted payload, and an error if any.
+func mseHandshake(conn net.Conn, infoHash []byte, policy EncryptionPolicy) (net.Conn, error) {
+	if err := conn.SetDeadline(time.Now().Add(MSE_TIMEOUT)); err != nil {
+		return nil, fmt.Errorf("could not set deadline: %w", err)
+	}
+
+	defer conn.SetDeadline(time.Time{})
+
+	// 1. Send our public key Ya followed by random padding.
+	private := make([]byte, 20)
+	if _, err := rand.Read(private); err != nil {
+		return nil, fmt.Errorf("could not generate private key: %w", err)
+	}
+
+	privateKey := new(big.Int).SetBytes(private)
+	publicKey := new(big.Int).Exp(mseGenerator, privateKey, msePrime)
+
+	padA, err := msePad()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate padding: %w", err)
+	}
+
+	if _, err := conn.Write(append(publicKey.FillBytes(make([]byte, mseKeyLength)), padA...)); err != nil {
+		return nil, fmt.Errorf("could not send public key: %w", err)
+	}
+
+	// 2. Receive the public key Yb of the peer and compute the shared secret S.
+	peerKey, err := ReadN(mseKeyLength, conn)
+	if err != nil {
+		return nil, fmt.Errorf("could not read peer public key: %w", err)
+	}
+
+	secret := new(big.Int).Exp(new(big.Int).SetBytes(peerKey), privateKey, msePrime).FillBytes(make([]byte, mseKeyLength))
+
+	encrypt, err := mseCipher(mseHash([]byte("keyA"), secret, infoHash))
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %w", err)
+	}
+
+	decrypt, err := mseCipher(mseHash([]byte("keyB"), secret, infoHash))
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %w", err)
+	}
+
+	// 3. Send the hashes identifying the torrent, the verification constant and
+	// the crypto methods we provide, without padding or initial payload.
+	provide := uint32(cryptoRC4)
+	if policy == EncryptionPreferred {
+		provide |= cryptoPlaintext
+	}
+
+	req2 := mseHash([]byte("req2"), infoHash)
+	req3 := mseHash([]byte("req3"), secret)
+	for idx := range req2 {
+		req2[idx] ^= req3[idx]
+	}
+
+	payload := make([]byte, 8) // verification constant
+	payload = binary.BigEndian.AppendUint32(payload, provide)
+	payload = binary.BigEndian.AppendUint16(payload, 0) // length of PadC
+	payload = binary.BigEndian.AppendUint16(payload, 0) // length of IA
+	encrypt.XORKeyStream(payload, payload)
+
+	message := append(mseHash([]byte("req1"), secret), req2...)
+	if _, err := conn.Write(append(message, payload...)); err != nil {
+		return nil, fmt.Errorf("could not send crypto request: %w", err)
+	}
+
+	// 4. Skip the padding of the peer until the encrypted verification constant,
+	// then receive the crypto method selected by the peer.
+	verification := make([]byte, 8)
+	decrypt.XORKeyStream(verification, verification)
+
+	if err := mseSync(conn, verification); err != nil {
+		return nil, err
+	}
+
+	selection, err := ReadN(6, conn)
+	if err != nil {
+		return nil, fmt.Errorf("could not read crypto selection: %w", err)
+	}
+
+	decrypt.XORKeyStream(selection, selection)
+
+	padLength := binary.BigEndian.Uint16(selection[4:])
+	if padLength > mseMaxPad {
+		return nil, fmt.Errorf("peer sent padding of %d bytes", padLength)
+	}
+
+	padD, err := ReadN(int(padLength), conn)
+	if err != nil {
+		return nil, fmt.Errorf("could not read padding: %w", err)
+	}
+
+	decrypt.XORKeyStream(padD, padD)
+
+	switch selected := binary.BigEndian.Uint32(selection[:4]); {
+	case selected == cryptoRC4:
+		return &mseConn{Conn: conn, encrypt: encrypt, decrypt: decrypt}, nil
+	case selected == cryptoPlaintext && policy == EncryptionPreferred:
+		return conn, nil
+	default:
+		return nil, fmt.Errorf("peer selected unsupported crypto method %#x", selected)
+	}
+}
+
+// mseSync reads from 'conn' until 'verification' is found, reading at most
+// mseMaxPad bytes of padding before it.
+func mseSync(conn io.Reader, verification []byte) error {
+	window := make([]byte, 0, mseMaxPad+len(verification))
+	buf := make([]byte, 1)
+
+	for len(window) < cap(window) {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return fmt.Errorf("could not read verification constant: %w", err)
+		}
+
+		window = append(window, buf[0])
+		if bytes.HasSuffix(window, verification) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("could not find verification constant")
+}
@@ -0,0 +1,175 @@
+/*
+Torrent implementation dealing with peer exchange.
+
+See https://bittorrent.org/beps/bep_0011.html
+*/
+
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aescarias/apricot/torrent/bencode"
+)
+
+const (
+	utPexName    = "ut_pex"        // The name of the peer exchange extension (BEP 11).
+	utPexId      = 2               // The extended message ID we expect for peer exchange messages.
+	PEX_INTERVAL = 1 * time.Minute // The interval at which peer exchange messages are sent.
+	maxPexPeers  = 50              // The most peers added or dropped in a single message.
+)
+
+// ErrPrivateTorrent is returned when attempting to discover peers for a private
+// torrent (BEP 27) through means other than its trackers.
+var ErrPrivateTorrent = errors.New("torrent is private")
+
+// A pexMessage represents the dictionary of a ut_pex message. The peer lists
+// are in compact format.
+type pexMessage struct {
+	Added    string `bencode:"added"`
+	Added6   string `bencode:"added6,omitempty"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// ParsePexMessage decodes the 'payload' of a peer exchange message. Returns the
+// peers added and dropped by the sender or an error if any.
+func ParsePexMessage(payload []byte) ([]TrackerPeer, []TrackerPeer, error) {
+	var message pexMessage
+	if err := bencode.Unmarshal(payload, &message); err != nil {
+		return nil, nil, fmt.Errorf("could not decode pex message: %w", err)
+	}
+
+	added, err := compactToPeerList(message.Added)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	added6, err := compactToPeerList6(message.Added6)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dropped, err := compactToPeerList(message.Dropped)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dropped6, err := compactToPeerList6(message.Dropped6)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(added, added6...), append(dropped, dropped6...), nil
+}
+
+// handlePexMessage passes the peers added by a peer exchange message to the
+// OnPexPeers callback. Messages are ignored for private torrents.
+func (c *TCPClient) handlePexMessage(payload []byte) {
+	if c.OnPexPeers == nil || (c.Info != nil && c.Info.Private) {
+		return
+	}
+
+	added, _, err := ParsePexMessage(payload)
+	if err != nil || len(added) == 0 {
+		return
+	}
+
+	c.OnPexPeers(added)
+}
+
+// SendPex sends a peer exchange message listing the peers 'added' and 'dropped'
+// since the previous message. At most 50 peers of each kind are sent.
+//
+// Returns ErrPrivateTorrent for private torrents or an error if the peer does
+// not support peer exchange.
+func (c *TCPClient) SendPex(added []TrackerPeer, dropped []TrackerPeer) error {
+	if c.Info != nil && c.Info.Private {
+		return ErrPrivateTorrent
+	}
+
+	peerId, ok := c.ExtensionId(utPexName)
+	if !ok {
+		return fmt.Errorf("peer does not support peer exchange")
+	}
+
+	var message pexMessage
+	message.Added, message.Added6 = peersToCompact(added[:min(len(added), maxPexPeers)])
+	message.Dropped, message.Dropped6 = peersToCompact(dropped[:min(len(dropped), maxPexPeers)])
+
+	payload, err := bencode.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("could not encode pex message: %w", err)
+	}
+
+	return c.SendMessage(Message{Id: MessageExtended, Extended: Extended{Id: peerId, Payload: payload}})
+}
+
+// StartPex periodically sends peer exchange messages to the peer until 'ctx' is
+// done or sending fails. Every PEX_INTERVAL, the peers returned by 'peers' are
+// compared to those previously sent and the differences are sent to the peer.
+//
+// Returns ErrPrivateTorrent for private torrents or an error if the peer does
+// not support peer exchange. Otherwise, the messages are sent in the background.
+func (c *TCPClient) StartPex(ctx context.Context, peers func() []TrackerPeer) error {
+	if c.Info != nil && c.Info.Private {
+		return ErrPrivateTorrent
+	}
+
+	if _, ok := c.ExtensionId(utPexName); !ok {
+		return fmt.Errorf("peer does not support peer exchange")
+	}
+
+	go func() {
+		ticker := time.NewTicker(PEX_INTERVAL)
+		defer ticker.Stop()
+
+		sent := make(map[string]TrackerPeer)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current := make(map[string]TrackerPeer)
+			var added, dropped []TrackerPeer
+
+			for _, peer := range peers() {
+				current[peer.String()] = peer
+				if _, ok := sent[peer.String()]; !ok {
+					added = append(added, peer)
+				}
+			}
+
+			for addr, peer := range sent {
+				if _, ok := current[addr]; !ok {
+					dropped = append(dropped, peer)
+				}
+			}
+
+			if len(added) == 0 && len(dropped) == 0 {
+				continue
+			}
+
+			if err := c.SendPex(added, dropped); err != nil {
+				return
+			}
+
+			// Only the peers that fit in the message count as sent.
+			for _, peer := range added[:min(len(added), maxPexPeers)] {
+				sent[peer.String()] = peer
+			}
+
+			for _, peer := range dropped[:min(len(dropped), maxPexPeers)] {
+				delete(sent, peer.String())
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,218 @@
+/* Management of a bounded set of peer connections. */
+
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// The default number of peers a PeerPool keeps connected at once.
+const MAX_PEERS = 30
+
+// A PeerPool keeps up to MaxPeers connections to the peers of a torrent open,
+// dialing peers from a backlog as connections are retired.
+//
+// Peers are identified by their address, so a peer is never queued or connected
+// twice at once. Peers that answer a handshake with the wrong identity (see
+// ErrInfoHashMismatch) are never dialed again. A PeerPool is safe for use by
+// multiple goroutines.
+type PeerPool struct {
+	Info   *Info  // The info of the torrent the peers are connected for.
+	PeerId string // The 20-byte peer ID used in handshakes.
+
+	// The number of peers kept connected at once. Defaults to MAX_PEERS.
+	MaxPeers int
+	// (optional) How peers are dialed. Defaults to a direct connection with a
+	// timeout of DIAL_TIMEOUT.
+	Dial *DialOptions
+
+	mu       sync.Mutex
+	infoHash [20]byte
+	backlog  []TrackerPeer
+	known    map[string]bool // The peers that are queued, being dialed or connected.
+	banned   map[string]bool // The peers that must not be dialed again.
+	dialing  int
+	clients  []*TCPClient
+	cancels  map[*TCPClient]context.CancelFunc
+}
+
+// NewPeerPool creates an empty pool of connections for the torrent described by
+// 'info', using 'peerId' in handshakes. Returns the pool or an error if any.
+func NewPeerPool(info *Info, peerId string) (*PeerPool, error) {
+	infoHash, err := info.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("could not get info hash: %w", err)
+	}
+
+	return &PeerPool{
+		Info:     info,
+		PeerId:   peerId,
+		MaxPeers: MAX_PEERS,
+		infoHash: infoHash,
+		known:    make(map[string]bool),
+		banned:   make(map[string]bool),
+		cancels:  make(map[*TCPClient]context.CancelFunc),
+	}, nil
+}
+
+// Add queues 'peers' to be dialed by Fill. Peers already queued, connected or
+// banned are skipped. Queued peers are ordered by the IP preference of Dial.
+func (p *PeerPool) Add(peers ...TrackerPeer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, peer := range peers {
+		key := peer.String()
+		if p.known[key] || p.banned[key] {
+			continue
+		}
+
+		p.known[key] = true
+		p.backlog = append(p.backlog, peer)
+	}
+
+	p.backlog = PreferPeers(p.backlog, p.Dial.preference())
+}
+
+// Fill dials peers from the backlog concurrently until MaxPeers peers are
+// connected or the backlog is empty, and blocks until the dials are done.
+// Returns the number of peers connected.
+func (p *PeerPool) Fill() int {
+	connected := 0
+
+	for {
+		batch := p.takeBatch()
+		if len(batch) == 0 {
+			return connected
+		}
+
+		var wg sync.WaitGroup
+		for _, peer := range batch {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				if p.dial(peer) {
+					p.mu.Lock()
+					connected++
+					p.mu.Unlock()
+				}
+			}()
+		}
+
+		wg.Wait()
+	}
+}
+
+// takeBatch removes as many peers from the backlog as there are free connection
+// slots and counts them as being dialed.
+func (p *PeerPool) takeBatch() []TrackerPeer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	maxPeers := p.MaxPeers
+	if maxPeers <= 0 {
+		maxPeers = MAX_PEERS
+	}
+
+	free := max(0, maxPeers-len(p.clients)-p.dialing)
+	batch := p.backlog[:min(free, len(p.backlog))]
+	p.backlog = slices.Clone(p.backlog[len(batch):])
+	p.dialing += len(batch)
+
+	return batch
+}
+
+// dial connects to 'peer' and adds it to the pool. Returns whether the peer
+// was connected.
+func (p *PeerPool) dial(peer TrackerPeer) bool {
+	client, err := NewTCPClientWithOptions(string(p.infoHash[:]), peer, p.PeerId, p.Info.NumPieces(), p.Dial)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dialing--
+
+	if err != nil {
+		delete(p.known, peer.String())
+
+		if errors.Is(err, ErrInfoHashMismatch) || errors.Is(err, ErrPeerIdMismatch) {
+			p.banned[peer.String()] = true
+		}
+
+		return false
+	}
+
+	client.Info = p.Info
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client.StartKeepAlive(ctx, KEEP_ALIVE_INTERVAL)
+
+	p.clients = append(p.clients, client)
+	p.cancels[client] = cancel
+
+	return true
+}
+
+// Clients returns the currently connected clients.
+func (p *PeerPool) Clients() []*TCPClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return slices.Clone(p.clients)
+}
+
+// Len returns the number of currently connected clients.
+func (p *PeerPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.clients)
+}
+
+// Retire closes the connection of 'client' and removes it from the pool, freeing
+// its slot for a peer from the backlog on the next call to Fill. The peer may be
+// added again later.
+func (p *PeerPool) Retire(client *TCPClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.retire(client)
+}
+
+// retire removes 'client' from the pool. The lock must be held.
+func (p *PeerPool) retire(client *TCPClient) {
+	idx := slices.Index(p.clients, client)
+	if idx < 0 {
+		return
+	}
+
+	p.clients = slices.Delete(p.clients, idx, idx+1)
+	delete(p.known, client.Peer.String())
+
+	p.cancels[client]()
+	delete(p.cancels, client)
+
+	client.Close()
+}
+
+// Close closes every connection in the pool and clears the backlog.
+func (p *PeerPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, client := range slices.Clone(p.clients) {
+		p.retire(client)
+	}
+
+	for _, peer := range p.backlog {
+		delete(p.known, peer.String())
+	}
+
+	p.backlog = nil
+}
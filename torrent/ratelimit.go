@@ -0,0 +1,195 @@
+/* Bandwidth limiting for peer connections. */
+
+package torrent
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	minLimiterBurst = 16 * 1024            // Smallest amount of bytes a peer bucket can hold (one block).
+	minLimiterWait  = 5 * time.Millisecond // Shortest time to sleep while waiting for tokens.
+)
+
+// A BandwidthLimiter is a hierarchical token bucket that caps the total rate
+// of all peers (the global limit) as well as the rate of each individual peer.
+//
+// Tokens earned by the global bucket are shared fairly between peers: on each
+// refill they are split evenly between every peer with room in its bucket and
+// whatever a full peer cannot take is handed to the others. This prevents a
+// single fast peer from monopolizing the budget.
+type BandwidthLimiter struct {
+	mu sync.Mutex
+
+	globalRate float64 // Bytes per second for all peers. Zero means unlimited.
+	peerRate   float64 // Bytes per second for each peer. Zero means unlimited.
+
+	peers      map[*PeerLimiter]struct{}
+	lastRefill time.Time
+}
+
+// A PeerLimiter represents the bucket of a single peer within a BandwidthLimiter.
+type PeerLimiter struct {
+	parent *BandwidthLimiter
+	tokens float64
+}
+
+// NewBandwidthLimiter creates a limiter capping all peers to 'globalRate' bytes
+// per second and each peer to 'peerRate' bytes per second. A rate of zero or
+// less means that the corresponding limit is not enforced.
+func NewBandwidthLimiter(globalRate, peerRate int) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		globalRate: float64(max(globalRate, 0)),
+		peerRate:   float64(max(peerRate, 0)),
+		peers:      map[*PeerLimiter]struct{}{},
+		lastRefill: time.Now(),
+	}
+}
+
+// NewPeer registers a new peer with the limiter and returns its bucket.
+//
+// The peer must be removed with PeerLimiter.Close once its connection ends so
+// that it no longer receives a share of the global budget.
+func (b *BandwidthLimiter) NewPeer() *PeerLimiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+
+	peer := &PeerLimiter{parent: b}
+	b.peers[peer] = struct{}{}
+
+	return peer
+}
+
+// shareRate returns the rate each peer is expected to receive. The caller must hold the lock.
+func (b *BandwidthLimiter) shareRate() float64 {
+	share := b.peerRate
+
+	if b.globalRate > 0 && len(b.peers) > 0 {
+		globalShare := b.globalRate / float64(len(b.peers))
+		if share <= 0 || globalShare < share {
+			share = globalShare
+		}
+	}
+
+	return share
+}
+
+// capacity returns the maximum amount of tokens a peer bucket can hold. The caller must hold the lock.
+func (b *BandwidthLimiter) capacity() float64 {
+	return max(b.shareRate(), minLimiterBurst)
+}
+
+// refill distributes the tokens earned since the last refill between the peer
+// buckets. The caller must hold the lock.
+func (b *BandwidthLimiter) refill(now time.Time) {
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	b.lastRefill = now
+
+	if elapsed <= 0 || len(b.peers) == 0 {
+		return
+	}
+
+	capacity := b.capacity()
+
+	// The amount of tokens each peer may still take in this refill.
+	var room []peerRoom
+	for peer := range b.peers {
+		available := capacity - peer.tokens
+		if b.peerRate > 0 {
+			available = min(available, b.peerRate*elapsed)
+		}
+
+		if available > 0 {
+			room = append(room, peerRoom{peer, available})
+		}
+	}
+
+	if b.globalRate <= 0 {
+		for _, entry := range room {
+			entry.peer.tokens += entry.available
+		}
+		return
+	}
+
+	// Peers with the least room are served first, so that whatever they cannot
+	// take is split between the peers after them.
+	slices.SortFunc(room, func(a, b peerRoom) int {
+		return cmp.Compare(a.available, b.available)
+	})
+
+	pool := b.globalRate * elapsed
+	for idx, entry := range room {
+		taken := min(pool/float64(len(room)-idx), entry.available)
+
+		entry.peer.tokens += taken
+		pool -= taken
+	}
+}
+
+// A peerRoom represents the amount of tokens a peer may take in a refill.
+type peerRoom struct {
+	peer      *PeerLimiter
+	available float64
+}
+
+// WaitN blocks until the peer is allowed to transfer 'n' bytes and consumes
+// the corresponding tokens.
+//
+// Requests larger than the bucket capacity are allowed once the bucket is full
+// and leave the bucket in debt, which is repaid by later refills.
+func (p *PeerLimiter) WaitN(n int) {
+	p.WaitNContext(context.Background(), n)
+}
+
+// WaitNContext is like WaitN but stops waiting once 'ctx' is done, in which case
+// no tokens are consumed and the error of the context is returned.
+func (p *PeerLimiter) WaitNContext(ctx context.Context, n int) error {
+	parent := p.parent
+
+	for {
+		parent.mu.Lock()
+
+		// A closed peer earns no tokens and has no share of the budget to wait
+		// for, so it is no longer limited.
+		if _, ok := parent.peers[p]; !ok || parent.globalRate <= 0 && parent.peerRate <= 0 {
+			parent.mu.Unlock()
+			return nil
+		}
+
+		parent.refill(time.Now())
+
+		needed := min(float64(n), parent.capacity())
+		if p.tokens >= needed {
+			p.tokens -= float64(n)
+			parent.mu.Unlock()
+			return nil
+		}
+
+		wait := time.Duration((needed - p.tokens) / parent.shareRate() * float64(time.Second))
+		parent.mu.Unlock()
+
+		timer := time.NewTimer(max(wait, minLimiterWait))
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Close removes the peer from its limiter. Waiting on a closed peer returns at
+// once.
+func (p *PeerLimiter) Close() {
+	p.parent.mu.Lock()
+	defer p.parent.mu.Unlock()
+
+	delete(p.parent.peers, p)
+}
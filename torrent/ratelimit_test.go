@@ -0,0 +1,128 @@
+package torrent
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// drainLimiter has 'numPeers' peers of 'limiter' transfer blocks for 'duration'
+// and returns the amount of bytes each of them was allowed to transfer.
+func drainLimiter(limiter *BandwidthLimiter, numPeers int, duration time.Duration) []int {
+	const blockSize = 4096
+
+	transferred := make([]int, numPeers)
+	deadline := time.Now().Add(duration)
+
+	var wg sync.WaitGroup
+	for idx := range numPeers {
+		peer := limiter.NewPeer()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer peer.Close()
+
+			for time.Now().Before(deadline) {
+				peer.WaitN(blockSize)
+				transferred[idx] += blockSize
+			}
+		}()
+	}
+
+	wg.Wait()
+	return transferred
+}
+
+func TestBandwidthLimiterGlobalCap(t *testing.T) {
+	const (
+		globalRate = 256 * 1024
+		numPeers   = 4
+		duration   = time.Second
+	)
+
+	transferred := drainLimiter(NewBandwidthLimiter(globalRate, 0), numPeers, duration)
+
+	var total int
+	for _, amount := range transferred {
+		total += amount
+	}
+
+	// Each peer may overshoot by its last block and the burst of its bucket.
+	if limit := globalRate*duration.Seconds() + numPeers*(minLimiterBurst+4096); float64(total) > limit {
+		t.Errorf("peers transferred %d bytes in %s, above the global cap of %.0f", total, duration, limit)
+	}
+
+	if total < globalRate/2 {
+		t.Errorf("peers transferred only %d bytes in %s", total, duration)
+	}
+
+	mean := total / numPeers
+	for idx, amount := range transferred {
+		if amount < mean/2 || amount > mean*3/2 {
+			t.Errorf("peer %d transferred %d bytes, far from the fair share of %d (all: %v)", idx, amount, mean, transferred)
+		}
+	}
+}
+
+func TestBandwidthLimiterPeerCap(t *testing.T) {
+	const (
+		peerRate = 64 * 1024
+		duration = 500 * time.Millisecond
+	)
+
+	transferred := drainLimiter(NewBandwidthLimiter(0, peerRate), 2, duration)
+
+	for idx, amount := range transferred {
+		if limit := peerRate*duration.Seconds() + minLimiterBurst + 4096; float64(amount) > limit {
+			t.Errorf("peer %d transferred %d bytes in %s, above its cap of %.0f", idx, amount, duration, limit)
+		}
+	}
+}
+
+func TestBandwidthLimiterUnlimited(t *testing.T) {
+	peer := NewBandwidthLimiter(0, 0).NewPeer()
+	defer peer.Close()
+
+	start := time.Now()
+	for range 1000 {
+		peer.WaitN(1 << 20)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("an unlimited limiter waited for %s", elapsed)
+	}
+}
+
+func TestBandwidthLimiterClosedPeer(t *testing.T) {
+	limiters := map[string]*BandwidthLimiter{
+		"global":   NewBandwidthLimiter(64*1024, 0),
+		"per peer": NewBandwidthLimiter(0, 64*1024),
+	}
+
+	for name, limiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			// Another peer keeps the limiter busy.
+			other := limiter.NewPeer()
+			defer other.Close()
+
+			peer := limiter.NewPeer()
+			peer.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			if err := peer.WaitNContext(ctx, 1<<20); err != nil {
+				t.Errorf("waiting on a closed peer returned %v", err)
+			}
+
+			// With the last peer gone, no share of the global budget is left.
+			other.Close()
+
+			if err := other.WaitNContext(ctx, 1<<20); err != nil {
+				t.Errorf("waiting on the last closed peer returned %v", err)
+			}
+		})
+	}
+}
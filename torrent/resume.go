@@ -0,0 +1,106 @@
+/* Persistence of download progress so that downloads may be resumed. */
+
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aescarias/apricot/torrent/bencode"
+)
+
+// ErrResumeMismatch is returned when a resume state does not belong to the
+// torrent being downloaded.
+var ErrResumeMismatch = errors.New("resume state does not match torrent")
+
+// A ResumeState records the progress of a download: the pieces that have been
+// verified and written, and the number of bytes they hold.
+type ResumeState struct {
+	InfoHash   [20]byte // The info hash of the torrent.
+	Pieces     BitField // The pieces verified and written.
+	Downloaded int64    // The number of bytes verified and written.
+}
+
+// resumeFile represents the bencoded contents of a resume file.
+type resumeFile struct {
+	InfoHash   [20]byte `bencode:"info hash"`
+	Pieces     []byte   `bencode:"pieces"` // The bit field, as encoded by BitField.MarshalBinary.
+	Downloaded int64    `bencode:"downloaded"`
+}
+
+// NewResumeState returns an empty resume state for the torrent described by 'info'.
+func NewResumeState(info *Info) (*ResumeState, error) {
+	infoHash, err := info.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("could not get info hash: %w", err)
+	}
+
+	return &ResumeState{InfoHash: infoHash, Pieces: NewBitField(info.NumPieces())}, nil
+}
+
+// Check returns ErrResumeMismatch if the state does not belong to the torrent
+// identified by 'infoHash' with 'pieces' pieces.
+func (r *ResumeState) Check(infoHash [20]byte, pieces int) error {
+	if r.InfoHash != infoHash {
+		return fmt.Errorf("%w: info hash is %x, expected %x", ErrResumeMismatch, r.InfoHash, infoHash)
+	}
+
+	if r.Pieces.Length != pieces {
+		return fmt.Errorf("%w: state has %d pieces, expected %d", ErrResumeMismatch, r.Pieces.Length, pieces)
+	}
+
+	return nil
+}
+
+// Save writes the resume state to the file at 'path'. Returns an error if any.
+func (r *ResumeState) Save(path string) error {
+	pieces, err := r.Pieces.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("could not encode pieces: %w", err)
+	}
+
+	encoded, err := bencode.Marshal(resumeFile{
+		InfoHash:   r.InfoHash,
+		Pieces:     pieces,
+		Downloaded: r.Downloaded,
+	})
+	if err != nil {
+		return fmt.Errorf("could not encode resume state: %w", err)
+	}
+
+	return os.WriteFile(path, encoded, 0o644)
+}
+
+// LoadResumeState restores a resume state previously written by Save from the
+// file at 'path'. Returns the state or an error if any.
+//
+// The state is checked against 'info' and ErrResumeMismatch is returned if it
+// belongs to a different torrent.
+func LoadResumeState(path string, info *Info) (*ResumeState, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file resumeFile
+	if err := bencode.Unmarshal(contents, &file); err != nil {
+		return nil, fmt.Errorf("could not decode resume state: %w", err)
+	}
+
+	state := &ResumeState{InfoHash: file.InfoHash, Downloaded: file.Downloaded}
+	if err := state.Pieces.UnmarshalBinary(file.Pieces); err != nil {
+		return nil, fmt.Errorf("could not decode pieces: %w", err)
+	}
+
+	infoHash, err := info.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("could not get info hash: %w", err)
+	}
+
+	if err := state.Check(infoHash, info.NumPieces()); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
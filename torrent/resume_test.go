@@ -0,0 +1,298 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/aescarias/apricot/torrent/bencode"
+)
+
+// memoryOutput is an io.WriterAt holding the written contents in memory.
+type memoryOutput struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (m *memoryOutput) WriteAt(p []byte, offset int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return copy(m.data[offset:], p), nil
+}
+
+// newResumeContents returns 'size' bytes of test contents derived from 'seed'.
+func newResumeContents(size int, seed byte) []byte {
+	contents := make([]byte, size)
+	for idx := range contents {
+		contents[idx] = byte(idx*7) + seed
+	}
+
+	return contents
+}
+
+// serveSeeder serves 'contents' as the torrent described by 'info' to a single
+// peer and returns the address of the seeder. The index of every piece requested
+// by the peer is sent to 'requests'.
+func serveSeeder(t *testing.T, info *Info, contents []byte, requests chan<- int) TrackerPeer {
+	t.Helper()
+
+	listener, err := Listen("127.0.0.1:0", "-AP0000-000000000002")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	if err := listener.Serve(info); err != nil {
+		t.Fatalf("could not serve torrent: %v", err)
+	}
+
+	go func() {
+		client, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+
+		field := NewBitField(info.NumPieces())
+		for index := range info.NumPieces() {
+			field.SetPiece(index)
+		}
+
+		if err := client.SendMessage(Message{Id: MessageBitfield, BitField: field}); err != nil {
+			return
+		}
+
+		if err := client.SendMessage(Message{Id: MessageUnchoke}); err != nil {
+			return
+		}
+
+		for {
+			message, err := client.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			if message.KeepAlive || message.Id != MessageRequest {
+				continue
+			}
+
+			if message.Request.Begin == 0 {
+				requests <- int(message.Request.Index)
+			}
+
+			if err := client.ServeRequest(message.Request, bytes.NewReader(contents)); err != nil {
+				return
+			}
+		}
+	}()
+
+	return TrackerPeer{Ip: "127.0.0.1", Port: listener.Port()}
+}
+
+func TestResumeStateRoundTrip(t *testing.T) {
+	info := newTestInfo(newResumeContents(4*1024+100, 0), 1024)
+
+	state, err := NewResumeState(info)
+	if err != nil {
+		t.Fatalf("could not create resume state: %v", err)
+	}
+
+	state.Pieces.SetPiece(1)
+	state.Pieces.SetPiece(4)
+	state.Downloaded = 1024 + 100
+
+	path := filepath.Join(t.TempDir(), "data.resume")
+	if err := state.Save(path); err != nil {
+		t.Fatalf("could not save resume state: %v", err)
+	}
+
+	loaded, err := LoadResumeState(path, info)
+	if err != nil {
+		t.Fatalf("could not load resume state: %v", err)
+	}
+
+	if !reflect.DeepEqual(loaded, state) {
+		t.Errorf("LoadResumeState returned %+v, expected %+v", loaded, state)
+	}
+}
+
+func TestLoadResumeStateMismatch(t *testing.T) {
+	info := newTestInfo(newResumeContents(4*1024+100, 0), 1024)
+
+	infoHash, err := info.Hash()
+	if err != nil {
+		t.Fatalf("could not get info hash: %v", err)
+	}
+
+	other, err := NewResumeState(newTestInfo(newResumeContents(4*1024+100, 1), 1024))
+	if err != nil {
+		t.Fatalf("could not create resume state: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		state *ResumeState
+	}{
+		{"info hash", other},
+		{"piece count", &ResumeState{InfoHash: infoHash, Pieces: NewBitField(info.NumPieces() + 1)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "data.resume")
+			if err := test.state.Save(path); err != nil {
+				t.Fatalf("could not save resume state: %v", err)
+			}
+
+			state, err := LoadResumeState(path, info)
+			if !errors.Is(err, ErrResumeMismatch) {
+				t.Errorf("LoadResumeState returned %+v, %v, expected ErrResumeMismatch", state, err)
+			}
+		})
+	}
+}
+
+func TestLoadResumeStateCorruptPieces(t *testing.T) {
+	info := newTestInfo(newResumeContents(4*1024+100, 0), 1024)
+
+	infoHash, err := info.Hash()
+	if err != nil {
+		t.Fatalf("could not get info hash: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		pieces []byte
+	}{
+		{"truncated", []byte{0x00, 0x05}},
+		{"short", []byte{0x00, 0x00, 0x00, 0x05}},
+		{"dirty padding", []byte{0x00, 0x00, 0x00, 0x05, 0x04}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := bencode.Marshal(resumeFile{InfoHash: infoHash, Pieces: test.pieces})
+			if err != nil {
+				t.Fatalf("could not encode resume file: %v", err)
+			}
+
+			path := filepath.Join(t.TempDir(), "data.resume")
+			if err := os.WriteFile(path, encoded, 0o644); err != nil {
+				t.Fatalf("could not write resume file: %v", err)
+			}
+
+			state, err := LoadResumeState(path, info)
+			if err == nil || errors.Is(err, ErrResumeMismatch) {
+				t.Errorf("LoadResumeState returned %+v, %v, expected a decoding error", state, err)
+			}
+		})
+	}
+}
+
+func TestDownloadSkipsResumedPieces(t *testing.T) {
+	contents := newResumeContents(4*1024+100, 0)
+	info := newTestInfo(contents, 1024)
+
+	requests := make(chan int, info.NumPieces())
+	peer := serveSeeder(t, info, contents, requests)
+
+	output := &memoryOutput{data: make([]byte, len(contents))}
+
+	download, err := NewDownload(info, []TrackerPeer{peer}, output, "-AP0000-000000000001")
+	if err != nil {
+		t.Fatalf("could not create download: %v", err)
+	}
+
+	download.Resume, err = NewResumeState(info)
+	if err != nil {
+		t.Fatalf("could not create resume state: %v", err)
+	}
+
+	download.Resume.Pieces.SetPiece(0)
+	download.Resume.Pieces.SetPiece(2)
+	download.Resume.Downloaded = 2 * 1024
+
+	if err := download.Run(); err != nil {
+		t.Fatalf("could not download: %v", err)
+	}
+
+	close(requests)
+
+	var requested []int
+	for index := range requests {
+		requested = append(requested, index)
+	}
+	slices.Sort(requested)
+
+	if !slices.Equal(requested, []int{1, 3, 4}) {
+		t.Errorf("requested pieces %v, expected [1 3 4]", requested)
+	}
+
+	for index := range info.NumPieces() {
+		start := index * 1024
+		end := min(start+1024, len(contents))
+
+		expected := contents[start:end]
+		if index == 0 || index == 2 {
+			expected = make([]byte, end-start)
+		}
+
+		if !bytes.Equal(output.data[start:end], expected) {
+			t.Errorf("piece %d was not written as expected", index)
+		}
+	}
+
+	if !download.Resume.Pieces.Complete() {
+		t.Errorf("resume state is missing pieces: %x", download.Resume.Pieces.Field)
+	}
+
+	if download.Resume.Downloaded != int64(len(contents)) {
+		t.Errorf("resume state has %d bytes downloaded, expected %d", download.Resume.Downloaded, len(contents))
+	}
+}
+
+func TestDownloadResumeComplete(t *testing.T) {
+	info := newTestInfo(newResumeContents(4*1024+100, 0), 1024)
+
+	download, err := NewDownload(info, nil, &memoryOutput{}, "-AP0000-000000000001")
+	if err != nil {
+		t.Fatalf("could not create download: %v", err)
+	}
+
+	download.Resume, err = NewResumeState(info)
+	if err != nil {
+		t.Fatalf("could not create resume state: %v", err)
+	}
+
+	for index := range info.NumPieces() {
+		download.Resume.Pieces.SetPiece(index)
+	}
+
+	if err := download.Run(); err != nil {
+		t.Errorf("Run returned %v for a completed download", err)
+	}
+}
+
+func TestDownloadResumeMismatch(t *testing.T) {
+	info := newTestInfo(newResumeContents(4*1024+100, 0), 1024)
+
+	download, err := NewDownload(info, nil, &memoryOutput{}, "-AP0000-000000000001")
+	if err != nil {
+		t.Fatalf("could not create download: %v", err)
+	}
+
+	download.Resume, err = NewResumeState(newTestInfo(newResumeContents(4*1024+100, 1), 1024))
+	if err != nil {
+		t.Fatalf("could not create resume state: %v", err)
+	}
+
+	if err := download.Run(); !errors.Is(err, ErrResumeMismatch) {
+		t.Errorf("Run returned %v, expected ErrResumeMismatch", err)
+	}
+}
@@ -0,0 +1,103 @@
+/* Retrying of failed tracker requests with exponential backoff. */
+
+package torrent
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	RETRY_ATTEMPTS   = 3                // The default number of attempts of a tracker request.
+	RETRY_BASE_DELAY = 1 * time.Second  // The default delay before the first retry.
+	RETRY_MAX_DELAY  = 30 * time.Second // The longest delay between two attempts.
+)
+
+// A RetryPolicy controls how tracker requests failing with transient errors are
+// retried: timeouts, refused or reset connections and 5xx responses from HTTP
+// trackers. Permanent errors, such as failure reasons sent by trackers, unknown
+// hosts or invalid certificates, are never retried. Neither are requests to UDP
+// trackers, which retransmit on their own as described in BEP 15.
+//
+// The delay before each retry doubles from BaseDelay, up to RETRY_MAX_DELAY, and
+// a random jitter of up to half the delay is subtracted from it so that clients
+// do not retry in lockstep.
+type RetryPolicy struct {
+	// The maximum number of attempts, including the first. Defaults to RETRY_ATTEMPTS.
+	MaxAttempts int
+	// The delay before the first retry. Defaults to RETRY_BASE_DELAY.
+	BaseDelay time.Duration
+}
+
+// delay returns the time to wait before the retry following 'attempt' attempts.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	if delay <= 0 {
+		delay = RETRY_BASE_DELAY
+	}
+
+	for range attempt - 1 {
+		delay *= 2
+		if delay >= RETRY_MAX_DELAY {
+			delay = RETRY_MAX_DELAY
+			break
+		}
+	}
+
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryable reports whether a tracker request failing with 'err' may succeed if
+// attempted again.
+func retryable(err error) bool {
+	var httpErr *TrackerHTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retry calls 'request' until it succeeds, fails with an error that is not
+// retryable or the attempts allowed by 'policy' run out. If 'policy' is nil,
+// 'request' is called once. Waiting between attempts stops once 'ctx' is done,
+// in which case the error of the context is returned. Retries are logged to
+// 'logger'.
+func retry(ctx context.Context, policy *RetryPolicy, logger Logger, request func() (*TrackerResponse, error)) (*TrackerResponse, error) {
+	if policy == nil {
+		return request()
+	}
+
+	attempts := policy.MaxAttempts
+	if attempts <= 0 {
+		attempts = RETRY_ATTEMPTS
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := request()
+		if err == nil || attempt >= attempts || !retryable(err) || ctx.Err() != nil {
+			return resp, err
+		}
+
+		delay := policy.delay(attempt)
+		logger.Warn("retrying tracker request", "attempt", attempt, "delay", delay, "error", err)
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package torrent
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	urlError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://tracker.example.com/announce", Err: err}
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"timeout", urlError(os.ErrDeadlineExceeded), true},
+		{"connection refused", urlError(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), true},
+		{"connection reset", urlError(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), true},
+		{"server error", &TrackerHTTPError{StatusCode: 503}, true},
+		{"not found", &TrackerHTTPError{StatusCode: 404}, false},
+		{"unknown host", urlError(&net.DNSError{Err: "no such host", Name: "tracker.example.com", IsNotFound: true}), false},
+		{"invalid certificate", urlError(&x509.UnknownAuthorityError{}), false},
+		{"malformed url", urlError(errors.New("unsupported protocol scheme")), false},
+		{"failure reason", &ErrFailureReason{Message: "unregistered torrent"}, false},
+	}
+
+	for _, test := range tests {
+		if retryable(test.err) != test.retryable {
+			t.Errorf("%s: retryable returned %t for %v", test.name, !test.retryable, test.err)
+		}
+	}
+}
+
+func TestGetPeersRetry(t *testing.T) {
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1, 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("d8:intervali1800e5:peers0:e"))
+		}
+	}))
+	defer server.Close()
+
+	torrent := &Torrent{
+		AnnounceURL: server.URL + "/announce",
+		Retry:       &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+	}
+
+	if _, err := torrent.GetPeers(TrackerRequest{}); err != nil {
+		t.Fatalf("could not get peers after retrying: %v", err)
+	}
+
+	if count := requests.Load(); count != 3 {
+		t.Errorf("tracker received %d requests, expected 3", count)
+	}
+}
+
+// countingLogger counts the warnings logged.
+type countingLogger struct {
+	nopLogger
+	warnings atomic.Int32
+}
+
+func (l *countingLogger) Warn(msg string, args ...any) {
+	l.warnings.Add(1)
+}
+
+func TestGetPeersUDPNotRetried(t *testing.T) {
+	// A port that was just released has nothing listening on it, so the
+	// connect request is refused.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	dead := "udp://" + conn.LocalAddr().String() + "/announce"
+	conn.Close()
+
+	logger := &countingLogger{}
+	torrent := &Torrent{
+		AnnounceURL: dead,
+		Retry:       &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+		Logger:      logger,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	if _, err := torrent.GetPeersContext(ctx, TrackerRequest{PeerId: "-AP0000-000000000000"}); err == nil {
+		t.Fatalf("announced to a closed port")
+	}
+
+	if count := logger.warnings.Load(); count != 0 {
+		t.Errorf("the UDP request was retried %d times", count)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Torrent implementation dealing with tracker scrapes.
+
+See https://bittorrent.org/beps/bep_0048.html
+*/
+
+package torrent
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// A ScrapeResponse represents the statistics a tracker reports for a torrent.
+type ScrapeResponse struct {
+	Complete   int // The number of peers with the entire file (seeders).
+	Incomplete int // The number of peers still downloading (leechers).
+	Downloaded int // The number of times the tracker registered a completed download.
+}
+
+// ScrapeURL derives the scrape URL of a tracker from its 'announceURL'.
+//
+// By convention, the scrape URL is obtained by replacing the text 'announce'
+// that immediately follows the last '/' of the path with 'scrape'. Returns an
+// error if the announce URL does not follow this convention.
+func ScrapeURL(announceURL string) (string, error) {
+	announce, err := url.Parse(announceURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse url: %w", err)
+	}
+
+	slash := strings.LastIndex(announce.Path, "/")
+	if slash < 0 || !strings.HasPrefix(announce.Path[slash+1:], "announce") {
+		return "", fmt.Errorf("tracker %q does not support scraping", announceURL)
+	}
+
+	announce.Path = announce.Path[:slash+1] + "scrape" + announce.Path[slash+1+len("announce"):]
+	announce.RawPath = ""
+
+	return announce.String(), nil
+}
+
+// Scrape requests the statistics of the torrent identified by 'infoHash' from
+// the tracker at the announce URL. Returns the statistics or an error if any.
+//
+// Only HTTP and HTTPS trackers are supported.
+func (t *Torrent) Scrape(infoHash [20]byte) (*ScrapeResponse, error) {
+	scrapeURL, err := ScrapeURL(t.AnnounceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	scrape, err := url.Parse(scrapeURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse url: %w", err)
+	}
+
+	if scrape.Scheme != "http" && scrape.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme: %s", scrape.Scheme)
+	}
+
+	query := scrape.Query()
+	query.Set("info_hash", string(infoHash[:]))
+	scrape.RawQuery = encodeQuery(query)
+
+	resp, err := t.httpClient().Get(scrape.String())
+	if err != nil {
+		return nil, fmt.Errorf("request to tracker failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, newTrackerHTTPError(resp)
+	}
+
+	token, err := decodeTrackerBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	response, ok := token.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response type: %v", token)
+	}
+
+	if failure, ok := response["failure reason"].(string); ok {
+		return nil, &ErrFailureReason{Message: failure}
+	}
+
+	files, ok := response["files"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("scrape response has no files dictionary")
+	}
+
+	stats, ok := files[string(infoHash[:])].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("scrape response has no entry for info hash %x", infoHash)
+	}
+
+	complete, _ := stats["complete"].(int64)
+	incomplete, _ := stats["incomplete"].(int64)
+	downloaded, _ := stats["downloaded"].(int64)
+
+	return &ScrapeResponse{
+		Complete:   int(complete),
+		Incomplete: int(incomplete),
+		Downloaded: int(downloaded),
+	}, nil
+}
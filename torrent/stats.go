@@ -0,0 +1,63 @@
+/* Transfer statistics of peer connections and downloads. */
+
+package torrent
+
+import "sync/atomic"
+
+// A Stats is a snapshot of the transfer counters of a peer connection or of a
+// download. Byte counts only include the payloads of piece messages.
+type Stats struct {
+	Downloaded      int64 // The number of block bytes received.
+	Uploaded        int64 // The number of block bytes sent.
+	PiecesCompleted int64 // The number of pieces downloaded and verified.
+	PiecesFailed    int64 // The number of pieces that failed hash verification.
+	Peers           int   // The number of connected peers, for a download.
+}
+
+// counters holds the transfer counters behind a Stats. They are updated
+// atomically, so a snapshot may be taken while transfers are in progress.
+type counters struct {
+	downloaded      atomic.Int64
+	uploaded        atomic.Int64
+	piecesCompleted atomic.Int64
+	piecesFailed    atomic.Int64
+}
+
+// snapshot returns the current values of the counters.
+func (c *counters) snapshot() Stats {
+	return Stats{
+		Downloaded:      c.downloaded.Load(),
+		Uploaded:        c.uploaded.Load(),
+		PiecesCompleted: c.piecesCompleted.Load(),
+		PiecesFailed:    c.piecesFailed.Load(),
+	}
+}
+
+// Stats returns a snapshot of the transfer counters of the connection. It may be
+// called while messages are being exchanged.
+func (c *TCPClient) Stats() Stats {
+	return c.counters.snapshot()
+}
+
+// count applies 'update' to the counters of the connection and to those of the
+// download it belongs to, if any.
+func (c *TCPClient) count(update func(counters *counters)) {
+	update(&c.counters)
+
+	if c.parentCounters != nil {
+		update(c.parentCounters)
+	}
+}
+
+// Stats returns a snapshot of the transfer counters of the download, summed over
+// every peer connection, along with the number of connected peers. It may be
+// called while the download is running.
+func (d *Download) Stats() Stats {
+	stats := d.counters.snapshot()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats.Peers = len(d.seeders)
+	return stats
+}
@@ -0,0 +1,213 @@
+/* Storage of torrent contents in files on disk. */
+
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A Storage maps the concatenated contents of a torrent onto its files within a
+// directory on disk.
+//
+// Single file torrents are stored in a file named after the torrent. Multiple
+// file torrents are stored in a directory named after the torrent, with each file
+// at its path within it. UTF-8 names and paths are used when the torrent provides
+// them. Files and directories are created as they are first written to, and files
+// are preallocated to their full length.
+//
+// A Storage may be used as the Output of a Download.
+type Storage struct {
+	Info *Info  // The info of the torrent being stored.
+	Dir  string // The directory holding the contents of the torrent.
+
+	mu     sync.Mutex
+	ranges []FileRange
+	paths  []string
+	files  []*os.File
+}
+
+// NewStorage creates a storage for the torrent described by 'info' within the
+// directory 'dir'. Returns an error if the name of the torrent or the path of a
+// file is unsafe, such as one containing '..' components.
+func NewStorage(info *Info, dir string) (*Storage, error) {
+	name := info.PreferredName()
+	if err := validatePathComponent(name); err != nil {
+		return nil, fmt.Errorf("invalid torrent name: %w", err)
+	}
+
+	ranges := info.FileRanges()
+	paths := make([]string, len(ranges))
+
+	for idx, fileRange := range ranges {
+		if len(info.Files) == 0 {
+			paths[idx] = filepath.Join(dir, name)
+			continue
+		}
+
+		path := fileRange.File.PreferredPath()
+		if len(path) == 0 {
+			return nil, fmt.Errorf("file %d has an empty path", idx)
+		}
+
+		for _, part := range path {
+			if err := validatePathComponent(part); err != nil {
+				return nil, fmt.Errorf("invalid path of file %d: %w", idx, err)
+			}
+		}
+
+		paths[idx] = filepath.Join(append([]string{dir, name}, path...)...)
+	}
+
+	return &Storage{
+		Info:   info,
+		Dir:    dir,
+		ranges: ranges,
+		paths:  paths,
+		files:  make([]*os.File, len(ranges)),
+	}, nil
+}
+
+// validatePathComponent returns an error if 'part' cannot be safely used as a
+// single component of a path on disk.
+func validatePathComponent(part string) error {
+	switch {
+	case len(part) == 0:
+		return fmt.Errorf("empty path component")
+	case part == "." || part == "..":
+		return fmt.Errorf("path component %q is not allowed", part)
+	case strings.ContainsAny(part, "/\\\x00"):
+		return fmt.Errorf("path component %q contains a separator", part)
+	case filepath.VolumeName(part) != "":
+		return fmt.Errorf("path component %q contains a volume name", part)
+	}
+
+	return nil
+}
+
+// file returns the open file at index 'index', creating its directory and
+// preallocating it if it is opened for the first time.
+func (s *Storage) file(index int) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.files[index] != nil {
+		return s.files[index], nil
+	}
+
+	path := s.paths[index]
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("could not create directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %w", err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not stat file: %w", err)
+	}
+
+	if stat.Size() != s.ranges[index].Length {
+		if err := file.Truncate(s.ranges[index].Length); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("could not preallocate file: %w", err)
+		}
+	}
+
+	s.files[index] = file
+	return file, nil
+}
+
+// forEachFile calls 'fn' for each part of the file contents covering the
+// 'length' bytes of the torrent starting at 'off', with the index of the file,
+// the offset within the file and the offset within the span.
+func (s *Storage) forEachFile(off int64, length int64, fn func(index int, fileOff int64, spanOff int64, size int64) error) error {
+	if off < 0 || off+length > s.Info.TotalLength() {
+		return fmt.Errorf("range [%d, %d) is outside of the torrent contents", off, off+length)
+	}
+
+	for idx, fileRange := range s.ranges {
+		start := max(off, fileRange.Offset)
+		end := min(off+length, fileRange.Offset+fileRange.Length)
+
+		if start >= end {
+			continue
+		}
+
+		if err := fn(idx, start-fileRange.Offset, start-off, end-start); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteAt writes 'p' at offset 'off' of the torrent contents, splitting the write
+// across the files it spans. Returns the number of bytes written and an error if
+// any. Writes past the end of the torrent contents are rejected.
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	written := 0
+
+	err := s.forEachFile(off, int64(len(p)), func(index int, fileOff int64, spanOff int64, size int64) error {
+		file, err := s.file(index)
+		if err != nil {
+			return err
+		}
+
+		n, err := file.WriteAt(p[spanOff:spanOff+size], fileOff)
+		written += n
+
+		return err
+	})
+
+	return written, err
+}
+
+// ReadAt reads len(p) bytes at offset 'off' of the torrent contents, reading from
+// the files the range spans. Returns the number of bytes read and an error if any.
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+
+	err := s.forEachFile(off, int64(len(p)), func(index int, fileOff int64, spanOff int64, size int64) error {
+		file, err := s.file(index)
+		if err != nil {
+			return err
+		}
+
+		n, err := file.ReadAt(p[spanOff:spanOff+size], fileOff)
+		read += n
+
+		if errors.Is(err, io.EOF) && int64(n) == size {
+			return nil
+		}
+
+		return err
+	})
+
+	return read, err
+}
+
+// Close closes every file opened by the storage.
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for idx, file := range s.files {
+		if file != nil {
+			errs = append(errs, file.Close())
+			s.files[idx] = nil
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -5,9 +5,35 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The default time allowed for each read from a peer. Peers send keep alive
+// messages every two minutes, so a peer silent for longer is considered gone.
+const READ_TIMEOUT = 2 * time.Minute
+
+// The default interval between keep alive messages sent to a peer.
+const KEEP_ALIVE_INTERVAL = 1 * time.Minute
+
+// The largest message accepted from a peer, excluding its length prefix: a piece
+// message carrying a block of MAX_REQUEST_LENGTH bytes after its ID, index and
+// offset. Bitfield messages may be longer if the torrent has enough pieces.
+const MAX_MESSAGE_LENGTH = 1 + 8 + MAX_REQUEST_LENGTH
+
+var (
+	// ErrInfoHashMismatch is returned when a peer answers a handshake with an info
+	// hash other than the one requested. The peer does not serve the torrent.
+	ErrInfoHashMismatch = errors.New("info hash mismatch")
+	// ErrPeerIdMismatch is returned when a peer answers a handshake with a peer ID
+	// other than the one reported by the tracker.
+	ErrPeerIdMismatch = errors.New("peer id mismatch")
 )
 
 // A TCPClient represents a peer connection over TCP.
@@ -19,6 +45,54 @@ type TCPClient struct {
 	Peer       TrackerPeer
 	PeerId     string
 	Pieces     int
+
+	// The info of the torrent being exchanged, used to verify downloaded pieces.
+	Info *Info
+
+	// If set, limits the rate at which messages are read from the peer.
+	DownloadLimiter *PeerLimiter
+	// If set, limits the rate at which blocks are sent to the peer.
+	UploadLimiter *PeerLimiter
+
+	// The time allowed for each read from the peer. Defaults to READ_TIMEOUT.
+	ReadTimeout time.Duration
+
+	// (optional) Receives messages about the connection. If nil, nothing is logged.
+	Logger Logger
+
+	// Guards writes to the connection so that each message is written whole.
+	writeMu sync.Mutex
+
+	// Whether we have unchoked the peer, as set by the last choke or unchoke
+	// message sent to it.
+	unchokedPeer atomic.Bool
+
+	// The transfer counters of the connection and, if it belongs to a download,
+	// those of the download.
+	counters       counters
+	parentCounters *counters
+
+	// Done once the connection is closed with Close, cancelling waits for the
+	// rate limiters.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The UDP port of the DHT node of the peer, if announced by a port message.
+	DHTPort uint16
+
+	// The extended handshake received from the peer (BEP 10), if any.
+	Extensions *ExtendedHandshake
+
+	// (optional) Called with the peers added by each peer exchange message
+	// received from the peer (BEP 11). Never called for private torrents.
+	OnPexPeers func(added []TrackerPeer)
+
+	// The reserved bytes sent by the peer in its handshake, advertising the
+	// extensions it supports.
+	PeerReserved Reserved
+
+	// Holds the length prefix of the message being read, reused across reads.
+	prefixBuf [4]byte
 }
 
 // NewTCPClient creates a TCP connection with 'peer' and performs a handshake with
@@ -26,56 +100,69 @@ type TCPClient struct {
 // argument for validating the bit field.
 //
 // Returns the created TCPClient and an error if any occurred during this process.
+// Errors wrap ErrInfoHashMismatch or ErrPeerIdMismatch if the peer answered with
+// the wrong identity, in which case retrying the peer is pointless.
+//
+// The peer is connected to directly with a timeout of DIAL_TIMEOUT. Use
+// NewTCPClientWithOptions to configure how the peer is dialed.
 func NewTCPClient(infoHash string, peer TrackerPeer, peerId string, pieces int) (*TCPClient, error) {
-	conn, err := net.Dial("tcp", peer.String())
+	return NewTCPClientWithOptions(infoHash, peer, peerId, pieces, nil)
+}
+
+// NewTCPClientWithOptions creates a TCP connection with 'peer' in the same way as
+// NewTCPClient, but dials the peer as described by 'options' (see DialPeer).
+func NewTCPClientWithOptions(infoHash string, peer TrackerPeer, peerId string, pieces int, options *DialOptions) (*TCPClient, error) {
+	conn, err := DialPeer(peer, options)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := performHandshake(conn, infoHash, peer, peerId, pieces, options.reserved())
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
+	return client, nil
+}
+
+// performHandshake performs a handshake with 'peer' over the established connection
+// 'conn' in the same way as NewTCPClient, advertising 'reserved'. The connection
+// is not closed on error.
+func performHandshake(conn net.Conn, infoHash string, peer TrackerPeer, peerId string, pieces int, reserved Reserved) (*TCPClient, error) {
 	// Send our handshake message to the connection
 	handshake := Handshake{
-		Protocol: "BitTorrent protocol",
-		Reserved: []byte{0, 0, 0, 0, 0, 0, 0, 0},
+		Protocol: PROTOCOL_STRING,
+		Reserved: reserved[:],
 		InfoHash: infoHash,
 		PeerId:   peerId,
 	}
 
-	_, err = conn.Write(handshake.Serialized())
-	if err != nil {
+	if _, err := conn.Write(handshake.Serialized()); err != nil {
 		return nil, fmt.Errorf("could not send handshake message: %w", err)
 	}
 
-	// Process and validate the handshake sent by the tracker.
-	pStrLen, err := ReadN(1, conn)
+	// Process and validate the handshake sent by the peer.
+	peerHandshake, err := ParseHandshake(conn)
 	if err != nil {
-		return nil, fmt.Errorf("could not read peer handshake: %w", err)
-	}
-
-	if _, err := ReadN(int(pStrLen[0]), conn); err != nil {
-		return nil, fmt.Errorf("could not read peer handshake protocol: %w", err)
-	}
-
-	if _, err := ReadN(8, conn); err != nil {
-		return nil, fmt.Errorf("could not read reserved bytes: %w", err)
+		return nil, err
 	}
 
-	recvInfoHash, err := ReadN(20, conn)
-	if err != nil {
-		return nil, fmt.Errorf("could not read info hash: %w", err)
+	if peerHandshake.InfoHash != infoHash {
+		return nil, fmt.Errorf("ending handshake with %s: %w", peer, ErrInfoHashMismatch)
 	}
 
-	if !bytes.Equal(recvInfoHash, []byte(infoHash)) {
-		return nil, fmt.Errorf("ending due to info hash mismatch")
+	if len(peer.PeerId) > 0 && peerHandshake.PeerId != peer.PeerId {
+		return nil, fmt.Errorf("ending handshake with %s: tracker %w", peer, ErrPeerIdMismatch)
 	}
 
-	recvPeerId, err := ReadN(20, conn)
-	if err != nil {
-		return nil, fmt.Errorf("could not read peer id: %w", err)
-	}
+	return newTCPClient(conn, infoHash, peer, peerId, pieces, peerHandshake), nil
+}
 
-	if len(peer.PeerId) > 0 && !bytes.Equal(recvPeerId, []byte(peer.PeerId)) {
-		return nil, fmt.Errorf("ending due to tracker peer id mismatch")
-	}
+// newTCPClient returns a client for the connection 'conn' with 'peer' once the
+// handshakes have been exchanged, 'peerHandshake' being the one sent by the peer.
+func newTCPClient(conn net.Conn, infoHash string, peer TrackerPeer, peerId string, pieces int, peerHandshake *Handshake) *TCPClient {
+	ctx, cancel := context.WithCancel(context.Background())
 
 	return &TCPClient{
 		PeerId:     peerId,
@@ -84,22 +171,95 @@ func NewTCPClient(infoHash string, peer TrackerPeer, peerId string, pieces int)
 		Choked:     true, // A connection starts choked and not interested by default.
 		Peer:       peer,
 		Pieces:     pieces,
-	}, nil
+
+		PeerReserved: Reserved(peerHandshake.Reserved),
+
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Close closes the connection to the peer. Reads and sends waiting for a rate
+// limiter return immediately with context.Canceled.
+func (c *TCPClient) Close() error {
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	return c.Connection.Close()
+}
+
+// waitLimiter waits until 'limiter', if any, allows transferring 'n' bytes or
+// the connection is closed.
+func (c *TCPClient) waitLimiter(limiter *PeerLimiter, n int) error {
+	if limiter == nil {
+		return nil
+	}
+
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return limiter.WaitNContext(ctx, n)
+}
+
+// SupportsDHT reports whether the peer advertised a DHT node in its handshake
+// (BEP 5), in which case it may send a port message.
+func (c *TCPClient) SupportsDHT() bool {
+	return c.PeerReserved.Has(RESERVED_BIT_DHT)
+}
+
+// SupportsFast reports whether the peer advertised support for the Fast
+// Extension in its handshake (BEP 6).
+func (c *TCPClient) SupportsFast() bool {
+	return c.PeerReserved.Has(RESERVED_BIT_FAST)
+}
+
+// setReadDeadline sets the deadline of the next read from the peer connection
+// according to ReadTimeout.
+func (c *TCPClient) setReadDeadline() error {
+	timeout := c.ReadTimeout
+	if timeout <= 0 {
+		timeout = READ_TIMEOUT
+	}
+
+	return c.Connection.SetReadDeadline(time.Now().Add(timeout))
 }
 
 // ReadMessage waits for a message from the peer connection and returns the
 // received message or an error if any.
+//
+// If the peer does not send data within ReadTimeout, an error wrapping
+// os.ErrDeadlineExceeded is returned and the peer should be dropped.
+//
+// Unlike SendMessage, ReadMessage must not be called from multiple goroutines.
 func (c *TCPClient) ReadMessage() (*Message, error) {
-	prefixBytes, err := ReadN(4, c.Connection)
-	if err != nil {
+	if err := c.setReadDeadline(); err != nil {
+		return nil, fmt.Errorf("could not set read deadline: %w", err)
+	}
+
+	if _, err := ReadNInto(c.prefixBuf[:], c.Connection); err != nil {
 		return nil, err
 	}
 
-	lengthPrefix := binary.BigEndian.Uint32(prefixBytes)
+	lengthPrefix := binary.BigEndian.Uint32(c.prefixBuf[:])
 	if lengthPrefix == 0 {
 		return &Message{KeepAlive: true}, nil
 	}
 
+	if maxLength := c.maxMessageLength(); int64(lengthPrefix) > int64(maxLength) {
+		return nil, fmt.Errorf("peer sent a message of %d bytes, at most %d allowed", lengthPrefix, maxLength)
+	}
+
+	if err := c.waitLimiter(c.DownloadLimiter, int(lengthPrefix)); err != nil {
+		return nil, fmt.Errorf("could not wait for download limiter: %w", err)
+	}
+
+	if err := c.setReadDeadline(); err != nil {
+		return nil, fmt.Errorf("could not set read deadline: %w", err)
+	}
+
 	messageBytes, err := ReadN(int(lengthPrefix), c.Connection)
 	if err != nil {
 		return nil, fmt.Errorf("could not read message: %w", err)
@@ -112,16 +272,25 @@ func (c *TCPClient) ReadMessage() (*Message, error) {
 	case MessageChoke, MessageUnchoke, MessageInterested, MessageNotInterested:
 		return &Message{Id: msgId}, nil
 	case MessageHave:
+		if len(msgSlice) != 4 {
+			return nil, fmt.Errorf("peer sent a have message of %d bytes", len(msgSlice))
+		}
+
 		return &Message{Id: msgId, PieceIndex: binary.BigEndian.Uint32(msgSlice)}, nil
 	case MessageBitfield:
-		return &Message{
-			Id: msgId,
-			BitField: BitField{
-				Field:  msgSlice,
-				Length: c.Pieces,
-			},
-		}, nil
+		field := BitField{Field: msgSlice, Length: c.Pieces}
+
+		// The piece count is unknown before the metadata of a torrent is fetched.
+		if c.Pieces > 0 && !field.Valid() {
+			return nil, fmt.Errorf("peer sent an invalid bitfield of %d bytes for %d pieces", len(msgSlice), c.Pieces)
+		}
+
+		return &Message{Id: msgId, BitField: field}, nil
 	case MessageRequest, MessageCancel:
+		if len(msgSlice) != 12 {
+			return nil, fmt.Errorf("peer sent a request message of %d bytes", len(msgSlice))
+		}
+
 		index := binary.BigEndian.Uint32(msgSlice[0:4])
 		begin := binary.BigEndian.Uint32(msgSlice[4:8])
 		length := binary.BigEndian.Uint32(msgSlice[8:12])
@@ -131,24 +300,91 @@ func (c *TCPClient) ReadMessage() (*Message, error) {
 			Request: Request{Index: index, Begin: begin, Length: length},
 		}, nil
 	case MessagePiece:
+		if len(msgSlice) < 8 {
+			return nil, fmt.Errorf("peer sent a piece message of %d bytes", len(msgSlice))
+		}
+
 		index := binary.BigEndian.Uint32(msgSlice[0:4])
 		begin := binary.BigEndian.Uint32(msgSlice[4:8])
 		block := msgSlice[8:]
 
+		c.count(func(counters *counters) { counters.downloaded.Add(int64(len(block))) })
+
 		return &Message{
 			Id:    msgId,
 			Block: Block{Index: index, Begin: begin, Block: block},
 		}, nil
+	case MessagePort:
+		if len(msgSlice) != 2 {
+			return nil, fmt.Errorf("peer sent a port message of %d bytes", len(msgSlice))
+		}
+
+		return &Message{Id: msgId, Port: binary.BigEndian.Uint16(msgSlice)}, nil
+	case MessageExtended:
+		if len(msgSlice) < 1 {
+			return nil, fmt.Errorf("peer sent an empty extended message")
+		}
+
+		return &Message{
+			Id:       msgId,
+			Extended: Extended{Id: msgSlice[0], Payload: msgSlice[1:]},
+		}, nil
 	default:
 		return &Message{Generic: true, Contents: msgSlice, Id: msgId}, nil
 	}
 }
 
+// maxMessageLength returns the largest message accepted from the peer, which is
+// MAX_MESSAGE_LENGTH unless a bitfield of the torrent is longer.
+func (c *TCPClient) maxMessageLength() int {
+	return max(MAX_MESSAGE_LENGTH, 1+(c.Pieces+7)/8)
+}
+
+// write writes 'buf' to the peer connection while holding the write lock.
+func (c *TCPClient) write(buf []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := c.Connection.Write(buf)
+	return err
+}
+
+// StartKeepAlive sends a keep alive message to the peer every 'interval' in the
+// background until 'ctx' is done or sending fails. If 'interval' is zero or
+// negative, KEEP_ALIVE_INTERVAL is used.
+//
+// Peers drop connections that stay silent for around two minutes, so one keep
+// alive sender should be run for each active connection.
+func (c *TCPClient) StartKeepAlive(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = KEEP_ALIVE_INTERVAL
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := c.SendMessage(Message{KeepAlive: true}); err != nil {
+				return
+			}
+		}
+	}()
+}
+
 // SendMessage sends a 'message' to the peer connection and returns an error if any.
+//
+// SendMessage may be called from multiple goroutines; each message is written whole.
 func (c *TCPClient) SendMessage(message Message) error {
 	if message.KeepAlive {
 		// A keep alive message is simply 4 zeroes.
-		_, err := c.Connection.Write([]byte{0, 0, 0, 0})
+		err := c.write([]byte{0, 0, 0, 0})
 		if err != nil {
 			return fmt.Errorf("could not send keep alive: %w", err)
 		}
@@ -161,8 +397,18 @@ func (c *TCPClient) SendMessage(message Message) error {
 		buf := binary.BigEndian.AppendUint32([]byte{}, 1) // length prefix
 		buf = append(buf, byte(message.Id))
 
-		c.Connection.Write(buf)
-	case MessageRequest:
+		err := c.write(buf)
+		if err != nil {
+			return fmt.Errorf("could not send state message: %w", err)
+		}
+
+		switch message.Id {
+		case MessageChoke:
+			c.unchokedPeer.Store(false)
+		case MessageUnchoke:
+			c.unchokedPeer.Store(true)
+		}
+	case MessageRequest, MessageCancel:
 		buf := new(bytes.Buffer)
 		binary.Write(buf, binary.BigEndian, byte(message.Id))
 		binary.Write(buf, binary.BigEndian, message.Request.Index)
@@ -174,7 +420,7 @@ func (c *TCPClient) SendMessage(message Message) error {
 		lengthPrefix := make([]byte, 4)
 		binary.BigEndian.PutUint32(lengthPrefix, uint32(len(msgSent)))
 
-		_, err := c.Connection.Write(append(lengthPrefix, msgSent...))
+		err := c.write(append(lengthPrefix, msgSent...))
 		if err != nil {
 			return fmt.Errorf("could not send request message: %w", err)
 		}
@@ -188,10 +434,59 @@ func (c *TCPClient) SendMessage(message Message) error {
 		lengthPrefix := make([]byte, 4)
 		binary.BigEndian.PutUint32(lengthPrefix, uint32(len(msgSent)))
 
-		_, err := c.Connection.Write(append(lengthPrefix, msgSent...))
+		err := c.write(append(lengthPrefix, msgSent...))
 		if err != nil {
 			return fmt.Errorf("could not send have message: %w", err)
 		}
+	case MessageBitfield:
+		buf := binary.BigEndian.AppendUint32([]byte{}, uint32(1+len(message.BitField.Field))) // length prefix
+		buf = append(buf, byte(message.Id))
+		buf = append(buf, message.BitField.Field...)
+
+		err := c.write(buf)
+		if err != nil {
+			return fmt.Errorf("could not send bitfield message: %w", err)
+		}
+	case MessagePiece:
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, byte(message.Id))
+		binary.Write(buf, binary.BigEndian, message.Block.Index)
+		binary.Write(buf, binary.BigEndian, message.Block.Begin)
+		buf.Write(message.Block.Block)
+
+		msgSent := buf.Bytes()
+
+		if err := c.waitLimiter(c.UploadLimiter, len(msgSent)); err != nil {
+			return fmt.Errorf("could not wait for upload limiter: %w", err)
+		}
+
+		lengthPrefix := make([]byte, 4)
+		binary.BigEndian.PutUint32(lengthPrefix, uint32(len(msgSent)))
+
+		err := c.write(append(lengthPrefix, msgSent...))
+		if err != nil {
+			return fmt.Errorf("could not send piece message: %w", err)
+		}
+
+		c.count(func(counters *counters) { counters.uploaded.Add(int64(len(message.Block.Block))) })
+	case MessagePort:
+		buf := binary.BigEndian.AppendUint32([]byte{}, 3) // length prefix
+		buf = append(buf, byte(message.Id))
+		buf = binary.BigEndian.AppendUint16(buf, message.Port)
+
+		err := c.write(buf)
+		if err != nil {
+			return fmt.Errorf("could not send port message: %w", err)
+		}
+	case MessageExtended:
+		buf := binary.BigEndian.AppendUint32([]byte{}, uint32(2+len(message.Extended.Payload))) // length prefix
+		buf = append(buf, byte(message.Id), message.Extended.Id)
+		buf = append(buf, message.Extended.Payload...)
+
+		err := c.write(buf)
+		if err != nil {
+			return fmt.Errorf("could not send extended message: %w", err)
+		}
 	default:
 		return fmt.Errorf("no handler for message %v", message)
 	}
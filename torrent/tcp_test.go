@@ -0,0 +1,329 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newClientPair returns two clients connected to each other over loopback TCP,
+// both expecting a torrent of 'pieces' pieces.
+func newClientPair(t *testing.T, pieces int) (*TCPClient, *TCPClient) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+
+	remote, ok := <-accepted
+	if !ok {
+		t.Fatalf("could not accept connection")
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		remote.Close()
+	})
+
+	return &TCPClient{Connection: conn, Pieces: pieces}, &TCPClient{Connection: remote, Pieces: pieces}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	sender, receiver := newClientPair(t, 10)
+
+	messages := []Message{
+		{KeepAlive: true},
+		{Id: MessageChoke},
+		{Id: MessageUnchoke},
+		{Id: MessageInterested},
+		{Id: MessageNotInterested},
+		{Id: MessageHave, PieceIndex: 7},
+		{Id: MessageBitfield, BitField: BitField{Field: []byte{0xff, 0xc0}, Length: 10}},
+		{Id: MessageRequest, Request: Request{Index: 1, Begin: 16384, Length: 16384}},
+		{Id: MessageCancel, Request: Request{Index: 2, Begin: 0, Length: 100}},
+		{Id: MessagePiece, Block: Block{Index: 3, Begin: 32768, Block: []byte("block")}},
+		{Id: MessagePiece, Block: Block{Index: 4, Begin: 0, Block: []byte{}}},
+		{Id: MessagePort, Port: 6881},
+		{Id: MessageExtended, Extended: Extended{Id: 1, Payload: []byte("d1:ai1ee")}},
+	}
+
+	for _, message := range messages {
+		if err := sender.SendMessage(message); err != nil {
+			t.Fatalf("could not send %+v: %v", message, err)
+		}
+
+		received, err := receiver.ReadMessage()
+		if err != nil {
+			t.Fatalf("could not read %+v: %v", message, err)
+		}
+
+		if !reflect.DeepEqual(*received, message) {
+			t.Errorf("round trip of %+v returned %+v", message, *received)
+		}
+	}
+}
+
+// chunkedConn writes in small chunks, like connections that wrap another one,
+// so that unsynchronized writes interleave.
+type chunkedConn struct {
+	net.Conn
+}
+
+func (c chunkedConn) Write(buf []byte) (int, error) {
+	var written int
+
+	for chunk := range slices.Chunk(buf, 1024) {
+		n, err := c.Conn.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		runtime.Gosched()
+	}
+
+	return written, nil
+}
+
+func TestSendMessageConcurrent(t *testing.T) {
+	const (
+		senders   = 8
+		perSender = 50
+		blockSize = 64 * 1024
+	)
+
+	sender, receiver := newClientPair(t, 10)
+	sender.Connection = chunkedConn{sender.Connection}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Keep alive messages are written alongside the others.
+	sender.StartKeepAlive(ctx, time.Millisecond)
+
+	for idx := range senders {
+		go func() {
+			block := bytes.Repeat([]byte{byte(idx)}, blockSize)
+
+			for begin := range perSender {
+				message := Message{Id: MessagePiece, Block: Block{Index: uint32(idx), Begin: uint32(begin), Block: block}}
+				if err := sender.SendMessage(message); err != nil {
+					t.Errorf("could not send block %d: %v", begin, err)
+					return
+				}
+			}
+		}()
+	}
+
+	received := make([]int, senders)
+
+	for range senders * perSender {
+		message, err := receiver.ReadMessage()
+		for err == nil && message.KeepAlive {
+			message, err = receiver.ReadMessage()
+		}
+
+		if err != nil {
+			t.Fatalf("could not read message: %v", err)
+		}
+
+		index := message.Block.Index
+		if message.Id != MessagePiece || int(index) >= senders {
+			t.Fatalf("read interleaved message %d for piece %d", message.Id, index)
+		}
+
+		if int(message.Block.Begin) != received[index] {
+			t.Errorf("read block %d of sender %d, expected block %d", message.Block.Begin, index, received[index])
+		}
+		received[index]++
+
+		if !bytes.Equal(message.Block.Block, bytes.Repeat([]byte{byte(index)}, blockSize)) {
+			t.Fatalf("block %d of sender %d was interleaved with another message", message.Block.Begin, index)
+		}
+	}
+}
+
+func TestReadMessageMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{"short have", []byte{0, 0, 0, 3, byte(MessageHave), 0, 1}},
+		{"long have", []byte{0, 0, 0, 6, byte(MessageHave), 0, 0, 0, 1, 2}},
+		{"short piece", []byte{0, 0, 0, 5, byte(MessagePiece), 0, 0, 0, 1}},
+		{"piece without offset", []byte{0, 0, 0, 1, byte(MessagePiece)}},
+		{"short request", []byte{0, 0, 0, 4, byte(MessageRequest), 0, 0, 0}},
+		{"short cancel", []byte{0, 0, 0, 2, byte(MessageCancel), 0}},
+		{"short port", []byte{0, 0, 0, 2, byte(MessagePort), 0}},
+		{"empty extended", []byte{0, 0, 0, 1, byte(MessageExtended)}},
+		{"short bitfield", []byte{0, 0, 0, 2, byte(MessageBitfield), 0xff}},
+		{"over-long bitfield", []byte{0, 0, 0, 4, byte(MessageBitfield), 0xff, 0xc0, 0x00}},
+		{"bitfield with dirty padding", []byte{0, 0, 0, 3, byte(MessageBitfield), 0xff, 0xff}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender, receiver := newClientPair(t, 10)
+
+			if _, err := sender.Connection.Write(test.raw); err != nil {
+				t.Fatalf("could not write message: %v", err)
+			}
+
+			if message, err := receiver.ReadMessage(); err == nil {
+				t.Errorf("ReadMessage accepted %x as %+v", test.raw, *message)
+			}
+		})
+	}
+}
+
+func TestReadMessageTooLong(t *testing.T) {
+	sender, receiver := newClientPair(t, 10)
+
+	// A peer announcing a 4 GiB message must be rejected before it is allocated.
+	if _, err := sender.Connection.Write([]byte{0xff, 0xff, 0xff, 0xff, byte(MessagePiece)}); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+
+	if _, err := receiver.ReadMessage(); err == nil {
+		t.Errorf("ReadMessage accepted a message of 4 GiB")
+	}
+}
+
+func TestReadMessageLargeBitfield(t *testing.T) {
+	pieces := 8 * 2 * MAX_MESSAGE_LENGTH
+	sender, receiver := newClientPair(t, pieces)
+
+	field := NewBitField(pieces)
+	field.SetPiece(pieces - 1)
+
+	go sender.SendMessage(Message{Id: MessageBitfield, BitField: field})
+
+	message, err := receiver.ReadMessage()
+	if err != nil {
+		t.Fatalf("could not read bitfield of %d pieces: %v", pieces, err)
+	}
+
+	if !message.BitField.HasPiece(pieces - 1) {
+		t.Errorf("bitfield lost the last piece")
+	}
+}
+
+func TestReadMessageTimeout(t *testing.T) {
+	_, receiver := newClientPair(t, 10)
+	receiver.ReadTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := receiver.ReadMessage()
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected a deadline error from a silent peer, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReadMessage returned after %s", elapsed)
+	}
+}
+
+func TestReadMessageTimeoutMidMessage(t *testing.T) {
+	sender, receiver := newClientPair(t, 10)
+	receiver.ReadTimeout = 50 * time.Millisecond
+
+	// The peer stalls after announcing a message of 5 bytes.
+	if _, err := sender.Connection.Write([]byte{0, 0, 0, 5, byte(MessageHave)}); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+
+	if _, err := receiver.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected a deadline error from a stalled peer, got %v", err)
+	}
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		sender := &TCPClient{Connection: conn}
+		for range b.N {
+			if sender.SendMessage(Message{Id: MessageHave, PieceIndex: 1}) != nil {
+				return
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatalf("could not dial: %v", err)
+	}
+	defer conn.Close()
+
+	receiver := &TCPClient{Connection: conn, Pieces: 10}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		if _, err := receiver.ReadMessage(); err != nil {
+			b.Fatalf("could not read message: %v", err)
+		}
+	}
+}
+
+func TestPerformHandshakeProtocolMismatch(t *testing.T) {
+	local, remote := newClientPair(t, 10)
+	infoHash := strings.Repeat("h", 20)
+
+	// The peer answers with a protocol string of the right length but the
+	// wrong contents.
+	go func() {
+		ReadN(1+len(PROTOCOL_STRING)+8+20+20, remote.Connection)
+
+		reply := Handshake{
+			Protocol: strings.ToUpper(PROTOCOL_STRING),
+			Reserved: make([]byte, 8),
+			InfoHash: infoHash,
+			PeerId:   strings.Repeat("p", 20),
+		}
+		remote.Connection.Write(reply.Serialized())
+	}()
+
+	client, err := performHandshake(local.Connection, infoHash, TrackerPeer{Ip: "127.0.0.1", Port: 6881}, strings.Repeat("q", 20), 10, DEFAULT_RESERVED)
+	if !errors.Is(err, ErrProtocolMismatch) {
+		t.Errorf("handshake returned %v with error %v, expected ErrProtocolMismatch", client, err)
+	}
+}
@@ -0,0 +1,129 @@
+package torrent
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aescarias/apricot/torrent/bencode"
+)
+
+// A testTracker is an http.Handler answering every announce with a fixed peer
+// list, in either the compact or dictionary model, or with a failure reason.
+type testTracker struct {
+	Peers    []TrackerPeer // The peers returned in every response.
+	Interval int           // The interval in seconds returned in every response.
+
+	// Whether peers are sent in the compact format, IPv6 peers being sent in the
+	// 'peers6' key. Otherwise, peers are sent in the dictionary model.
+	Compact bool
+	// (optional) If set, every announce fails with this reason.
+	FailureReason string
+	// (optional) If set, every successful response carries this warning.
+	WarningMessage string
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+// NewTestTracker starts a server answering announces with 'peers' in compact
+// format and 'interval'. The announce URL of the tracker is the URL field of the
+// server, which must be closed once done.
+func NewTestTracker(peers []TrackerPeer, interval int) *httptest.Server {
+	return httptest.NewServer(&testTracker{Peers: peers, Interval: interval, Compact: true})
+}
+
+// serveTestTracker starts a server for 'tracker', closed at the end of the test,
+// and returns a torrent announcing to it.
+func serveTestTracker(t *testing.T, tracker *testTracker) *Torrent {
+	server := httptest.NewServer(tracker)
+	t.Cleanup(server.Close)
+
+	return &Torrent{AnnounceURL: server.URL + "/announce"}
+}
+
+// Requests returns the announce requests received so far, in order.
+func (t *testTracker) Requests() []*http.Request {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]*http.Request(nil), t.requests...)
+}
+
+// ServeHTTP answers an announce request with the bencoded response of the tracker.
+func (t *testTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	t.requests = append(t.requests, r)
+	t.mu.Unlock()
+
+	response, err := t.response()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	encoded, err := bencode.EncodeBencode(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(encoded))
+}
+
+// response returns the announce response of the tracker as a dictionary.
+func (t *testTracker) response() (map[string]any, error) {
+	if len(t.FailureReason) > 0 {
+		return map[string]any{"failure reason": t.FailureReason}, nil
+	}
+
+	response := map[string]any{"interval": int64(t.Interval)}
+	if len(t.WarningMessage) > 0 {
+		response["warning message"] = t.WarningMessage
+	}
+
+	if !t.Compact {
+		peers := make([]any, 0, len(t.Peers))
+		for _, peer := range t.Peers {
+			dict := map[string]any{"ip": peer.Ip, "port": int64(peer.Port)}
+			if len(peer.PeerId) > 0 {
+				dict["peer id"] = peer.PeerId
+			}
+
+			peers = append(peers, dict)
+		}
+
+		response["peers"] = peers
+		return response, nil
+	}
+
+	var peers4, peers6 []TrackerPeer
+	for _, peer := range t.Peers {
+		if ip := net.ParseIP(peer.Ip); ip != nil && ip.To4() == nil {
+			peers6 = append(peers6, peer)
+		} else {
+			peers4 = append(peers4, peer)
+		}
+	}
+
+	compact, err := PeersToCompact(peers4)
+	if err != nil {
+		return nil, err
+	}
+
+	response["peers"] = compact
+
+	if len(peers6) > 0 {
+		compact6, err := PeersToCompact6(peers6)
+		if err != nil {
+			return nil, err
+		}
+
+		response["peers6"] = compact6
+	}
+
+	return response, nil
+}
@@ -12,42 +12,134 @@ package torrent
 
 import (
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/aescarias/apricot/torrent/bencode"
 )
 
+// ErrPieceLengthNotPowerOfTwo is returned by Info.Validate when the piece length
+// is not a power of two. Such torrents are valid but unusual, and some clients
+// do not support them, so this may be treated as a warning.
+var ErrPieceLengthNotPowerOfTwo = errors.New("piece length is not a power of two")
+
 // A Torrent represents the contents of a .torrent file.
 type Torrent struct {
-	Info        Info   // Information describing the files of this torrent.
-	AnnounceURL string // The announce URL of the torrent tracker.
+	Info        Info   `bencode:"info"`               // Information describing the files of this torrent.
+	AnnounceURL string `bencode:"announce,omitempty"` // The announce URL of the torrent tracker.
+
+	// (optional) Tiers of announce URLs as described in BEP 12, in the order of
+	// the .torrent file. GetPeersAny tries the URLs of each tier in random order.
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+
+	Comment      string    `bencode:"comment,omitempty"`    // (optional) Free-form textual comments of the author.
+	CreatedBy    string    `bencode:"created by,omitempty"` // (optional) Name and version of the program used to create the torrent.
+	CreationDate time.Time `bencode:"-"`                    // (optional) The time the torrent was created.
+	Encoding     string    `bencode:"encoding,omitempty"`   // (optional) The string encoding used in the info dictionary.
+
+	// (optional) In case of a v2 torrent, the concatenated SHA-256 hashes of the
+	// piece layer of each file larger than a piece, keyed by its pieces root.
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
+
+	// (optional) URLs of HTTP servers hosting the contents of the torrent, as
+	// described in BEP 19.
+	WebSeeds []string `bencode:"-"`
+
+	// (optional) The client used for HTTP requests to trackers. If nil, a client
+	// with a timeout of 30 seconds is used. The TLS configuration of its transport
+	// also applies to secure WebSocket trackers; see NewTrackerHTTPClient.
+	HTTPClient *http.Client `bencode:"-"`
+	// (optional) How failed tracker requests are retried. If nil, requests are
+	// not retried.
+	Retry *RetryPolicy `bencode:"-"`
+	// (optional) Receives messages about tracker requests. If nil, nothing is logged.
+	Logger Logger `bencode:"-"`
+
+	// The non-empty tiers of AnnounceList in the order tried by GetPeersAny,
+	// guarded by announceMu.
+	announceOrder [][]string
+	announceMu    sync.Mutex
 }
 
 // An Info represents the contents of the 'info' dictionary in the .torrent file.
 type Info struct {
-	// The suggested name of the file or directory.
-	Name string
+	// The suggested name of the file or directory, in the string encoding of the
+	// torrent.
+	Name string `bencode:"name"`
+	// (optional) The suggested name of the file or directory encoded as UTF-8.
+	NameUTF8 string `bencode:"name.utf-8,omitempty"`
 	// Number of bytes in each piece.
-	PieceLength int
-	// Concatenated 20-byte SHA1 hash values for each piece.
-	Pieces string
-	// In case of a single file torrent, the length of the file in bytes.
-	Length int
+	PieceLength int64 `bencode:"piece length"`
+	// Concatenated 20-byte SHA1 hash values for each piece. This is binary data.
+	Pieces string `bencode:"pieces"`
+	// In case of a single file torrent, the length of the file in bytes. Bencodable
+	// includes it whenever Files is empty, even if zero.
+	Length int64 `bencode:"length,omitempty"`
 	// In case of a multiple file torrent, the files included in the torrent.
-	Files []InfoFile
+	Files []InfoFile `bencode:"files,omitempty"`
+	// Whether the torrent is private (BEP 27). Peers of a private torrent must
+	// only be obtained from its trackers and not from the DHT or peer exchange.
+	Private bool `bencode:"private,omitempty"`
+	// (optional) The version of the meta info format, 2 for v2 and hybrid torrents
+	// (BEP 52). Zero for v1 torrents.
+	MetaVersion int `bencode:"meta version,omitempty"`
+	// (optional) In case of a v2 torrent, the tree of files included in the torrent.
+	// See Info.TreeFiles.
+	FileTree map[string]any `bencode:"file tree,omitempty"`
+
+	// The exact bencoded form of the info dictionary as read from the .torrent file.
+	raw string
+	// The info hash known ahead of the metadata, such as from a magnet URI.
+	infoHash *[20]byte
 }
 
 // An InfoFile represents an individual file within a multiple file torrent.
 type InfoFile struct {
 	// The length of the file in bytes.
-	Length int
-	// A slice of path parts ending with the filename.
-	Path []string
+	Length int64 `bencode:"length"`
+	// A slice of path parts ending with the filename, in the string encoding of
+	// the torrent.
+	Path []string `bencode:"path"`
+	// (optional) A slice of path parts ending with the filename encoded as UTF-8.
+	PathUTF8 []string `bencode:"path.utf-8,omitempty"`
+}
+
+// PreferredName returns the name of the file or directory as UTF-8 if the torrent
+// provides it, otherwise the name in the string encoding of the torrent.
+func (i *Info) PreferredName() string {
+	if len(i.NameUTF8) > 0 {
+		return i.NameUTF8
+	}
+
+	return i.Name
+}
+
+// PreferredPath returns the path of the file as UTF-8 if the torrent provides it,
+// otherwise the path in the string encoding of the torrent.
+func (f *InfoFile) PreferredPath() []string {
+	if len(f.PathUTF8) > 0 {
+		return f.PathUTF8
+	}
+
+	return f.Path
+}
+
+// HasMetadata reports whether the contents of the info dictionary are known.
+//
+// This is false for an Info obtained from a magnet URI until its metadata is
+// fetched from peers.
+func (i *Info) HasMetadata() bool {
+	return len(i.raw) > 0 || len(i.Pieces) > 0 || len(i.FileTree) > 0
 }
 
 // PieceHashes returns a slice of all SHA1 piece hashes described in the torrent.
+// The slice is empty, but not nil, if the torrent has no pieces.
 func (i *Info) PieceHashes() []string {
-	var hashes []string
+	hashes := make([]string, 0, i.NumPieces())
 
 	for idx := 0; idx <= len(i.Pieces)-20; idx += 20 {
 		hashes = append(hashes, i.Pieces[idx:idx+20])
@@ -56,16 +148,38 @@ func (i *Info) PieceHashes() []string {
 	return hashes
 }
 
+// NumPieces returns the number of pieces described in the torrent. This is zero
+// if Pieces is empty, as for torrents of empty files or without metadata.
+func (i *Info) NumPieces() int {
+	return len(i.Pieces) / 20
+}
+
+// PieceSize returns the length in bytes of the piece at 'index'. Every piece is
+// PieceLength bytes long except for the last one, which holds the remainder of
+// the total length. Returns 0 if the index is out of range.
+func (i *Info) PieceSize(index int) int {
+	numPieces := i.NumPieces()
+	if index < 0 || index >= numPieces {
+		return 0
+	}
+
+	if index < numPieces-1 {
+		return int(i.PieceLength)
+	}
+
+	return int(i.TotalLength() - int64(numPieces-1)*i.PieceLength)
+}
+
 // TotalLength returns the total amount of bytes contained in this torrent.
 //
 // For single file torrents, this returns the same value as Length. For multiple
 // file torrents, this returns the sum of the file lengths in the torrent.
-func (i *Info) TotalLength() int {
+func (i *Info) TotalLength() int64 {
 	if len(i.Files) <= 0 {
 		return i.Length
 	}
 
-	total := 0
+	var total int64
 
 	for _, file := range i.Files {
 		total += file.Length
@@ -75,24 +189,106 @@ func (i *Info) TotalLength() int {
 }
 
 // Bencodable returns a Bencodable representation of the info struct.
+//
+// If the info was read from a .torrent file or fetched from peers, the original
+// dictionary is returned, including any keys not represented in Info, so that
+// encoding it preserves the info hash.
 func (i *Info) Bencodable() map[string]any {
+	if len(i.raw) > 0 {
+		if token, err := bencode.DecodeBencodeSingle(i.raw); err == nil {
+			if contents, ok := token.(map[string]any); ok {
+				return contents
+			}
+		}
+	}
+
 	contents := map[string]any{
 		"name":         i.Name,
 		"piece length": i.PieceLength,
-		"pieces":       i.Pieces,
 	}
 
-	if files := i.Files; len(files) > 0 {
-		var items []map[string]any
-		for _, file := range files {
-			items = append(items, map[string]any{
-				"length": file.Length,
-				"path":   file.Path,
-			})
+	// Pure v2 torrents describe their files only through the file tree.
+	if !i.IsV2() || i.IsHybrid() {
+		contents["pieces"] = i.Pieces
+
+		if files := i.Files; len(files) > 0 {
+			var items []map[string]any
+			for _, file := range files {
+				item := map[string]any{
+					"length": file.Length,
+					"path":   file.Path,
+				}
+
+				if len(file.PathUTF8) > 0 {
+					item["path.utf-8"] = file.PathUTF8
+				}
+
+				items = append(items, item)
+			}
+			contents["files"] = items
+		} else {
+			// Single file torrents require the length, even if it is zero.
+			contents["length"] = i.Length
 		}
-		contents["files"] = items
-	} else {
-		contents["length"] = i.Length
+	}
+
+	if len(i.NameUTF8) > 0 {
+		contents["name.utf-8"] = i.NameUTF8
+	}
+
+	if i.Private {
+		contents["private"] = 1
+	}
+
+	if i.MetaVersion != 0 {
+		contents["meta version"] = i.MetaVersion
+	}
+
+	if i.FileTree != nil {
+		contents["file tree"] = i.FileTree
+	}
+
+	return contents
+}
+
+// Bencodable returns a Bencodable representation of the torrent, that is, the
+// contents of the .torrent file. Encoding it reproduces an equivalent file with
+// the same info hash.
+func (t *Torrent) Bencodable() map[string]any {
+	contents := map[string]any{
+		"info": t.Info.Bencodable(),
+	}
+
+	if len(t.AnnounceURL) > 0 {
+		contents["announce"] = t.AnnounceURL
+	}
+
+	if len(t.AnnounceList) > 0 {
+		contents["announce-list"] = t.AnnounceList
+	}
+
+	if len(t.Comment) > 0 {
+		contents["comment"] = t.Comment
+	}
+
+	if len(t.CreatedBy) > 0 {
+		contents["created by"] = t.CreatedBy
+	}
+
+	if !t.CreationDate.IsZero() {
+		contents["creation date"] = t.CreationDate.Unix()
+	}
+
+	if len(t.Encoding) > 0 {
+		contents["encoding"] = t.Encoding
+	}
+
+	if len(t.WebSeeds) > 0 {
+		contents["url-list"] = t.WebSeeds
+	}
+
+	if len(t.PieceLayers) > 0 {
+		contents["piece layers"] = t.PieceLayers
 	}
 
 	return contents
@@ -100,11 +296,19 @@ func (i *Info) Bencodable() map[string]any {
 
 // Hash returns the info hash as a byte sequence and an error if any.
 //
-// The info hash is a SHA1 hash of the bencoded info struct.
+// The info hash is a SHA1 hash of the bencoded info dictionary. If the info was
+// read from a .torrent file, the original bytes of the dictionary are hashed so
+// that keys not modeled by Info are accounted for. Otherwise, the hash is computed
+// over the encoding of Bencodable.
+//
+// If the info has no metadata but its hash is known ahead of time (as is the
+// case for magnet URIs), that hash is returned.
 func (i *Info) Hash() ([20]byte, error) {
-	bencodable := i.Bencodable()
+	if !i.HasMetadata() && i.infoHash != nil {
+		return *i.infoHash, nil
+	}
 
-	bencoded, err := bencode.EncodeBencode(bencodable)
+	bencoded, err := i.encode()
 	if err != nil {
 		return [20]byte{}, fmt.Errorf("could not bencode data for info hash: %w", err)
 	}
@@ -112,62 +316,246 @@ func (i *Info) Hash() ([20]byte, error) {
 	return sha1.Sum([]byte(bencoded)), nil
 }
 
-// newInfoFileSlice parses a decoded 'items' list into a slice of files included
-// in the torrent. Returns this slice or an error if any.
-func newInfoFileSlice(items []any) ([]InfoFile, error) {
-	files := make([]InfoFile, len(items))
+// encode returns the bencoded info dictionary from which the info hashes are
+// computed: the original bytes if the info was read from a .torrent file or
+// fetched from peers, otherwise the encoding of Bencodable.
+func (i *Info) encode() (string, error) {
+	if len(i.raw) > 0 {
+		return i.raw, nil
+	}
+
+	return bencode.EncodeBencode(i.Bencodable())
+}
+
+// SameAs reports whether the torrent and 'other' describe the same content, as
+// identified by their info hashes. This allows deduplicating a torrent loaded
+// from a .torrent file and one loaded from a magnet URI.
+//
+// The v1 info hashes are compared and, if both torrents are v2 torrents, so are
+// their v2 info hashes. Returns an error if any hash cannot be computed.
+func (t *Torrent) SameAs(other *Torrent) (bool, error) {
+	hash, err := t.Info.Hash()
+	if err != nil {
+		return false, fmt.Errorf("could not get info hash: %w", err)
+	}
 
-	for nth, item := range items {
-		item, ok := item.(map[string]any)
-		if !ok {
-			return nil, fmt.Errorf("invalid file item: %v", item)
+	otherHash, err := other.Info.Hash()
+	if err != nil {
+		return false, fmt.Errorf("could not get info hash of other torrent: %w", err)
+	}
+
+	if hash != otherHash {
+		return false, nil
+	}
+
+	if !t.Info.IsV2() || !other.Info.IsV2() {
+		return true, nil
+	}
+
+	hashV2, err := t.Info.HashV2()
+	if err != nil {
+		return false, fmt.Errorf("could not get v2 info hash: %w", err)
+	}
+
+	otherHashV2, err := other.Info.HashV2()
+	if err != nil {
+		return false, fmt.Errorf("could not get v2 info hash of other torrent: %w", err)
+	}
+
+	return hashV2 == otherHashV2, nil
+}
+
+// The keys of the meta info dictionary read by NewTorrent.
+var metaInfoKeys = []string{
+	"announce", "announce-list", "comment", "created by", "creation date",
+	"encoding", "info", "piece layers", "url-list",
+}
+
+// NewTorrent creates a Torrent structure from a decoded 'contents' dictionary
+// representing the .torrent file. The info dictionary is checked with Info.Validate,
+// though piece lengths that are not a power of two are accepted. If present, the
+// announce URL is checked with ValidateAnnounceURL; torrents without one, such as
+// trackerless torrents, are accepted.
+//
+// Returns the structure or an error if any.
+func NewTorrent(contents map[string]any) (*Torrent, error) {
+	if _, ok := contents["info"].(map[string]any); !ok {
+		return nil, fmt.Errorf("missing info dictionary")
+	}
+
+	var torrent Torrent
+	if err := bencode.UnmarshalToken(contents, &torrent); err != nil {
+		return nil, fmt.Errorf("could not parse meta info: %w", err)
+	}
+
+	if err := torrent.Info.Validate(); err != nil && !errors.Is(err, ErrPieceLengthNotPowerOfTwo) {
+		return nil, fmt.Errorf("invalid info dictionary: %w", err)
+	}
+
+	if _, ok := contents["announce"]; ok {
+		if err := ValidateAnnounceURL(torrent.AnnounceURL); err != nil {
+			return nil, err
 		}
+	}
+
+	if creationDate, ok := contents["creation date"].(int64); ok {
+		torrent.CreationDate = time.Unix(creationDate, 0)
+	}
 
-		rawPath, ok := item["path"].([]any)
-		if !ok {
-			return nil, fmt.Errorf("invalid path list: %v", rawPath)
+	switch urlList := contents["url-list"].(type) {
+	case string:
+		if len(urlList) > 0 {
+			torrent.WebSeeds = []string{urlList}
 		}
+	case []any:
+		if err := bencode.UnmarshalToken(urlList, &torrent.WebSeeds); err != nil {
+			return nil, fmt.Errorf("could not parse url list: %w", err)
+		}
+	}
 
-		path := make([]string, len(rawPath))
+	return &torrent, nil
+}
+
+// Validate checks that the info dictionary is consistent: the piece length must
+// be positive, the pieces must be a whole number of SHA1 hashes and there must be
+// exactly one hash per piece of the total length. For v2 torrents, the file tree
+// must be well-formed and the piece hashes are only checked for hybrid torrents.
+// Returns a descriptive error for the first problem found.
+//
+// If the info is otherwise valid, but its piece length is not a power of two, an
+// error wrapping ErrPieceLengthNotPowerOfTwo is returned.
+func (i *Info) Validate() error {
+	if i.PieceLength <= 0 {
+		return fmt.Errorf("piece length must be positive, got %d", i.PieceLength)
+	}
 
-		for idx, part := range rawPath {
-			path[idx] = part.(string)
+	if i.MetaVersion != 0 && i.MetaVersion != 2 {
+		return fmt.Errorf("unsupported meta version %d", i.MetaVersion)
+	}
+
+	if i.IsV2() {
+		if _, err := i.TreeFiles(); err != nil {
+			return fmt.Errorf("invalid file tree: %w", err)
 		}
+	}
 
-		files[nth] = InfoFile{
-			Length: item["length"].(int),
-			Path:   path,
+	if !i.IsV2() || i.IsHybrid() {
+		if err := i.validatePieces(); err != nil {
+			return err
 		}
 	}
 
-	return files, nil
+	if i.PieceLength&(i.PieceLength-1) != 0 {
+		return fmt.Errorf("%w: %d", ErrPieceLengthNotPowerOfTwo, i.PieceLength)
+	}
+
+	return nil
 }
 
-// NewTorrent creates a Torrent structure from a decoded 'contents' dictionary
-// representing the .torrent file. Returns the structure or an error if any.
-func NewTorrent(contents map[string]any) (*Torrent, error) {
-	info := contents["info"].(map[string]any)
+// validatePieces checks that the v1 piece hashes cover the total length of the
+// torrent.
+func (i *Info) validatePieces() error {
+	if len(i.Pieces)%20 != 0 {
+		return fmt.Errorf("pieces length %d is not a multiple of 20", len(i.Pieces))
+	}
 
-	var files []InfoFile
-	if items, ok := info["files"].([]any); ok {
-		var err error
+	if len(i.Files) == 0 && i.Length < 0 {
+		return fmt.Errorf("length must not be negative, got %d", i.Length)
+	}
 
-		files, err = newInfoFileSlice(items)
-		if err != nil {
-			return nil, fmt.Errorf("could not parse files list: %w", err)
+	for idx, file := range i.Files {
+		if file.Length < 0 {
+			return fmt.Errorf("length of file %d must not be negative, got %d", idx, file.Length)
 		}
 	}
 
-	length, _ := info["length"].(int)
+	numPieces := i.NumPieces()
+	expected := (i.TotalLength() + i.PieceLength - 1) / i.PieceLength
+
+	if int64(numPieces) != expected {
+		return fmt.Errorf("torrent of %d bytes in pieces of %d bytes has %d pieces, but %d piece hashes were given",
+			i.TotalLength(), i.PieceLength, expected, numPieces)
+	}
+
+	return nil
+}
+
+// NewTorrentFromBencode creates a Torrent structure from the bencoded 'contents'
+// of a .torrent file. Unlike NewTorrent, the original bytes of the info dictionary
+// are preserved so that the info hash matches the one used by trackers and peers.
+// The contents must hold a single dictionary, so trailing data returns an error.
+// Only the keys read by NewTorrent are decoded; other keys are checked but skipped.
+//
+// Returns the structure or an error if any.
+func NewTorrentFromBencode(contents string) (*Torrent, error) {
+	return newTorrentFromScanner(&bencode.Scanner{Contents: contents, CurrentIndex: 0})
+}
+
+// newTorrentFromScanner creates a Torrent structure from the .torrent file held
+// by 'scanner', as described by NewTorrentFromBencode.
+func newTorrentFromScanner(scanner *bencode.Scanner) (*Torrent, error) {
+	scanner.AdvanceWhitespace()
+
+	metaInfo, spans, err := bencode.ParseBencodeDictionaryKeys(scanner, metaInfoKeys...)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode meta info dictionary: %w", err)
+	}
+
+	if err := scanner.ExpectEnd(); err != nil {
+		return nil, fmt.Errorf("could not decode meta info dictionary: %w", err)
+	}
+
+	torrent, err := NewTorrent(metaInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	span := spans["info"]
+	torrent.Info.raw = scanner.Contents[span.Start:span.End]
+
+	return torrent, nil
+}
+
+// NewTorrentFromBytes creates a Torrent structure from the bencoded 'contents'
+// of a .torrent file in the same way as NewTorrentFromBencode. The contents are
+// copied, so the caller may reuse them afterwards.
+//
+// Returns the structure or an error if any.
+func NewTorrentFromBytes(contents []byte) (*Torrent, error) {
+	return NewTorrentFromBencode(string(contents))
+}
+
+// NewTorrentFromReader creates a Torrent structure from the bencoded contents of
+// a .torrent file read from 'r' until EOF, in the same way as NewTorrentFromBencode.
+//
+// Returns the structure or an error if any.
+func NewTorrentFromReader(r io.Reader) (*Torrent, error) {
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read torrent file: %w", err)
+	}
+
+	// The contents are not shared with the caller, so they need not be copied.
+	return newTorrentFromScanner(bencode.NewScannerBytes(contents))
+}
+
+// NewInfoFromBencode creates an Info structure from the bencoded 'contents' of
+// an info dictionary, such as metadata fetched from peers. The original bytes
+// are preserved for computing the info hash. The info dictionary is checked in
+// the same way as by NewTorrent.
+//
+// Returns the structure or an error if any.
+func NewInfoFromBencode(contents string) (*Info, error) {
+	var info Info
+	if err := bencode.Unmarshal([]byte(contents), &info); err != nil {
+		return nil, fmt.Errorf("could not parse info dictionary: %w", err)
+	}
+
+	if err := info.Validate(); err != nil && !errors.Is(err, ErrPieceLengthNotPowerOfTwo) {
+		return nil, fmt.Errorf("invalid info dictionary: %w", err)
+	}
+
+	info.raw = contents
 
-	return &Torrent{
-		Info: Info{
-			Name:        info["name"].(string),
-			PieceLength: info["piece length"].(int),
-			Pieces:      info["pieces"].(string),
-			Length:      length,
-			Files:       files,
-		},
-		AnnounceURL: contents["announce"].(string),
-	}, nil
+	return &info, nil
 }
@@ -0,0 +1,359 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aescarias/apricot/torrent/bencode"
+)
+
+func TestHashZeroLengthFile(t *testing.T) {
+	info := Info{Name: "empty", PieceLength: 16384}
+
+	hash, err := info.Hash()
+	if err != nil {
+		t.Fatalf("could not hash info: %v", err)
+	}
+
+	expected := sha1.Sum([]byte("d6:lengthi0e4:name5:empty12:piece lengthi16384e6:pieces0:e"))
+	if hash != expected {
+		t.Errorf("info hash %x does not cover the zero length, expected %x", hash, expected)
+	}
+}
+
+func TestHashMatchesBencodable(t *testing.T) {
+	infos := map[string]Info{
+		"single file": {
+			Name:        "file",
+			PieceLength: 16384,
+			Pieces:      strings.Repeat("a", 40),
+			Length:      20000,
+			Private:     true,
+		},
+		"multiple files": {
+			Name:        "dir",
+			NameUTF8:    "dir",
+			PieceLength: 16384,
+			Pieces:      strings.Repeat("b", 20),
+			Files: []InfoFile{
+				{Length: 0, Path: []string{"empty"}},
+				{Length: 100, Path: []string{"sub", "file"}, PathUTF8: []string{"sub", "file"}},
+			},
+		},
+	}
+
+	for name, info := range infos {
+		t.Run(name, func(t *testing.T) {
+			hash, err := info.Hash()
+			if err != nil {
+				t.Fatalf("could not hash info: %v", err)
+			}
+
+			encoded, err := bencode.EncodeBencode(info.Bencodable())
+			if err != nil {
+				t.Fatalf("could not encode info: %v", err)
+			}
+
+			// Loading the encoded info must hash the same as the info it came from.
+			loaded, err := NewInfoFromBencode(encoded)
+			if err != nil {
+				t.Fatalf("could not load encoded info: %v", err)
+			}
+
+			loadedHash, err := loaded.Hash()
+			if err != nil {
+				t.Fatalf("could not hash loaded info: %v", err)
+			}
+
+			if hash != sha1.Sum([]byte(encoded)) || hash != loadedHash {
+				t.Errorf("info hash %x differs from that of its encoding %x", hash, loadedHash)
+			}
+		})
+	}
+}
+
+// openTestTorrent loads the torrent at 'path' under testdata.
+func openTestTorrent(t *testing.T, path string) *Torrent {
+	t.Helper()
+
+	file, err := os.Open("testdata/" + path)
+	if err != nil {
+		t.Fatalf("could not open test torrent: %v", err)
+	}
+	defer file.Close()
+
+	torrent, err := NewTorrentFromReader(file)
+	if err != nil {
+		t.Fatalf("could not load test torrent: %v", err)
+	}
+
+	return torrent
+}
+
+func TestPieceCounts(t *testing.T) {
+	hundred := openTestTorrent(t, "hundred.torrent")
+
+	contents, err := os.ReadFile("testdata/hundred.bin")
+	if err != nil {
+		t.Fatalf("could not read test data: %v", err)
+	}
+
+	twoPieces := bytes.Repeat([]byte{'a'}, 20000)
+	first, second := sha1.Sum(twoPieces[:16384]), sha1.Sum(twoPieces[16384:])
+
+	tests := []struct {
+		name     string
+		info     Info
+		contents []byte
+		sizes    []int
+	}{
+		{"zero pieces", Info{Name: "empty", PieceLength: 16384}, nil, nil},
+		{"one piece", hundred.Info, contents, []int{100}},
+		{
+			"two pieces",
+			Info{Name: "two", PieceLength: 16384, Length: 20000, Pieces: string(first[:]) + string(second[:])},
+			twoPieces,
+			[]int{16384, 3616},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := test.info
+
+			if err := info.Validate(); err != nil {
+				t.Fatalf("invalid info: %v", err)
+			}
+
+			if info.NumPieces() != len(test.sizes) {
+				t.Errorf("NumPieces returned %d, expected %d", info.NumPieces(), len(test.sizes))
+			}
+
+			hashes := info.PieceHashes()
+			if hashes == nil || len(hashes) != len(test.sizes) {
+				t.Errorf("PieceHashes returned %d hashes, expected %d", len(hashes), len(test.sizes))
+			}
+
+			for index, size := range test.sizes {
+				if info.PieceSize(index) != size {
+					t.Errorf("piece %d has size %d, expected %d", index, info.PieceSize(index), size)
+				}
+			}
+
+			if size := info.PieceSize(len(test.sizes)); size != 0 {
+				t.Errorf("piece past the end has size %d", size)
+			}
+
+			valid, err := info.VerifyFile(bytes.NewReader(test.contents))
+			if err != nil {
+				t.Fatalf("could not verify contents: %v", err)
+			}
+
+			for index, ok := range valid {
+				if !ok {
+					t.Errorf("piece %d failed verification", index)
+				}
+			}
+
+			have := NewBitField(info.NumPieces())
+			have.SetPiece(-1)
+			if have.HasPiece(-1) || have.HasPiece(info.NumPieces()) || have.Count() != 0 {
+				t.Errorf("bit field of %d pieces accepted an out of range piece", info.NumPieces())
+			}
+		})
+	}
+}
+
+func TestLargeFileLength(t *testing.T) {
+	const length int64 = 5000000000
+
+	// A 5 GB file in pieces of 16 MiB has 299 pieces.
+	info := "d6:lengthi5000000000e4:name4:huge12:piece lengthi16777216e6:pieces5980:" + strings.Repeat("x", 5980) + "e"
+
+	torrent, err := NewTorrentFromBencode("d4:info" + info + "e")
+	if err != nil {
+		t.Fatalf("could not load torrent: %v", err)
+	}
+
+	if torrent.Info.Length != length || torrent.Info.TotalLength() != length {
+		t.Errorf("torrent has length %d, expected %d", torrent.Info.TotalLength(), length)
+	}
+
+	if size := torrent.Info.PieceSize(298); size != int(length-298*16777216) {
+		t.Errorf("last piece has size %d", size)
+	}
+}
+
+func TestMarshalInfoRoundTrip(t *testing.T) {
+	info := Info{
+		Name:        "dir",
+		NameUTF8:    "dïr",
+		PieceLength: 16384,
+		Pieces:      strings.Repeat("\x00\xff", 20),
+		Files: []InfoFile{
+			{Length: 16384, Path: []string{"a"}},
+			{Length: 100, Path: []string{"sub", "b"}, PathUTF8: []string{"sub", "ß"}},
+		},
+		Private: true,
+	}
+
+	encoded, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatalf("could not marshal info: %v", err)
+	}
+
+	var decoded Info
+	if err := bencode.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("could not unmarshal info: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, info) {
+		t.Errorf("round trip returned %+v, expected %+v", decoded, info)
+	}
+
+	// Marshal agrees with the encoding the info hash is computed from.
+	hash, err := info.Hash()
+	if err != nil {
+		t.Fatalf("could not hash info: %v", err)
+	}
+
+	if hash != sha1.Sum(encoded) {
+		t.Errorf("info hash %x differs from the hash of the marshaled info", hash)
+	}
+}
+
+func TestPreferUTF8Names(t *testing.T) {
+	// The legacy keys hold the names in Latin-1, as declared by the encoding.
+	contents := "d8:encoding10:ISO-8859-14:infod5:filesld6:lengthi10e4:pathl4:caf\xe9e" +
+		"10:path.utf-8l5:café" + "eed6:lengthi5e4:pathl5:plainee" +
+		"e4:name6:r\xe9sum\xe910:name.utf-88:résumé" +
+		"12:piece lengthi16384e6:pieces20:" + strings.Repeat("x", 20) + "ee"
+
+	torrent, err := NewTorrentFromBencode(contents)
+	if err != nil {
+		t.Fatalf("could not load torrent: %v", err)
+	}
+
+	if name := torrent.Info.PreferredName(); name != "résumé" {
+		t.Errorf("preferred name is %q, expected the UTF-8 name", name)
+	}
+
+	files := torrent.Info.Files
+	if len(files) != 2 {
+		t.Fatalf("torrent has %d files, expected 2", len(files))
+	}
+
+	if path := files[0].PreferredPath(); !slices.Equal(path, []string{"café"}) {
+		t.Errorf("preferred path is %q, expected the UTF-8 path", path)
+	}
+
+	// Files without a UTF-8 path fall back to the legacy path.
+	if path := files[1].PreferredPath(); !slices.Equal(path, []string{"plain"}) {
+		t.Errorf("preferred path is %q, expected the legacy path", path)
+	}
+}
+
+// largeMultiFileTorrent returns a .torrent file of 'numFiles' files of 16 KiB
+// each, with a large unknown key that NewTorrentFromBencode need not decode.
+func largeMultiFileTorrent(b *testing.B, numFiles int) string {
+	files := make([]InfoFile, numFiles)
+	for idx := range files {
+		files[idx] = InfoFile{Length: 16384, Path: []string{"dir", fmt.Sprintf("file%06d", idx)}}
+	}
+
+	unknown := make([]any, numFiles)
+	for idx := range unknown {
+		unknown[idx] = map[string]any{"index": idx, "note": "unused"}
+	}
+
+	encoded, err := bencode.EncodeBencode(map[string]any{
+		"announce": "http://tracker.example.com/announce",
+		"info": (&Info{
+			Name:        "large",
+			PieceLength: 16384,
+			Pieces:      strings.Repeat("x", 20*numFiles),
+			Files:       files,
+		}).Bencodable(),
+		"x-unknown": unknown,
+	})
+	if err != nil {
+		b.Fatalf("could not encode torrent: %v", err)
+	}
+
+	return encoded
+}
+
+func BenchmarkNewTorrentFromBencode(b *testing.B) {
+	contents := largeMultiFileTorrent(b, 20000)
+	b.SetBytes(int64(len(contents)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		if _, err := NewTorrentFromBencode(contents); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeFullTorrent(b *testing.B) {
+	contents := largeMultiFileTorrent(b, 20000)
+	b.SetBytes(int64(len(contents)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		tokens, err := bencode.DecodeBencode(contents)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := NewTorrent(tokens[0].(map[string]any)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAnnounceListRoundTrip(t *testing.T) {
+	announceList := [][]string{
+		{"http://a.example.com/announce", "http://b.example.com/announce", "http://c.example.com/announce",
+			"http://d.example.com/announce", "http://e.example.com/announce", "http://f.example.com/announce"},
+		{},
+		{"udp://g.example.com:6969/announce"},
+	}
+
+	original := Torrent{
+		Info:         *newTestInfo([]byte("apricot"), 16384),
+		AnnounceURL:  "http://a.example.com/announce",
+		AnnounceList: announceList,
+	}
+
+	contents, err := bencode.EncodeBencode(original.Bencodable())
+	if err != nil {
+		t.Fatalf("could not encode torrent: %v", err)
+	}
+
+	torrent, err := NewTorrentFromBencode(contents)
+	if err != nil {
+		t.Fatalf("could not read torrent: %v", err)
+	}
+
+	if !reflect.DeepEqual(torrent.AnnounceList, announceList) {
+		t.Errorf("announce list read as %q, expected the order of the file %q", torrent.AnnounceList, announceList)
+	}
+
+	encoded, err := bencode.EncodeBencode(torrent.Bencodable())
+	if err != nil {
+		t.Fatalf("could not encode torrent: %v", err)
+	}
+
+	if encoded != contents {
+		t.Errorf("torrent encoded as %q, expected %q", encoded, contents)
+	}
+}
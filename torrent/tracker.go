@@ -3,12 +3,22 @@
 package torrent
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aescarias/apricot/torrent/bencode"
 )
@@ -34,11 +44,11 @@ type TrackerRequest struct {
 	// The port number the peer is listening on.
 	Port int
 	// The total amount uploaded so far.
-	Uploaded int
+	Uploaded int64
 	// The total amount downloaded so far.
-	Downloaded int
+	Downloaded int64
 	// The number of bytes this peer still has to download.
-	Left int
+	Left int64
 	// (optional) An announcement to the tracker.
 	//
 	// 'started' announces that the download has just started. 'stopped' announces
@@ -51,12 +61,45 @@ type TrackerRequest struct {
 	// regardless of whether 'compact' is 0 or 1. A tracker may also refuse connections
 	// that use 'compact=0'.
 	Compact int
+	// (optional) The number of peers the client would like to receive. Omitted if zero.
+	NumWant int
+	// (optional) A string not shared with other peers that allows the client to
+	// prove its identity should its IP address change. Omitted if empty.
+	Key string
+	// (optional) Whether the tracker may omit peer IDs in the peer list. Ignored
+	// if the compact format is used.
+	NoPeerId bool
+	// (optional) The tracker ID returned by a previous announce to the same tracker,
+	// which must be sent back in subsequent announces. Omitted if empty.
+	TrackerId string
+	// (optional) Additional query parameters sent to HTTP trackers, such as those
+	// required by some private trackers. Parameters set from the other fields of
+	// the request take precedence over extra parameters with the same key.
+	Extra url.Values
 }
 
 // A TrackerResponse represents the response sent by the announce endpoint.
 type TrackerResponse struct {
 	Interval int           // The interval in seconds to wait before re-requests.
 	Peers    []TrackerPeer // A list of peers
+
+	// (optional) The minimum interval in seconds to wait before re-requests.
+	// Trackers may refuse clients that announce more often than this.
+	MinInterval int
+	// (optional) An ID identifying the client to the tracker, to be sent back as
+	// TrackerRequest.TrackerId in subsequent announces.
+	TrackerId string
+	// (optional) The number of peers with the complete torrent (seeders).
+	Complete int
+	// (optional) The number of peers without the complete torrent (leechers).
+	Incomplete int
+	// (optional) A warning sent by the tracker along with a successful response,
+	// such as to announce that it is being moved or shut down.
+	Warning string
+	// (optional) The peer IDs of the WebTorrent peers that offered a WebRTC
+	// connection through a WebSocket tracker. They have no address and cannot be
+	// dialed, so they are never part of Peers.
+	WebRTCPeers []string
 }
 
 // A TrackerPeer represents a peer returned in the tracker response.
@@ -72,6 +115,8 @@ type ErrFailureReason struct {
 	Message string // The failure reason
 }
 
+// String returns the address of the peer in the form 'host:port', or '[host]:port'
+// if the host is an IPv6 address, suitable for use with net.Dial.
 func (p TrackerPeer) String() string {
 	return net.JoinHostPort(p.Ip, fmt.Sprint(p.Port))
 }
@@ -80,66 +125,483 @@ func (err *ErrFailureReason) Error() string {
 	return err.Message
 }
 
-// GetPeers gets the tracker peers announced by a URL in the announce list.
+// The maximum number of bytes of the response body kept in a TrackerHTTPError.
+const MAX_ERROR_BODY_SIZE = 1024
+
+// A TrackerHTTPError occurs when an HTTP tracker responds with a status other
+// than 200 OK. Callers may use errors.As to inspect the status code, such as to
+// back off on 429 Too Many Requests.
+type TrackerHTTPError struct {
+	StatusCode int    // The HTTP status code, such as 404.
+	Status     string // The HTTP status, such as "404 Not Found".
+	Body       []byte // Up to MAX_ERROR_BODY_SIZE bytes of the response body.
+}
+
+func (err *TrackerHTTPError) Error() string {
+	return fmt.Sprintf("request to tracker returned %s", err.Status)
+}
+
+// decodeTrackerBody decodes the bencoded body of the tracker response 'resp'.
+// Bodies sent with a gzip content encoding are decompressed first, as some
+// trackers compress responses even when the transport did not ask for it.
+func decodeTrackerBody(resp *http.Response) (any, error) {
+	var body io.Reader = resp.Body
+
+	if strings.EqualFold(strings.TrimSpace(resp.Header.Get("Content-Encoding")), "gzip") {
+		reader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress response: %w", err)
+		}
+		defer reader.Close()
+
+		body = reader
+	}
+
+	token, err := bencode.NewDecoder(body).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("could not decode response: %w", err)
+	}
+
+	return token, nil
+}
+
+// newTrackerHTTPError returns a TrackerHTTPError describing 'resp', reading the
+// start of its body for diagnostics.
+func newTrackerHTTPError(resp *http.Response) *TrackerHTTPError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, MAX_ERROR_BODY_SIZE))
+
+	return &TrackerHTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
+}
+
+// The client used for HTTP requests to trackers if the torrent does not specify one.
+var defaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// httpClient returns the client used for HTTP requests to trackers.
+func (t *Torrent) httpClient() *http.Client {
+	if t.HTTPClient != nil {
+		return t.HTTPClient
+	}
+
+	return defaultHTTPClient
+}
+
+// NewTrackerHTTPClient returns a client suitable for Torrent.HTTPClient that
+// uses 'tlsConfig' for HTTPS and secure WebSocket trackers, such as to trust a
+// custom CA pool or pin certificates. Other settings match the default client.
+//
+// Setting InsecureSkipVerify in 'tlsConfig' accepts any certificate, including
+// the self-signed certificates of some private trackers. This exposes the passkey
+// in announce URLs and the peer list to anyone able to intercept the connection,
+// so it should only be used for trackers known to be trustworthy.
+func NewTrackerHTTPClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Timeout: defaultHTTPClient.Timeout, Transport: transport}
+}
+
+// clientTLSConfig returns the TLS configuration of the transport of 'client', or
+// nil if it uses the default configuration.
+func clientTLSConfig(client *http.Client) *tls.Config {
+	if transport, ok := client.Transport.(*http.Transport); ok {
+		return transport.TLSClientConfig
+	}
+
+	return nil
+}
+
+// GetPeers gets the tracker peers announced by the announce URL of the torrent.
 // Returns the tracker response including the peers and an error if any.
 //
-// A tracker may announce peers over TCP, UDP, or WebSockets. Only the former
-// is implemented.
+// A tracker may announce peers over TCP (HTTP), UDP, or WebSockets. WebRTC is
+// not supported, so a WebSocket tracker returns no peers in Peers; the peers
+// offering a WebRTC connection are only listed in WebRTCPeers.
 func (t *Torrent) GetPeers(request TrackerRequest) (*TrackerResponse, error) {
-	announce, err := url.Parse(t.AnnounceURL)
+	return t.GetPeersContext(context.Background(), request)
+}
+
+// GetPeersContext is like GetPeers but aborts the request once 'ctx' is done,
+// in which case the error of the context is returned.
+func (t *Torrent) GetPeersContext(ctx context.Context, request TrackerRequest) (*TrackerResponse, error) {
+	return t.getPeersFrom(ctx, t.AnnounceURL, request)
+}
+
+// GetPeersAny gets the tracker peers from the first tracker in the announce list
+// that responds successfully, walking the tiers in order as described in BEP 12.
+// If the torrent has no announce list, the announce URL is used instead.
+//
+// The URLs of each tier are shuffled on the first request, leaving AnnounceList
+// untouched, and are shuffled again once the trackers of the announce list change.
+// A tracker that responds successfully is moved to the front of its tier so that
+// it is tried first in subsequent requests. Returns the tracker response or the
+// joined errors of every tracker if all of them fail.
+//
+// GetPeersAny may be called concurrently, but not while the trackers are changed
+// with AddTracker or SetTrackers.
+func (t *Torrent) GetPeersAny(request TrackerRequest) (*TrackerResponse, error) {
+	return t.GetPeersAnyContext(context.Background(), request)
+}
+
+// GetPeersAnyContext gets the tracker peers like GetPeersAny, but gives up once
+// 'ctx' is done, in which case the error of the context is returned along with
+// the errors of the trackers tried so far.
+func (t *Torrent) GetPeersAnyContext(ctx context.Context, request TrackerRequest) (*TrackerResponse, error) {
+	var errs []error
+
+	for tierIdx, tier := range t.announceTiers() {
+		for _, announceURL := range tier {
+			if err := ctx.Err(); err != nil {
+				return nil, errors.Join(append(errs, err)...)
+			}
+
+			resp, err := t.getPeersFrom(ctx, announceURL, request)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", announceURL, err))
+				continue
+			}
+
+			t.promoteTracker(tierIdx, announceURL)
+			return resp, nil
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// announceTiers returns a copy of the tiers of trackers tried by GetPeersAnyContext:
+// the non-empty tiers of the announce list with their URLs shuffled, or a single
+// tier holding the announce URL if there are none.
+func (t *Torrent) announceTiers() [][]string {
+	t.announceMu.Lock()
+	defer t.announceMu.Unlock()
+
+	if !sameTrackers(t.announceOrder, t.AnnounceList) {
+		t.announceOrder = nil
+
+		for _, urls := range t.AnnounceList {
+			if len(urls) == 0 {
+				continue
+			}
+
+			tier := slices.Clone(urls)
+			rand.Shuffle(len(tier), func(i, j int) {
+				tier[i], tier[j] = tier[j], tier[i]
+			})
+
+			t.announceOrder = append(t.announceOrder, tier)
+		}
+	}
+
+	if len(t.announceOrder) == 0 {
+		return [][]string{{t.AnnounceURL}}
+	}
+
+	tiers := make([][]string, len(t.announceOrder))
+	for idx, tier := range t.announceOrder {
+		tiers[idx] = slices.Clone(tier)
+	}
+
+	return tiers
+}
+
+// promoteTracker moves 'announceURL' to the front of the tier at index 'tier' of
+// the announce order, if it is still there.
+func (t *Torrent) promoteTracker(tier int, announceURL string) {
+	t.announceMu.Lock()
+	defer t.announceMu.Unlock()
+
+	if tier >= len(t.announceOrder) {
+		return
+	}
+
+	urls := t.announceOrder[tier]
+	if idx := slices.Index(urls, announceURL); idx > 0 {
+		copy(urls[1:idx+1], urls[:idx])
+		urls[0] = announceURL
+	}
+}
+
+// sameTrackers reports whether 'order' holds the URLs of the non-empty tiers of
+// 'tiers', in any order within each tier.
+func sameTrackers(order [][]string, tiers [][]string) bool {
+	var idx int
+
+	for _, urls := range tiers {
+		if len(urls) == 0 {
+			continue
+		}
+
+		if idx >= len(order) || len(order[idx]) != len(urls) {
+			return false
+		}
+
+		for _, announceURL := range urls {
+			if !slices.Contains(order[idx], announceURL) {
+				return false
+			}
+		}
+
+		idx++
+	}
+
+	return idx == len(order)
+}
+
+// SetTrackers replaces the trackers of the torrent with 'urls', overriding both
+// the announce URL and the announce list. Each URL is placed in a tier of its own
+// so that GetPeersAny tries them in order, and duplicate or empty URLs are ignored.
+// The announce URL becomes the first of 'urls', if any.
+func (t *Torrent) SetTrackers(urls []string) {
+	t.AnnounceURL = ""
+	t.AnnounceList = nil
+
+	for _, announceURL := range urls {
+		t.AddTracker(len(t.AnnounceList), announceURL)
+	}
+}
+
+// AddTracker adds the tracker at 'announceURL' to the tier at index 'tier' of the
+// announce list used by GetPeersAny. If 'tier' is past the last tier, a new tier
+// is appended. URLs that are empty or already present in any tier are ignored.
+//
+// If the torrent has no announce list, one is created holding the announce URL
+// as tier 0. If it has no announce URL either, 'announceURL' becomes the announce
+// URL.
+func (t *Torrent) AddTracker(tier int, announceURL string) {
+	announceURL = strings.TrimSpace(announceURL)
+	if len(announceURL) == 0 {
+		return
+	}
+
+	for _, urls := range t.AnnounceList {
+		if slices.Contains(urls, announceURL) {
+			return
+		}
+	}
+
+	if len(t.AnnounceList) == 0 && len(t.AnnounceURL) > 0 {
+		if t.AnnounceURL == announceURL {
+			return
+		}
+
+		t.AnnounceList = [][]string{{t.AnnounceURL}}
+	}
+
+	if len(t.AnnounceURL) == 0 {
+		t.AnnounceURL = announceURL
+	}
+
+	tier = max(tier, 0)
+	if tier >= len(t.AnnounceList) {
+		t.AnnounceList = append(t.AnnounceList, []string{announceURL})
+	} else {
+		t.AnnounceList[tier] = append(t.AnnounceList[tier], announceURL)
+	}
+}
+
+// setAnnounceQuery adds the parameters of 'request' to the query string of the
+// HTTP 'announce' URL, preserving any parameters already present.
+func setAnnounceQuery(announce *url.URL, request TrackerRequest) {
+	query := announce.Query()
+
+	for key, values := range request.Extra {
+		query[key] = values
+	}
+
+	query.Set("info_hash", string(request.InfoHash[:]))
+	query.Set("peer_id", request.PeerId)
+	query.Set("left", fmt.Sprint(request.Left))
+	query.Set("downloaded", fmt.Sprint(request.Downloaded))
+	query.Set("uploaded", fmt.Sprint(request.Uploaded))
+
+	if len(request.Ip) > 0 {
+		query.Set("ip", request.Ip)
+	}
+
+	query.Set("port", fmt.Sprint(request.Port))
+	query.Set("compact", fmt.Sprint(request.Compact))
+
+	if len(request.Event) > 0 && request.Event != EventEmpty {
+		query.Set("event", string(request.Event))
+	}
+
+	if request.NumWant > 0 {
+		query.Set("numwant", fmt.Sprint(request.NumWant))
+	}
+
+	if len(request.Key) > 0 {
+		query.Set("key", request.Key)
+	}
+
+	if request.NoPeerId {
+		query.Set("no_peer_id", "1")
+	}
+
+	if len(request.TrackerId) > 0 {
+		query.Set("trackerid", request.TrackerId)
+	}
+
+	announce.RawQuery = encodeQuery(query)
+}
+
+// encodeQuery encodes 'query' into URL-encoded form sorted by key, like
+// url.Values.Encode, but percent-encodes every byte outside of the unreserved
+// characters of RFC 3986, including spaces. Some trackers reject the '+' used
+// by url.Values.Encode for spaces in binary values such as the info hash.
+func encodeQuery(query url.Values) string {
+	keys := slices.Sorted(maps.Keys(query))
+
+	var builder strings.Builder
+	for _, key := range keys {
+		for _, value := range query[key] {
+			if builder.Len() > 0 {
+				builder.WriteByte('&')
+			}
+
+			builder.WriteString(percentEncode(key))
+			builder.WriteByte('=')
+			builder.WriteString(percentEncode(value))
+		}
+	}
+
+	return builder.String()
+}
+
+// percentEncode escapes every byte of 's' other than the unreserved characters
+// of RFC 3986 (letters, digits, '-', '.', '_' and '~') as '%XX'.
+func percentEncode(s string) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var builder strings.Builder
+	for idx := range len(s) {
+		ch := s[idx]
+
+		switch {
+		case 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '.', ch == '_', ch == '~':
+			builder.WriteByte(ch)
+		default:
+			builder.WriteByte('%')
+			builder.WriteByte(hexDigits[ch>>4])
+			builder.WriteByte(hexDigits[ch&0x0f])
+		}
+	}
+
+	return builder.String()
+}
+
+// getPeersFrom gets the tracker peers announced by 'announceURL', retrying as
+// described by the retry policy of the torrent. Returns the tracker response
+// including the peers and an error if any.
+func (t *Torrent) getPeersFrom(ctx context.Context, announceURL string, request TrackerRequest) (*TrackerResponse, error) {
+	// UDP trackers already retransmit requests following BEP 15.
+	if announce, err := url.Parse(announceURL); err == nil && announce.Scheme == "udp" {
+		return t.getPeersOnce(ctx, announceURL, request)
+	}
+
+	return retry(ctx, t.Retry, loggerOrNop(t.Logger), func() (*TrackerResponse, error) {
+		return t.getPeersOnce(ctx, announceURL, request)
+	})
+}
+
+// ErrInvalidAnnounceURL is returned when an announce URL is empty, cannot be
+// parsed or uses a scheme other than http, https, udp, ws or wss.
+var ErrInvalidAnnounceURL = errors.New("invalid announce url")
+
+// ValidateAnnounceURL checks that 'announceURL' is a URL that trackers can be
+// contacted at: it must not be empty, it must be parseable and have a host, and
+// its scheme must be one of http, https, udp, ws or wss.
+//
+// Returns an error wrapping ErrInvalidAnnounceURL and naming the URL if not.
+func ValidateAnnounceURL(announceURL string) error {
+	if len(announceURL) == 0 {
+		return fmt.Errorf("%w: empty url", ErrInvalidAnnounceURL)
+	}
+
+	announce, err := url.Parse(announceURL)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse url: %w", err)
+		return fmt.Errorf("%w %q: %w", ErrInvalidAnnounceURL, announceURL, err)
 	}
 
 	switch announce.Scheme {
-	case "http", "https":
-		query := announce.Query()
+	case "http", "https", "udp", "ws", "wss":
+	case "":
+		return fmt.Errorf("%w %q: missing scheme", ErrInvalidAnnounceURL, announceURL)
+	default:
+		return fmt.Errorf("%w %q: unsupported scheme %q", ErrInvalidAnnounceURL, announceURL, announce.Scheme)
+	}
 
-		query.Set("info_hash", string(request.InfoHash[:]))
-		query.Set("peer_id", request.PeerId)
-		query.Set("left", fmt.Sprint(request.Left))
-		query.Set("downloaded", fmt.Sprint(request.Downloaded))
-		query.Set("uploaded", fmt.Sprint(request.Uploaded))
+	if len(announce.Host) == 0 {
+		return fmt.Errorf("%w %q: missing host", ErrInvalidAnnounceURL, announceURL)
+	}
 
-		if len(request.Ip) > 0 {
-			query.Set("ip", request.Ip)
-		}
+	return nil
+}
+
+// getPeersOnce gets the tracker peers announced by 'announceURL' in a single
+// request. Returns the tracker response including the peers and an error if any.
+func (t *Torrent) getPeersOnce(ctx context.Context, announceURL string, request TrackerRequest) (*TrackerResponse, error) {
+	if err := ValidateAnnounceURL(announceURL); err != nil {
+		return nil, err
+	}
 
-		query.Set("port", fmt.Sprint(request.Port))
-		query.Set("compact", fmt.Sprint(request.Compact))
+	announce, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse url: %w", err)
+	}
 
-		announce.RawQuery = query.Encode()
+	switch announce.Scheme {
+	case "http", "https":
+		setAnnounceQuery(announce, request)
+	case "udp":
+		return getPeersUDP(ctx, announce, request)
+	case "ws", "wss":
+		return getPeersWebSocket(ctx, announce, request, clientTLSConfig(t.httpClient()))
 	default:
 		return nil, fmt.Errorf("unsupported scheme: %s", announce.Scheme)
 	}
 
-	resp, err := http.Get(announce.String())
+	req, err := http.NewRequestWithContext(ctx, "GET", announce.String(), nil)
 	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+
+	resp, err := t.httpClient().Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
 		return nil, fmt.Errorf("request to tracker failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("request to tracker returned %s", resp.Status)
-	}
-
-	read, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("could not read response: %w", err)
+		return nil, newTrackerHTTPError(resp)
 	}
 
-	tokens, err := bencode.DecodeBencode(string(read))
+	token, err := decodeTrackerBody(resp)
 	if err != nil {
-		return nil, fmt.Errorf("could not decode response: %w", err)
+		return nil, err
 	}
 
-	response, ok := tokens[0].(map[string]any)
+	response, ok := token.(map[string]any)
 	if !ok {
-		return nil, fmt.Errorf("unexpected response type: %v", response)
+		return nil, fmt.Errorf("unexpected response type: %T", token)
 	}
 
 	if failure, ok := response["failure reason"]; ok {
-		return nil, &ErrFailureReason{Message: failure.(string)}
+		message, ok := failure.(string)
+		if !ok {
+			return nil, fmt.Errorf("tracker sent failure reason of unexpected type: %v", failure)
+		}
+
+		return nil, &ErrFailureReason{Message: message}
+	}
+
+	interval, ok := response["interval"].(int64)
+	if !ok {
+		return nil, fmt.Errorf("tracker sent missing or invalid interval: %v", response["interval"])
 	}
 
 	var peerList []TrackerPeer
@@ -151,37 +613,238 @@ func (t *Torrent) GetPeers(request TrackerRequest) (*TrackerResponse, error) {
 				return nil, fmt.Errorf("peer of unexpected type: %v", peer)
 			}
 
-			peerList = append(peerList, TrackerPeer{
-				Ip:     peer["ip"].(string),
-				Port:   peer["port"].(int),
-				PeerId: peer["peer id"].(string),
-			})
+			trackerPeer, err := dictToPeer(peer)
+			if err != nil {
+				return nil, err
+			}
+
+			peerList = append(peerList, trackerPeer)
 		}
 	case string:
-		peerList = compactToPeerList(peers)
+		peerList, err = compactToPeerList(peers)
+		if err != nil {
+			return nil, err
+		}
+	case nil:
+		// The tracker may only send IPv6 peers.
 	default:
 		return nil, fmt.Errorf("unknown peer list kind: %v", peers)
 	}
 
-	return &TrackerResponse{
-		Interval: response["interval"].(int),
+	if peers6, ok := response["peers6"].(string); ok {
+		peerList6, err := compactToPeerList6(peers6)
+		if err != nil {
+			return nil, err
+		}
+
+		peerList = append(peerList, peerList6...)
+	}
+
+	trackerResponse := &TrackerResponse{
+		Interval: int(interval),
 		Peers:    peerList,
-	}, nil
+	}
+
+	if minInterval, ok := response["min interval"].(int64); ok {
+		trackerResponse.MinInterval = int(minInterval)
+	}
+
+	if trackerId, ok := response["tracker id"].(string); ok {
+		trackerResponse.TrackerId = trackerId
+	}
+
+	if complete, ok := response["complete"].(int64); ok {
+		trackerResponse.Complete = int(complete)
+	}
+
+	if incomplete, ok := response["incomplete"].(int64); ok {
+		trackerResponse.Incomplete = int(incomplete)
+	}
+
+	if warning, ok := response["warning message"].(string); ok {
+		trackerResponse.Warning = warning
+	}
+
+	return trackerResponse, nil
+}
+
+// dictToPeer converts a peer in the dictionary model of the peer list into a
+// tracker peer.
+//
+// The IP may be an IPv4 address, an IPv6 address with or without brackets, or
+// a DNS name, which is resolved when dialing the peer. The port may be an integer
+// or a string holding one, as sent by some trackers, and the peer ID may be absent.
+// Returns an error if a key holds a value of an unexpected type.
+func dictToPeer(peer map[string]any) (TrackerPeer, error) {
+	ip, ok := peer["ip"].(string)
+	if !ok {
+		return TrackerPeer{}, fmt.Errorf("peer has invalid ip: %v", peer["ip"])
+	}
+
+	ip = normalizePeerIp(ip)
+	if len(ip) == 0 {
+		return TrackerPeer{}, fmt.Errorf("peer has empty ip")
+	}
+
+	var port int
+	switch value := peer["port"].(type) {
+	case int64:
+		port = int(value)
+	case string:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return TrackerPeer{}, fmt.Errorf("peer %s has invalid port %q", ip, value)
+		}
+
+		port = parsed
+	default:
+		return TrackerPeer{}, fmt.Errorf("peer %s has invalid port: %v", ip, value)
+	}
+
+	if port < 0 || port > 65535 {
+		return TrackerPeer{}, fmt.Errorf("peer %s has port %d out of range", ip, port)
+	}
+
+	var peerId string
+	switch value := peer["peer id"].(type) {
+	case string:
+		peerId = value
+	case nil:
+		// The tracker may omit peer IDs, such as when no_peer_id is set.
+	default:
+		return TrackerPeer{}, fmt.Errorf("peer %s has invalid peer id: %v", ip, value)
+	}
+
+	return TrackerPeer{Ip: ip, Port: port, PeerId: peerId}, nil
+}
+
+// normalizePeerIp returns the host 'ip' from the dictionary model of the peer
+// list in the form expected by TrackerPeer. Surrounding whitespace and the
+// brackets of IPv6 addresses are removed and IP addresses are put into their
+// canonical form, so that net.JoinHostPort produces a dialable address. DNS
+// names are returned unchanged.
+func normalizePeerIp(ip string) string {
+	ip = strings.TrimSpace(ip)
+
+	if strings.HasPrefix(ip, "[") && strings.HasSuffix(ip, "]") {
+		ip = ip[1 : len(ip)-1]
+	}
+
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+
+	return ip
 }
 
 // compactToPeerList decompress a peer list in compact format into a slice of tracker peers.
-func compactToPeerList(format string) []TrackerPeer {
+//
+// Each peer is 6 bytes long: a 4-byte IPv4 address followed by a 2-byte port.
+// Returns an error if the length of the list is not a multiple of 6.
+func compactToPeerList(format string) ([]TrackerPeer, error) {
+	return decodeCompactPeers(format, net.IPv4len)
+}
+
+// compactToPeerList6 decompress an IPv6 peer list in compact format (BEP 7) into a
+// slice of tracker peers.
+//
+// Each peer is 18 bytes long: a 16-byte IPv6 address followed by a 2-byte port.
+// Returns an error if the length of the list is not a multiple of 18.
+func compactToPeerList6(format string) ([]TrackerPeer, error) {
+	return decodeCompactPeers(format, net.IPv6len)
+}
+
+// decodeCompactPeers decodes a compact peer list where each address is 'ipLen'
+// bytes long and is followed by a 2-byte port.
+func decodeCompactPeers(format string, ipLen int) ([]TrackerPeer, error) {
+	entryLen := ipLen + 2
+	if len(format)%entryLen != 0 {
+		return nil, fmt.Errorf("compact peer list length %d is not a multiple of %d", len(format), entryLen)
+	}
+
 	var peerList []TrackerPeer
 
-	for idx := 0; idx < len(format); idx += 6 {
-		ipBytes := []byte(format[idx : idx+4])
-		portBytes := []byte(format[idx+4 : idx+6])
+	for idx := 0; idx < len(format); idx += entryLen {
+		ip := net.IP([]byte(format[idx : idx+ipLen]))
+		portInt := binary.BigEndian.Uint16([]byte(format[idx+ipLen : idx+entryLen]))
+
+		peerList = append(peerList, TrackerPeer{Port: int(portInt), Ip: ip.String()})
+	}
+
+	return peerList, nil
+}
+
+// PeersToCompact encodes 'peers' in compact format, the inverse of the peer list
+// sent by trackers: each peer is 6 bytes long, a 4-byte IPv4 address followed by
+// a 2-byte port. Returns an error if the address of a peer is not an IPv4
+// address or its port is out of range.
+func PeersToCompact(peers []TrackerPeer) (string, error) {
+	return encodeCompactPeers(peers, net.IPv4len)
+}
+
+// PeersToCompact6 encodes 'peers' in the IPv6 compact format (BEP 7): each peer
+// is 18 bytes long, a 16-byte IPv6 address followed by a 2-byte port. Returns an
+// error if the address of a peer is not an IPv6 address or its port is out of
+// range.
+func PeersToCompact6(peers []TrackerPeer) (string, error) {
+	return encodeCompactPeers(peers, net.IPv6len)
+}
+
+// encodeCompactPeers encodes 'peers' in compact format where each address is
+// 'ipLen' bytes long and is followed by a 2-byte port.
+func encodeCompactPeers(peers []TrackerPeer, ipLen int) (string, error) {
+	compact := make([]byte, 0, len(peers)*(ipLen+2))
 
-		portInt := binary.BigEndian.Uint16(portBytes)
-		ip := fmt.Sprintf("%d.%d.%d.%d", ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3])
+	for _, peer := range peers {
+		ip := net.ParseIP(peer.Ip)
+		if ip == nil {
+			return "", fmt.Errorf("peer %s has invalid ip", peer)
+		}
 
-		peerList = append(peerList, TrackerPeer{Port: int(portInt), Ip: ip})
+		if peer.Port < 0 || peer.Port > 65535 {
+			return "", fmt.Errorf("peer %s has port %d out of range", peer, peer.Port)
+		}
+
+		ip4 := ip.To4()
+		if ipLen == net.IPv4len && ip4 == nil {
+			return "", fmt.Errorf("peer %s is not an IPv4 peer", peer)
+		} else if ipLen == net.IPv6len && ip4 != nil {
+			return "", fmt.Errorf("peer %s is not an IPv6 peer", peer)
+		}
+
+		if ip4 != nil {
+			ip = ip4
+		}
+
+		compact = append(compact, ip...)
+		compact = binary.BigEndian.AppendUint16(compact, uint16(peer.Port))
 	}
 
-	return peerList
+	return string(compact), nil
+}
+
+// peersToCompact encodes 'peers' in compact format, returning the IPv4 peers
+// (6 bytes each) and IPv6 peers (18 bytes each) as separate lists. Peers whose
+// address is not a valid IP or whose port is out of range are skipped.
+func peersToCompact(peers []TrackerPeer) (string, string) {
+	var peers4, peers6 []TrackerPeer
+
+	for _, peer := range peers {
+		ip := net.ParseIP(peer.Ip)
+		if ip == nil || peer.Port < 0 || peer.Port > 65535 {
+			continue
+		}
+
+		if ip.To4() != nil {
+			peers4 = append(peers4, peer)
+		} else {
+			peers6 = append(peers6, peer)
+		}
+	}
+
+	// Neither list can fail to encode, as every remaining peer is valid.
+	compact, _ := PeersToCompact(peers4)
+	compact6, _ := PeersToCompact6(peers6)
+
+	return compact, compact6
 }
@@ -0,0 +1,166 @@
+/* Reachability checks for the trackers of a torrent. */
+
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The time allowed for each tracker to respond to a reachability probe.
+const trackerProbeTimeout = 10 * time.Second
+
+// A TrackerState represents the outcome of a tracker reachability probe.
+type TrackerState int
+
+const (
+	TrackerOK          TrackerState = iota // The tracker responded successfully.
+	TrackerFailure                         // The tracker responded with a failure reason.
+	TrackerTimeout                         // The tracker did not respond in time.
+	TrackerUnreachable                     // The tracker could not be contacted or sent an invalid response.
+)
+
+// A TrackerStatus represents the result of probing a single tracker.
+type TrackerStatus struct {
+	URL   string       // The announce URL of the tracker.
+	State TrackerState // The outcome of the probe.
+	Err   error        // If the state is not TrackerOK, the error that occurred.
+}
+
+func (s TrackerState) String() string {
+	switch s {
+	case TrackerOK:
+		return "ok"
+	case TrackerFailure:
+		return "failure"
+	case TrackerTimeout:
+		return "timeout"
+	case TrackerUnreachable:
+		return "unreachable"
+	default:
+		return fmt.Sprintf("TrackerState(%d)", int(s))
+	}
+}
+
+// Trackers returns every announce URL of the torrent, in tier order and without
+// duplicates. The announce URL is included if it is not part of the announce list.
+func (t *Torrent) Trackers() []string {
+	var trackers []string
+
+	for _, tier := range t.AnnounceList {
+		for _, announceURL := range tier {
+			if !slices.Contains(trackers, announceURL) {
+				trackers = append(trackers, announceURL)
+			}
+		}
+	}
+
+	if len(t.AnnounceURL) > 0 && !slices.Contains(trackers, t.AnnounceURL) {
+		trackers = append([]string{t.AnnounceURL}, trackers...)
+	}
+
+	return trackers
+}
+
+// CheckTrackers probes every tracker of the torrent concurrently and reports
+// whether it is reachable. Returns a status for each tracker in the order given
+// by Trackers and an error if the probes could not be prepared.
+//
+// The probe is a lightweight exchange with a short timeout: the announce in
+// 'request' for HTTP trackers, whose response is checked like in GetPeers, a
+// connect request for UDP trackers and the opening handshake for WebSocket
+// trackers. If the info hash of 'request' is zero, the info hash of the torrent
+// is used.
+func (t *Torrent) CheckTrackers(ctx context.Context, request TrackerRequest) ([]TrackerStatus, error) {
+	if request.InfoHash == [20]byte{} {
+		infoHash, err := t.Info.Hash()
+		if err != nil {
+			return nil, fmt.Errorf("could not get info hash: %w", err)
+		}
+
+		request.InfoHash = infoHash
+	}
+
+	trackers := t.Trackers()
+	statuses := make([]TrackerStatus, len(trackers))
+
+	var wg sync.WaitGroup
+	for idx, announceURL := range trackers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			probeCtx, cancel := context.WithTimeout(ctx, trackerProbeTimeout)
+			defer cancel()
+
+			err := t.probeTracker(probeCtx, announceURL, request)
+			statuses[idx] = TrackerStatus{URL: announceURL, State: trackerState(err), Err: err}
+		}()
+	}
+
+	wg.Wait()
+	return statuses, nil
+}
+
+// trackerState classifies the error returned by a tracker probe.
+func trackerState(err error) TrackerState {
+	var failure *ErrFailureReason
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return TrackerOK
+	case errors.As(err, &failure):
+		return TrackerFailure
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errUDPTimeout):
+		return TrackerTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return TrackerTimeout
+	default:
+		return TrackerUnreachable
+	}
+}
+
+// probeTracker performs a reachability probe against 'announceURL' using the
+// parameters in 'request'. Returns an error if the tracker is not usable.
+func (t *Torrent) probeTracker(ctx context.Context, announceURL string, request TrackerRequest) error {
+	announce, err := url.Parse(announceURL)
+	if err != nil {
+		return fmt.Errorf("could not parse url: %w", err)
+	}
+
+	deadline, _ := ctx.Deadline()
+
+	switch announce.Scheme {
+	case "http", "https":
+		_, err := t.getPeersOnce(ctx, announceURL, request)
+		return err
+	case "udp":
+		var dialer net.Dialer
+
+		conn, err := dialer.DialContext(ctx, "udp", announce.Host)
+		if err != nil {
+			return fmt.Errorf("could not connect to tracker: %w", err)
+		}
+		defer conn.Close()
+
+		_, err = udpConnect(conn, time.Until(deadline))
+		return err
+	case "ws", "wss":
+		ws, err := dialWebSocket(ctx, announce, clientTLSConfig(t.httpClient()))
+		if err != nil {
+			return err
+		}
+
+		return ws.Close()
+	default:
+		return fmt.Errorf("unsupported scheme: %s", announce.Scheme)
+	}
+}
@@ -0,0 +1,85 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckTrackers(t *testing.T) {
+	responsiveTracker := &testTracker{Interval: 1800, Compact: true}
+	responsive := httptest.NewServer(responsiveTracker)
+	defer responsive.Close()
+
+	// A successful reply without an interval is rejected like in GetPeers.
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d5:peers0:e"))
+	}))
+	defer invalid.Close()
+
+	failing := httptest.NewServer(&testTracker{FailureReason: "unregistered"})
+	defer failing.Close()
+
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer stalled.Close()
+
+	// A port that was just released has nothing listening on it.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	dead := "http://" + listener.Addr().String() + "/announce"
+	listener.Close()
+
+	expected := map[string]TrackerState{
+		responsive.URL + "/announce": TrackerOK,
+		failing.URL + "/announce":    TrackerFailure,
+		invalid.URL + "/announce":    TrackerUnreachable,
+		stalled.URL + "/announce":    TrackerTimeout,
+		dead:                         TrackerUnreachable,
+	}
+
+	torrent := &Torrent{
+		Info: Info{Name: "test", PieceLength: 16384},
+		AnnounceList: [][]string{
+			{responsive.URL + "/announce", failing.URL + "/announce", invalid.URL + "/announce"},
+			{stalled.URL + "/announce"},
+			{dead},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	statuses, err := torrent.CheckTrackers(ctx, TrackerRequest{PeerId: "-AP0000-000000000001", Port: 51413})
+	if err != nil {
+		t.Fatalf("could not check trackers: %v", err)
+	}
+
+	if len(statuses) != len(expected) {
+		t.Fatalf("got %d statuses, expected %d", len(statuses), len(expected))
+	}
+
+	for _, status := range statuses {
+		if state := expected[status.URL]; status.State != state {
+			t.Errorf("tracker %s reported as %s (%v), expected %s", status.URL, status.State, status.Err, state)
+		}
+	}
+
+	// The probe announces with the peer id of the caller and the info hash of
+	// the torrent.
+	infoHash, err := torrent.Info.Hash()
+	if err != nil {
+		t.Fatalf("could not hash info: %v", err)
+	}
+
+	query := responsiveTracker.Requests()[0].URL.Query()
+	if query.Get("peer_id") != "-AP0000-000000000001" || query.Get("info_hash") != string(infoHash[:]) {
+		t.Errorf("probe announced with peer id %q and info hash %x", query.Get("peer_id"), query.Get("info_hash"))
+	}
+}
@@ -0,0 +1,363 @@
+package torrent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetPeersAnyContextTimeout(t *testing.T) {
+	// A UDP tracker that never answers would otherwise be retried for hours.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer conn.Close()
+
+	deadTracker := "udp://" + conn.LocalAddr().String() + "/announce"
+	torrent := &Torrent{AnnounceList: [][]string{{deadTracker}, {deadTracker + "?second"}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = torrent.GetPeersAnyContext(ctx, TrackerRequest{PeerId: "-AP0000-000000000000"})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("GetPeersAnyContext returned after %s", elapsed)
+	}
+}
+
+func TestGetPeersMalformedResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing interval", "d5:peers0:e"},
+		{"string interval", "d8:interval4:1800e"},
+		{"integer failure reason", "d14:failure reasoni1ee"},
+		{"not a dictionary", "li1ee"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			torrent := &Torrent{AnnounceURL: server.URL + "/announce"}
+			if _, err := torrent.GetPeers(TrackerRequest{}); err == nil {
+				t.Errorf("GetPeers accepted response %q", test.body)
+			}
+		})
+	}
+}
+
+func TestGetPeersFailureReason(t *testing.T) {
+	torrent := serveTestTracker(t, &testTracker{FailureReason: "not found"})
+	_, err := torrent.GetPeers(TrackerRequest{})
+
+	var failure *ErrFailureReason
+	if !errors.As(err, &failure) || failure.Message != "not found" {
+		t.Errorf("expected failure reason %q, got %v", "not found", err)
+	}
+}
+
+func TestGetPeersCompactPeers(t *testing.T) {
+	peers := []TrackerPeer{
+		{Ip: "127.0.0.1", Port: 6881},
+		{Ip: "10.0.0.2", Port: 51413},
+		{Ip: "2001:db8::1", Port: 6882},
+	}
+
+	server := NewTestTracker(peers, 1800)
+	defer server.Close()
+
+	torrent := &Torrent{AnnounceURL: server.URL + "/announce"}
+
+	resp, err := torrent.GetPeers(TrackerRequest{})
+	if err != nil {
+		t.Fatalf("could not get peers: %v", err)
+	}
+
+	if resp.Interval != 1800 {
+		t.Errorf("got interval %d, expected 1800", resp.Interval)
+	}
+
+	if !reflect.DeepEqual(resp.Peers, peers) {
+		t.Errorf("got peers %+v, expected %+v", resp.Peers, peers)
+	}
+}
+
+func TestGetPeersDictionaryPeers(t *testing.T) {
+	peers := []TrackerPeer{
+		{Ip: "127.0.0.1", Port: 6881, PeerId: "-AP0000-000000000001"},
+		{Ip: "127.0.0.2", Port: 6882}, // no peer id
+		{Ip: "2001:db8::1", Port: 6883, PeerId: "-AP0000-000000000003"},
+	}
+
+	torrent := serveTestTracker(t, &testTracker{Peers: peers, Interval: 900, WarningMessage: "moving soon"})
+
+	resp, err := torrent.GetPeers(TrackerRequest{})
+	if err != nil {
+		t.Fatalf("could not get peers: %v", err)
+	}
+
+	if resp.Interval != 900 || resp.Warning != "moving soon" {
+		t.Errorf("got interval %d and warning %q", resp.Interval, resp.Warning)
+	}
+
+	if !reflect.DeepEqual(resp.Peers, peers) {
+		t.Errorf("got peers %+v, expected %+v", resp.Peers, peers)
+	}
+}
+
+func TestDictToPeer(t *testing.T) {
+	tests := []struct {
+		name     string
+		peer     map[string]any
+		expected TrackerPeer
+	}{
+		{"integer port", map[string]any{"ip": "127.0.0.1", "port": int64(6881)}, TrackerPeer{Ip: "127.0.0.1", Port: 6881}},
+		{"string port", map[string]any{"ip": "127.0.0.2", "port": "6882"}, TrackerPeer{Ip: "127.0.0.2", Port: 6882}},
+		{"peer id", map[string]any{"ip": "127.0.0.3", "port": int64(6883), "peer id": "-AP0000-000000000003"},
+			TrackerPeer{Ip: "127.0.0.3", Port: 6883, PeerId: "-AP0000-000000000003"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peer, err := dictToPeer(test.peer)
+			if err != nil {
+				t.Fatalf("could not convert %v: %v", test.peer, err)
+			}
+
+			if peer != test.expected {
+				t.Errorf("converted %v to %+v, expected %+v", test.peer, peer, test.expected)
+			}
+		})
+	}
+}
+
+func TestDictToPeerInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		peer map[string]any
+	}{
+		{"missing ip", map[string]any{"port": int64(6881)}},
+		{"integer ip", map[string]any{"ip": int64(1), "port": int64(6881)}},
+		{"empty ip", map[string]any{"ip": " ", "port": int64(6881)}},
+		{"missing port", map[string]any{"ip": "127.0.0.1"}},
+		{"non-numeric port", map[string]any{"ip": "127.0.0.1", "port": "http"}},
+		{"list port", map[string]any{"ip": "127.0.0.1", "port": []any{}}},
+		{"port out of range", map[string]any{"ip": "127.0.0.1", "port": "70000"}},
+		{"integer peer id", map[string]any{"ip": "127.0.0.1", "port": int64(6881), "peer id": int64(1)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if peer, err := dictToPeer(test.peer); err == nil {
+				t.Errorf("accepted %v as %+v", test.peer, peer)
+			}
+		})
+	}
+}
+
+func TestAnnounceQueryEncoding(t *testing.T) {
+	infoHash := [20]byte([]byte(" +-._~aZ09\x00\xff/?&=%\x7f\x80\x01"))
+
+	tracker := &testTracker{Interval: 1800, Compact: true}
+	torrent := serveTestTracker(t, tracker)
+
+	if _, err := torrent.GetPeers(TrackerRequest{InfoHash: infoHash, PeerId: "-AP0000-00000000 +01"}); err != nil {
+		t.Fatalf("could not announce: %v", err)
+	}
+
+	rawQuery := tracker.Requests()[0].URL.RawQuery
+
+	expected := []string{
+		"info_hash=%20%2B-._~aZ09%00%FF%2F%3F%26%3D%25%7F%80%01",
+		"peer_id=-AP0000-00000000%20%2B01",
+	}
+
+	for _, param := range expected {
+		if !slices.Contains(strings.Split(rawQuery, "&"), param) {
+			t.Errorf("query %q does not contain %q", rawQuery, param)
+		}
+	}
+}
+
+func TestDictToPeerIPv6(t *testing.T) {
+	tests := map[string]string{
+		"2001:db8::1":   "[2001:db8::1]:6881",
+		"[2001:db8::1]": "[2001:db8::1]:6881",
+		"2001:0db8:0000:0000:0000:0000:0000:0001": "[2001:db8::1]:6881",
+		" 2001:db8::1 ":    "[2001:db8::1]:6881",
+		"::ffff:127.0.0.1": "127.0.0.1:6881",
+		"peer.example.com": "peer.example.com:6881",
+	}
+
+	for ip, expected := range tests {
+		t.Run(ip, func(t *testing.T) {
+			peer, err := dictToPeer(map[string]any{"ip": ip, "port": int64(6881)})
+			if err != nil {
+				t.Fatalf("could not parse peer: %v", err)
+			}
+
+			if peer.String() != expected {
+				t.Errorf("peer with ip %q has address %q, expected %q", ip, peer.String(), expected)
+			}
+		})
+	}
+}
+
+func TestDictToPeerIPv6Dial(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	peer, err := dictToPeer(map[string]any{"ip": "0:0:0:0:0:0:0:1", "port": int64(port)})
+	if err != nil {
+		t.Fatalf("could not parse peer: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", peer.String())
+	if err != nil {
+		t.Fatalf("could not dial %s: %v", peer, err)
+	}
+	conn.Close()
+}
+
+func TestGetPeersGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte("d8:intervali900e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	writer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Sent compressed regardless of the Accept-Encoding of the request.
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	torrent := &Torrent{AnnounceURL: server.URL + "/announce"}
+
+	resp, err := torrent.GetPeers(TrackerRequest{Compact: 1})
+	if err != nil {
+		t.Fatalf("could not get peers: %v", err)
+	}
+
+	if resp.Interval != 900 || len(resp.Peers) != 1 || resp.Peers[0].String() != "127.0.0.1:6881" {
+		t.Errorf("decompressed response as %+v", resp)
+	}
+}
+
+func TestGetPeersInvalidGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer server.Close()
+
+	torrent := &Torrent{AnnounceURL: server.URL + "/announce"}
+	if _, err := torrent.GetPeers(TrackerRequest{}); err == nil {
+		t.Errorf("accepted a response that is not gzip-encoded")
+	}
+}
+
+func TestGetPeersAnyKeepsAnnounceList(t *testing.T) {
+	failingTracker := &testTracker{FailureReason: "unavailable"}
+	failing := httptest.NewServer(failingTracker)
+	defer failing.Close()
+
+	responsive := NewTestTracker(nil, 1800)
+	defer responsive.Close()
+
+	var tier []string
+	for idx := range 5 {
+		tier = append(tier, failing.URL+"/announce?"+strconv.Itoa(idx))
+	}
+	tier = append(tier, responsive.URL+"/announce")
+
+	torrent := &Torrent{AnnounceList: [][]string{{}, tier}}
+	announceList := [][]string{{}, slices.Clone(tier)}
+
+	for range 3 {
+		if _, err := torrent.GetPeersAny(TrackerRequest{}); err != nil {
+			t.Fatalf("could not get peers: %v", err)
+		}
+
+		if !reflect.DeepEqual(torrent.AnnounceList, announceList) {
+			t.Fatalf("announce list changed to %q", torrent.AnnounceList)
+		}
+	}
+
+	// Once found, the responsive tracker is tried first.
+	failures := len(failingTracker.Requests())
+	if failures > 5 {
+		t.Errorf("failing trackers were asked %d times", failures)
+	}
+
+	// A tracker added later is tried with the others.
+	torrent.AddTracker(0, failing.URL+"/announce?new")
+
+	if _, err := torrent.GetPeersAny(TrackerRequest{}); err != nil {
+		t.Fatalf("could not get peers: %v", err)
+	}
+
+	if len(failingTracker.Requests()) == failures {
+		t.Errorf("the added tracker was not tried")
+	}
+}
+
+func TestGetPeersAnyConcurrent(t *testing.T) {
+	failing := httptest.NewServer(&testTracker{FailureReason: "unavailable"})
+	defer failing.Close()
+
+	responsive := NewTestTracker(nil, 1800)
+	defer responsive.Close()
+
+	torrent := &Torrent{AnnounceList: [][]string{{
+		failing.URL + "/announce?1",
+		responsive.URL + "/announce?1",
+		failing.URL + "/announce?2",
+		responsive.URL + "/announce?2",
+	}}}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range 10 {
+				if _, err := torrent.GetPeersAny(TrackerRequest{}); err != nil {
+					t.Errorf("could not get peers: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,252 @@
+/*
+Torrent implementation dealing with UDP trackers.
+
+See https://bittorrent.org/beps/bep_0015.html
+*/
+
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	udpProtocolId    = 0x41727101980    // Magic constant identifying the UDP tracker protocol.
+	udpBaseTimeout   = 15 * time.Second // Timeout before the first retransmission.
+	udpMaxDuration   = time.Minute      // Longest time spent on an announce, including retransmissions.
+	udpConnectionTTL = time.Minute      // How long a connection ID remains valid.
+	udpMaxPacketSize = 64 * 1024        // Larger than any UDP payload, so responses are never truncated.
+)
+
+// A udpAction represents the action field of a UDP tracker packet.
+type udpAction uint32
+
+const (
+	udpActionConnect udpAction = iota
+	udpActionAnnounce
+	udpActionScrape
+	udpActionError
+)
+
+// errUDPTimeout is returned by udpExchange when no matching response arrives in time.
+var errUDPTimeout = errors.New("udp tracker request timed out")
+
+// udpEvent returns the numeric value of a tracker event used by the UDP protocol.
+func udpEvent(event TrackerEvent) uint32 {
+	switch event {
+	case EventCompleted:
+		return 1
+	case EventStarted:
+		return 2
+	case EventStopped:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// udpKey converts the key of a tracker request into the 32-bit key used by the
+// UDP protocol. An empty key is sent as zero.
+func udpKey(key string) uint32 {
+	if len(key) == 0 {
+		return 0
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32()
+}
+
+// udpNumWant returns the num want field for 'numWant', where -1 (the default)
+// lets the tracker decide.
+func udpNumWant(numWant int) uint32 {
+	if numWant <= 0 {
+		return 0xFFFFFFFF
+	}
+
+	return uint32(numWant)
+}
+
+// udpExchange sends the 'packet' for 'action' with transaction ID 'transactionId'
+// and waits up to 'timeout' for a response carrying the same transaction ID.
+//
+// Returns the response packet or an error if any. errUDPTimeout is returned if
+// no response is received in time and an ErrFailureReason if the tracker
+// responded with an error.
+func udpExchange(conn net.Conn, packet []byte, action udpAction, transactionId uint32, timeout time.Duration) ([]byte, error) {
+	if _, err := conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("could not send packet: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, udpMaxPacketSize)
+
+	for {
+		read, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, errUDPTimeout
+			}
+
+			return nil, fmt.Errorf("could not read packet: %w", err)
+		}
+
+		response := buf[:read]
+		if len(response) < 8 || binary.BigEndian.Uint32(response[4:8]) != transactionId {
+			continue // not the response we are waiting for
+		}
+
+		switch received := udpAction(binary.BigEndian.Uint32(response[0:4])); received {
+		case udpActionError:
+			return nil, &ErrFailureReason{Message: string(response[8:])}
+		case action:
+			return response, nil
+		default:
+			return nil, fmt.Errorf("unexpected action %d in response", received)
+		}
+	}
+}
+
+// udpConnect performs the connect exchange with the tracker on 'conn', waiting
+// up to 'timeout' for a response. Returns the connection ID or an error if any.
+func udpConnect(conn net.Conn, timeout time.Duration) (uint64, error) {
+	transactionId := rand.Uint32()
+
+	packet := binary.BigEndian.AppendUint64([]byte{}, udpProtocolId)
+	packet = binary.BigEndian.AppendUint32(packet, uint32(udpActionConnect))
+	packet = binary.BigEndian.AppendUint32(packet, transactionId)
+
+	response, err := udpExchange(conn, packet, udpActionConnect, transactionId, timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(response) < 16 {
+		return 0, fmt.Errorf("connect response too short: %d bytes", len(response))
+	}
+
+	return binary.BigEndian.Uint64(response[8:16]), nil
+}
+
+// getPeersUDP announces to the UDP tracker at 'announce' and returns the
+// tracker response or an error if any.
+//
+// Requests are retransmitted following the schedule in BEP 15, waiting
+// 15 * 2^n seconds for a response before each retransmission, but the whole
+// exchange gives up after udpMaxDuration so that a dead tracker does not block
+// for hours.
+//
+// The exchange is aborted once 'ctx' is done, in which case the error of the
+// context is returned.
+func getPeersUDP(ctx context.Context, announce *url.URL, request TrackerRequest) (*TrackerResponse, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "udp", announce.Host)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to tracker: %w", err)
+	}
+	defer conn.Close()
+
+	// Closing the connection unblocks any pending read.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	response, err := announceUDP(conn, request, time.Now().Add(udpMaxDuration))
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return response, err
+}
+
+// announceUDP performs the connect and announce exchanges with the tracker on
+// 'conn', retransmitting until 'deadline'. Peers are decoded as IPv6 addresses
+// if the tracker is reached over IPv6. Returns the tracker response or an error
+// if any; errUDPTimeout is returned once the deadline passes.
+func announceUDP(conn net.Conn, request TrackerRequest, deadline time.Time) (*TrackerResponse, error) {
+	var connectionId uint64
+	var connectedAt time.Time
+	var err error
+
+	decodePeers := compactToPeerList
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		decodePeers = compactToPeerList6
+	}
+
+	for attempt := 0; ; attempt++ {
+		timeout := min(udpBaseTimeout<<attempt, time.Until(deadline))
+		if timeout <= 0 {
+			return nil, errUDPTimeout
+		}
+
+		if connectedAt.IsZero() || time.Since(connectedAt) > udpConnectionTTL {
+			connectionId, err = udpConnect(conn, timeout)
+			if err == errUDPTimeout {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			connectedAt = time.Now()
+		}
+
+		transactionId := rand.Uint32()
+
+		var ip uint32
+		if parsed := net.ParseIP(request.Ip).To4(); parsed != nil {
+			ip = binary.BigEndian.Uint32(parsed)
+		}
+
+		packet := binary.BigEndian.AppendUint64([]byte{}, connectionId)
+		packet = binary.BigEndian.AppendUint32(packet, uint32(udpActionAnnounce))
+		packet = binary.BigEndian.AppendUint32(packet, transactionId)
+		packet = append(packet, request.InfoHash[:]...)
+		packet = append(packet, []byte(request.PeerId)...)
+		packet = binary.BigEndian.AppendUint64(packet, uint64(request.Downloaded))
+		packet = binary.BigEndian.AppendUint64(packet, uint64(request.Left))
+		packet = binary.BigEndian.AppendUint64(packet, uint64(request.Uploaded))
+		packet = binary.BigEndian.AppendUint32(packet, udpEvent(request.Event))
+		packet = binary.BigEndian.AppendUint32(packet, ip)
+		packet = binary.BigEndian.AppendUint32(packet, udpKey(request.Key))
+		packet = binary.BigEndian.AppendUint32(packet, udpNumWant(request.NumWant))
+		packet = binary.BigEndian.AppendUint16(packet, uint16(request.Port))
+
+		// The connect exchange may have used up part of the time left.
+		timeout = min(timeout, time.Until(deadline))
+		if timeout <= 0 {
+			return nil, errUDPTimeout
+		}
+
+		response, err := udpExchange(conn, packet, udpActionAnnounce, transactionId, timeout)
+		if err == errUDPTimeout {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(response) < 20 {
+			return nil, fmt.Errorf("announce response too short: %d bytes", len(response))
+		}
+
+		peers, err := decodePeers(string(response[20:]))
+		if err != nil {
+			return nil, err
+		}
+
+		return &TrackerResponse{
+			Interval:   int(binary.BigEndian.Uint32(response[8:12])),
+			Incomplete: int(binary.BigEndian.Uint32(response[12:16])),
+			Complete:   int(binary.BigEndian.Uint32(response[16:20])),
+			Peers:      peers,
+		}, nil
+	}
+}
@@ -0,0 +1,180 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveUDPTracker answers connect and announce requests on 'conn' until it is
+// closed, sending each announce packet to 'announces' and replying with the
+// compact peer list 'peers'.
+func serveUDPTracker(t *testing.T, conn net.PacketConn, announces chan<- []byte, peers []byte) {
+	const connectionId = 0x0123456789abcdef
+
+	buf := make([]byte, udpMaxPacketSize)
+
+	for {
+		read, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		packet := buf[:read]
+		if len(packet) < 16 {
+			t.Errorf("tracker received a packet of %d bytes", len(packet))
+			continue
+		}
+
+		action := binary.BigEndian.Uint32(packet[8:12])
+		reply := binary.BigEndian.AppendUint32([]byte{}, action)
+		reply = append(reply, packet[12:16]...) // the transaction ID
+
+		switch udpAction(action) {
+		case udpActionConnect:
+			if binary.BigEndian.Uint64(packet[0:8]) != udpProtocolId {
+				t.Errorf("connect request with protocol ID %x", packet[0:8])
+			}
+
+			reply = binary.BigEndian.AppendUint64(reply, connectionId)
+		case udpActionAnnounce:
+			if binary.BigEndian.Uint64(packet[0:8]) != connectionId {
+				t.Errorf("announce with connection ID %x", packet[0:8])
+			}
+
+			announces <- bytes.Clone(packet)
+
+			reply = binary.BigEndian.AppendUint32(reply, 1800) // interval
+			reply = binary.BigEndian.AppendUint32(reply, 2)    // leechers
+			reply = binary.BigEndian.AppendUint32(reply, 3)    // seeders
+			reply = append(reply, peers...)
+		default:
+			t.Errorf("tracker received action %d", action)
+			continue
+		}
+
+		conn.WriteTo(reply, addr)
+	}
+}
+
+// compactPeers encodes 'count' peers of the given address family with ports
+// counting up from 6881.
+func compactPeers(count int, ip net.IP) []byte {
+	var peers []byte
+
+	for idx := range count {
+		peers = append(peers, ip...)
+		peers = binary.BigEndian.AppendUint16(peers, uint16(6881+idx))
+	}
+
+	return peers
+}
+
+func TestGetPeersUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer conn.Close()
+
+	// More peers than fit in 2048 bytes.
+	const numPeers = 500
+
+	announces := make(chan []byte, 1)
+	go serveUDPTracker(t, conn, announces, compactPeers(numPeers, net.IPv4(10, 0, 0, 1).To4()))
+
+	torrent := &Torrent{AnnounceURL: "udp://" + conn.LocalAddr().String() + "/announce"}
+	request := TrackerRequest{
+		InfoHash: [20]byte{0xde, 0xad, 0xbe, 0xef},
+		PeerId:   "-AP0000-000000000000",
+		Port:     51413,
+		Left:     100,
+		Event:    EventStarted,
+	}
+
+	resp, err := torrent.GetPeers(request)
+	if err != nil {
+		t.Fatalf("could not announce: %v", err)
+	}
+
+	packet := <-announces
+	if !bytes.Equal(packet[16:36], request.InfoHash[:]) || string(packet[36:56]) != request.PeerId {
+		t.Errorf("announce carried info hash %x and peer id %q", packet[16:36], packet[36:56])
+	}
+
+	if left := binary.BigEndian.Uint64(packet[64:72]); left != 100 {
+		t.Errorf("announce carried %d bytes left, expected 100", left)
+	}
+
+	if event := binary.BigEndian.Uint32(packet[80:84]); event != udpEvent(EventStarted) {
+		t.Errorf("announce carried event %d, expected %d", event, udpEvent(EventStarted))
+	}
+
+	if port := binary.BigEndian.Uint16(packet[96:98]); port != 51413 {
+		t.Errorf("announce carried port %d, expected 51413", port)
+	}
+
+	if resp.Interval != 1800 || resp.Incomplete != 2 || resp.Complete != 3 {
+		t.Errorf("announce returned %+v", resp)
+	}
+
+	if len(resp.Peers) != numPeers {
+		t.Fatalf("announce returned %d peers, expected %d", len(resp.Peers), numPeers)
+	}
+
+	if last := resp.Peers[numPeers-1]; last.Ip != "10.0.0.1" || last.Port != 6881+numPeers-1 {
+		t.Errorf("last peer decoded as %s", last)
+	}
+}
+
+func TestGetPeersUDPIPv6(t *testing.T) {
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("could not listen on IPv6: %v", err)
+	}
+	defer conn.Close()
+
+	go serveUDPTracker(t, conn, make(chan []byte, 1), compactPeers(2, net.ParseIP("2001:db8::1")))
+
+	torrent := &Torrent{AnnounceURL: "udp://" + conn.LocalAddr().String() + "/announce"}
+
+	resp, err := torrent.GetPeers(TrackerRequest{PeerId: "-AP0000-000000000000"})
+	if err != nil {
+		t.Fatalf("could not announce: %v", err)
+	}
+
+	// 36 bytes would also decode as six IPv4 peers.
+	expected := []TrackerPeer{{Ip: "2001:db8::1", Port: 6881}, {Ip: "2001:db8::1", Port: 6882}}
+	if len(resp.Peers) != len(expected) || resp.Peers[0] != expected[0] || resp.Peers[1] != expected[1] {
+		t.Errorf("announce returned peers %v, expected %v", resp.Peers, expected)
+	}
+}
+
+func TestAnnounceUDPDeadline(t *testing.T) {
+	// A tracker that never answers.
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer silent.Close()
+
+	conn, err := net.Dial("udp", silent.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+
+	_, err = announceUDP(conn, TrackerRequest{PeerId: "-AP0000-000000000000"}, start.Add(200*time.Millisecond))
+	if !errors.Is(err, errUDPTimeout) {
+		t.Errorf("announce to a silent tracker returned %v, expected a timeout", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("announce gave up after %s, expected the deadline to apply", elapsed)
+	}
+}
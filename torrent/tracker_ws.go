@@ -0,0 +1,426 @@
+/*
+Torrent implementation dealing with WebSocket trackers, as used by WebTorrent.
+
+WebTorrent trackers speak a JSON protocol over WebSockets. Peers are exchanged
+via WebRTC offers and answers relayed by the tracker, which are not supported
+here: no offers are sent and offers received are never answered. The announce
+is performed and the peers that send offers to us within a short window are
+reported in TrackerResponse.WebRTCPeers, identified by their peer ID only.
+
+See https://github.com/webtorrent/bittorrent-tracker
+*/
+
+package torrent
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	wsHandshakeGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // Defined by RFC 6455.
+	wsTimeout       = 15 * time.Second                       // Deadline for the whole announce exchange.
+	wsOfferWindow   = 2 * time.Second                        // How long to wait for offers after the announce response.
+	wsNumWant       = 50                                     // Number of peers requested from the tracker.
+
+	wsMaxFrameSize   = 1 << 20 // Largest frame payload accepted from the tracker.
+	wsMaxMessageSize = 4 << 20 // Largest message accepted from the tracker, across all fragments.
+)
+
+// errWebSocketTooLarge is returned when the tracker sends a frame or message
+// larger than allowed.
+var errWebSocketTooLarge = errors.New("websocket message too large")
+
+// WebSocket frame opcodes as defined in RFC 6455.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// A wsConn represents a client WebSocket connection.
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// A wsAnnounce represents an announce message sent to a WebTorrent tracker.
+type wsAnnounce struct {
+	Action     string `json:"action"`
+	InfoHash   string `json:"info_hash"`
+	PeerId     string `json:"peer_id"`
+	Uploaded   int64  `json:"uploaded"`
+	Downloaded int64  `json:"downloaded"`
+	Left       int64  `json:"left"`
+	Event      string `json:"event,omitempty"`
+	NumWant    int    `json:"numwant"`
+	Offers     []any  `json:"offers"`
+}
+
+// A wsTrackerMessage represents a message received from a WebTorrent tracker.
+type wsTrackerMessage struct {
+	Action        string          `json:"action"`
+	InfoHash      string          `json:"info_hash"`
+	PeerId        string          `json:"peer_id"`
+	Interval      int             `json:"interval"`
+	Complete      int             `json:"complete"`
+	Incomplete    int             `json:"incomplete"`
+	FailureReason string          `json:"failure reason"`
+	Warning       string          `json:"warning message"`
+	Offer         json.RawMessage `json:"offer"`
+	OfferId       string          `json:"offer_id"`
+}
+
+// binaryToJSON converts a binary string into the form used by WebTorrent, where
+// each byte is represented by the character with the same code point.
+func binaryToJSON(binary string) string {
+	runes := make([]rune, len(binary))
+	for idx := range len(binary) {
+		runes[idx] = rune(binary[idx])
+	}
+
+	return string(runes)
+}
+
+// jsonToBinary converts a string in the form used by WebTorrent back into a
+// binary string. It is the inverse of binaryToJSON.
+func jsonToBinary(str string) string {
+	var contents []byte
+	for _, char := range str {
+		contents = append(contents, byte(char))
+	}
+
+	return string(contents)
+}
+
+// dialWebSocket opens a WebSocket connection to the ws:// or wss:// URL 'target'
+// and performs the opening handshake. Secure connections use 'tlsConfig' if not
+// nil. Returns the connection or an error if any.
+func dialWebSocket(ctx context.Context, target *url.URL, tlsConfig *tls.Config) (*wsConn, error) {
+	host := target.Host
+	if target.Port() == "" {
+		if target.Scheme == "wss" {
+			host = net.JoinHostPort(target.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(target.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: wsTimeout}
+	if target.Scheme == "wss" {
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+
+		if len(config.ServerName) == 0 {
+			config.ServerName = target.Hostname()
+		}
+
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: config}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(wsTimeout))
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	request := &http.Request{
+		Method: "GET",
+		URL:    target,
+		Host:   target.Host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-Websocket-Key":     {key},
+			"Sec-Websocket-Version": {"13"},
+		},
+	}
+
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not send websocket handshake: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not read websocket handshake: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake returned %s", resp.Status)
+	}
+
+	accept := sha1.Sum([]byte(key + wsHandshakeGUID))
+	if resp.Header.Get("Sec-Websocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake returned an invalid accept key")
+	}
+
+	return &wsConn{conn: conn, reader: reader}, nil
+}
+
+// writeFrame sends a single, masked frame with the given 'opcode' and 'payload'.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode} // FIN bit and opcode
+
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	// Frames sent by a client must be masked.
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame = append(frame, mask...)
+
+	for idx, char := range payload {
+		frame = append(frame, char^mask[idx%4])
+	}
+
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// readMessage reads the next text or binary message from the connection,
+// answering pings and reassembling fragmented messages along the way. Frames
+// larger than wsMaxFrameSize and messages larger than wsMaxMessageSize return
+// an error wrapping errWebSocketTooLarge before their payload is read.
+//
+// Returns io.EOF if the server closed the connection.
+func (ws *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+
+	for {
+		header, err := ReadN(2, ws.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		final := header[0]&0x80 != 0
+		opcode := header[0] & 0x0F
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7F)
+
+		switch length {
+		case 126:
+			extended, err := ReadN(2, ws.reader)
+			if err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(extended))
+		case 127:
+			extended, err := ReadN(8, ws.reader)
+			if err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(extended)
+		}
+
+		if length > wsMaxFrameSize {
+			return nil, fmt.Errorf("%w: frame of %d bytes, at most %d allowed", errWebSocketTooLarge, length, wsMaxFrameSize)
+		}
+
+		if opcode != wsOpClose && opcode != wsOpPing && opcode != wsOpPong && uint64(len(message))+length > wsMaxMessageSize {
+			return nil, fmt.Errorf("%w: more than %d bytes", errWebSocketTooLarge, wsMaxMessageSize)
+		}
+
+		var mask []byte
+		if masked {
+			mask, err = ReadN(4, ws.reader)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		payload, err := ReadN(int(length), ws.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		for idx := range payload {
+			if masked {
+				payload[idx] ^= mask[idx%4]
+			}
+		}
+
+		switch opcode {
+		case wsOpClose:
+			return nil, io.EOF
+		case wsOpPing:
+			if err := ws.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		}
+
+		message = append(message, payload...)
+
+		if final {
+			return message, nil
+		}
+	}
+}
+
+// Close sends a close frame and closes the underlying connection.
+func (ws *wsConn) Close() error {
+	ws.writeFrame(wsOpClose, nil)
+	return ws.conn.Close()
+}
+
+// getPeersWebSocket announces to a WebTorrent tracker at 'announce' and returns
+// the tracker response or an error if any.
+//
+// The response holds no dialable peers. Peers offering a connection through the
+// tracker are listed by peer ID in WebRTCPeers, as the connection itself would
+// be negotiated over WebRTC. The exchange is aborted once 'ctx' is
+// done, in which case the error of the context is returned. Secure connections
+// use 'tlsConfig' if not nil.
+func getPeersWebSocket(ctx context.Context, announce *url.URL, request TrackerRequest, tlsConfig *tls.Config) (*TrackerResponse, error) {
+	ws, err := dialWebSocket(ctx, announce, tlsConfig)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, fmt.Errorf("could not connect to tracker: %w", err)
+	}
+	defer ws.Close()
+
+	// Closing the connection unblocks any pending read.
+	stop := context.AfterFunc(ctx, func() { ws.conn.Close() })
+	defer stop()
+
+	response, err := announceWebSocket(ws, request)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return response, err
+}
+
+// announceWebSocket sends an announce over 'ws' and collects the tracker response
+// and the offers received shortly after. Returns the response or an error if any.
+func announceWebSocket(ws *wsConn, request TrackerRequest) (*TrackerResponse, error) {
+	message := wsAnnounce{
+		Action:     "announce",
+		InfoHash:   binaryToJSON(string(request.InfoHash[:])),
+		PeerId:     binaryToJSON(request.PeerId),
+		Uploaded:   request.Uploaded,
+		Downloaded: request.Downloaded,
+		Left:       request.Left,
+		NumWant:    wsNumWant,
+		Offers:     []any{},
+	}
+
+	if request.NumWant > 0 {
+		message.NumWant = request.NumWant
+	}
+
+	if len(request.Event) > 0 && request.Event != EventEmpty {
+		message.Event = string(request.Event)
+	}
+
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode announce: %w", err)
+	}
+
+	if err := ws.writeFrame(wsOpText, encoded); err != nil {
+		return nil, fmt.Errorf("could not send announce: %w", err)
+	}
+
+	var response *TrackerResponse
+	var offerers []string
+	seen := map[string]bool{}
+
+	for {
+		received, err := ws.readMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && response != nil {
+				break
+			}
+
+			if err == io.EOF && response != nil {
+				break
+			}
+
+			return nil, fmt.Errorf("could not read tracker response: %w", err)
+		}
+
+		var reply wsTrackerMessage
+		if err := json.Unmarshal(received, &reply); err != nil {
+			return nil, fmt.Errorf("could not decode tracker response: %w", err)
+		}
+
+		if len(reply.FailureReason) > 0 {
+			return nil, &ErrFailureReason{Message: reply.FailureReason}
+		}
+
+		if reply.Action != "announce" || jsonToBinary(reply.InfoHash) != string(request.InfoHash[:]) {
+			continue
+		}
+
+		if len(reply.Offer) > 0 {
+			peerId := jsonToBinary(reply.PeerId)
+			if !seen[peerId] {
+				seen[peerId] = true
+				offerers = append(offerers, peerId)
+			}
+			continue
+		}
+
+		if response == nil {
+			response = &TrackerResponse{
+				Interval:   reply.Interval,
+				Complete:   reply.Complete,
+				Incomplete: reply.Incomplete,
+				Warning:    reply.Warning,
+			}
+			ws.conn.SetReadDeadline(time.Now().Add(wsOfferWindow))
+		}
+	}
+
+	response.WebRTCPeers = offerers
+	return response, nil
+}
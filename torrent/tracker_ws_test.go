@@ -0,0 +1,178 @@
+package torrent
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// serveWebSocketTracker accepts a single WebSocket connection on 'listener',
+// decodes the announce sent over it into 'announce' and answers with 'replies'
+// before closing the connection. Replies given as []byte are sent as raw frames
+// and the others as JSON text frames.
+func serveWebSocketTracker(t *testing.T, listener net.Listener, announce chan<- wsAnnounce, replies []any) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		t.Errorf("could not read websocket handshake: %v", err)
+		return
+	}
+
+	accept := sha1.Sum([]byte(request.Header.Get("Sec-Websocket-Key") + wsHandshakeGUID))
+	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n"))
+
+	// Messages sent by the server are read back with the client's own reader.
+	ws := &wsConn{conn: conn, reader: reader}
+
+	message, err := ws.readMessage()
+	if err != nil {
+		t.Errorf("could not read announce: %v", err)
+		return
+	}
+
+	var received wsAnnounce
+	if err := json.Unmarshal(message, &received); err != nil {
+		t.Errorf("could not decode announce: %v", err)
+		return
+	}
+	announce <- received
+
+	for _, reply := range replies {
+		if raw, ok := reply.([]byte); ok {
+			if _, err := conn.Write(raw); err != nil {
+				return
+			}
+			continue
+		}
+
+		encoded, _ := json.Marshal(reply)
+
+		frame := []byte{0x80 | wsOpText, 126}
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(encoded)))
+		conn.Write(append(frame, encoded...))
+	}
+
+	conn.Write([]byte{0x80 | wsOpClose, 0})
+}
+
+func TestGetPeersWebSocket(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef, 0xff}
+	jsonHash := binaryToJSON(string(infoHash[:]))
+
+	announce := make(chan wsAnnounce, 1)
+	go serveWebSocketTracker(t, listener, announce, []any{
+		map[string]any{"action": "announce", "info_hash": jsonHash, "interval": 120, "complete": 3, "incomplete": 4},
+		map[string]any{"action": "announce", "info_hash": jsonHash, "peer_id": "-WW0001-aaaaaaaaaaaa", "offer": map[string]any{"type": "offer"}},
+		map[string]any{"action": "announce", "info_hash": jsonHash, "peer_id": "-WW0001-aaaaaaaaaaaa", "offer": map[string]any{"type": "offer"}},
+		map[string]any{"action": "announce", "info_hash": jsonHash, "peer_id": "-WW0001-bbbbbbbbbbbb", "offer": map[string]any{"type": "offer"}},
+	})
+
+	torrent := &Torrent{AnnounceURL: "ws://" + listener.Addr().String() + "/announce"}
+
+	resp, err := torrent.GetPeers(TrackerRequest{InfoHash: infoHash, PeerId: "-AP0000-000000000000", Left: 100})
+	if err != nil {
+		t.Fatalf("could not announce: %v", err)
+	}
+
+	sent := <-announce
+	if sent.Action != "announce" || sent.InfoHash != jsonHash || sent.PeerId != "-AP0000-000000000000" || sent.Left != 100 {
+		t.Errorf("tracker received announce %+v", sent)
+	}
+
+	if resp.Interval != 120 || resp.Complete != 3 || resp.Incomplete != 4 {
+		t.Errorf("announce returned %+v", resp)
+	}
+
+	// Peers offering WebRTC connections cannot be dialed.
+	if len(resp.Peers) != 0 {
+		t.Errorf("announce returned dialable peers %+v", resp.Peers)
+	}
+
+	if !slices.Equal(resp.WebRTCPeers, []string{"-WW0001-aaaaaaaaaaaa", "-WW0001-bbbbbbbbbbbb"}) {
+		t.Errorf("announce returned WebRTC peers %q, expected the two offering peers", resp.WebRTCPeers)
+	}
+}
+
+func TestGetPeersWebSocketFailureReason(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	announce := make(chan wsAnnounce, 1)
+	go serveWebSocketTracker(t, listener, announce, []any{
+		map[string]any{"action": "announce", "failure reason": "unregistered torrent"},
+	})
+
+	torrent := &Torrent{AnnounceURL: "ws://" + listener.Addr().String() + "/announce"}
+
+	_, err = torrent.GetPeers(TrackerRequest{PeerId: "-AP0000-000000000000"})
+
+	var failure *ErrFailureReason
+	if !errors.As(err, &failure) || failure.Message != "unregistered torrent" {
+		t.Errorf("expected the failure reason of the tracker, got %v", err)
+	}
+}
+
+func TestGetPeersWebSocketOversized(t *testing.T) {
+	// A fragment of the largest frame size, without its final bit set.
+	fragment := binary.BigEndian.AppendUint64([]byte{wsOpText, 127}, wsMaxFrameSize)
+	fragment = append(fragment, make([]byte, wsMaxFrameSize)...)
+
+	var fragmented []any
+	for range wsMaxMessageSize / wsMaxFrameSize {
+		fragmented = append(fragmented, fragment)
+	}
+	fragmented = append(fragmented, []byte{0x80 | wsOpContinuation, 1, '}'})
+
+	tests := []struct {
+		name    string
+		replies []any
+	}{
+		{"negative length", []any{binary.BigEndian.AppendUint64([]byte{0x80 | wsOpText, 127}, 1<<63)}},
+		{"huge length", []any{binary.BigEndian.AppendUint64([]byte{0x80 | wsOpText, 127}, 1<<40)}},
+		{"large frame", []any{binary.BigEndian.AppendUint64([]byte{0x80 | wsOpText, 127}, wsMaxFrameSize+1)}},
+		{"large message", fragmented},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("could not listen: %v", err)
+			}
+			defer listener.Close()
+
+			go serveWebSocketTracker(t, listener, make(chan wsAnnounce, 1), test.replies)
+
+			torrent := &Torrent{AnnounceURL: "ws://" + listener.Addr().String() + "/announce"}
+
+			_, err = torrent.GetPeers(TrackerRequest{PeerId: "-AP0000-000000000000"})
+			if !errors.Is(err, errWebSocketTooLarge) {
+				t.Errorf("expected an error for the oversized reply, got %v", err)
+			}
+		})
+	}
+}
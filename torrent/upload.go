@@ -0,0 +1,75 @@
+/* Serving of piece requests from peers. */
+
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The largest block a peer may request at once. Requests for larger blocks are
+// rejected, as most clients do.
+const MAX_REQUEST_LENGTH = 128 * 1024
+
+var (
+	// ErrRequestWhileChoked is returned when a peer requests a block while we
+	// are choking it. Such requests must be dropped.
+	ErrRequestWhileChoked = errors.New("request while choked")
+	// ErrInvalidRequest is returned when a peer requests a block that is not
+	// within a piece of the torrent.
+	ErrInvalidRequest = errors.New("invalid request")
+)
+
+// Choking reports whether we are choking the peer, that is, whether the last
+// choke or unchoke message sent to it was a choke message. A connection starts
+// choked.
+func (c *TCPClient) Choking() bool {
+	return !c.unchokedPeer.Load()
+}
+
+// ServeRequest answers a 'request' received from the peer by reading the block
+// from 'storage' and sending it in a piece message. The storage holds the
+// concatenated contents of the torrent, such as a Storage, and requires the Info
+// field of the client to be set.
+//
+// Returns an error wrapping ErrRequestWhileChoked if we are choking the peer or
+// ErrInvalidRequest if the block is empty, longer than MAX_REQUEST_LENGTH or not
+// within the requested piece. In both cases nothing is sent and the connection
+// remains usable.
+func (c *TCPClient) ServeRequest(request Request, storage io.ReaderAt) error {
+	if c.Info == nil {
+		return fmt.Errorf("cannot serve piece %d without torrent info", request.Index)
+	}
+
+	if c.Choking() {
+		return fmt.Errorf("%w: piece %d from %s", ErrRequestWhileChoked, request.Index, c.Peer)
+	}
+
+	if int64(request.Index) >= int64(c.Info.NumPieces()) {
+		return fmt.Errorf("%w: piece %d out of range", ErrInvalidRequest, request.Index)
+	}
+
+	if request.Length == 0 || request.Length > MAX_REQUEST_LENGTH {
+		return fmt.Errorf("%w: block of %d bytes", ErrInvalidRequest, request.Length)
+	}
+
+	pieceSize := int64(c.Info.PieceSize(int(request.Index)))
+	if int64(request.Begin)+int64(request.Length) > pieceSize {
+		return fmt.Errorf("%w: block at %d of %d bytes exceeds piece %d of %d bytes",
+			ErrInvalidRequest, request.Begin, request.Length, request.Index, pieceSize)
+	}
+
+	block := make([]byte, request.Length)
+	offset := int64(request.Index)*c.Info.PieceLength + int64(request.Begin)
+
+	// A reader may return io.EOF along with a block ending the torrent.
+	if read, err := storage.ReadAt(block, offset); read < len(block) {
+		return fmt.Errorf("could not read block of piece %d: %w", request.Index, err)
+	}
+
+	return c.SendMessage(Message{
+		Id:    MessagePiece,
+		Block: Block{Index: request.Index, Begin: request.Begin, Block: block},
+	})
+}
@@ -21,3 +21,12 @@ func ReadN(n int, reader io.Reader) ([]byte, error) {
 
 	return contents[:bytesRead], nil
 }
+
+// ReadNInto reads exactly len(buf) bytes from a reader (via the reader parameter)
+// into 'buf', without allocating.
+//
+// It returns the number of bytes read and an error if any, in the same scenarios
+// as io.ReadFull.
+func ReadNInto(buf []byte, reader io.Reader) (int, error) {
+	return io.ReadFull(reader, buf)
+}
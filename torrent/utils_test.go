@@ -0,0 +1,53 @@
+package torrent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadNInto(t *testing.T) {
+	buf := make([]byte, 4)
+
+	read, err := ReadNInto(buf, bytes.NewReader([]byte{1, 2, 3, 4, 5}))
+	if err != nil || read != 4 || !bytes.Equal(buf, []byte{1, 2, 3, 4}) {
+		t.Errorf("read %d bytes %v (%v)", read, buf, err)
+	}
+
+	if _, err := ReadNInto(buf, bytes.NewReader([]byte{1, 2})); err == nil {
+		t.Errorf("short read did not return an error")
+	}
+}
+
+// prefixes is a stream of 4-byte length prefixes, as read before every message.
+var prefixes = bytes.Repeat([]byte{0, 0, 0, 13}, 1024)
+
+func BenchmarkReadN(b *testing.B) {
+	reader := bytes.NewReader(prefixes)
+	b.ReportAllocs()
+
+	for range b.N {
+		if reader.Len() == 0 {
+			reader.Reset(prefixes)
+		}
+
+		if _, err := ReadN(4, reader); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadNInto(b *testing.B) {
+	reader := bytes.NewReader(prefixes)
+	var buf [4]byte
+	b.ReportAllocs()
+
+	for range b.N {
+		if reader.Len() == 0 {
+			reader.Reset(prefixes)
+		}
+
+		if _, err := ReadNInto(buf[:], reader); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Torrent implementation dealing with version 2 of the meta info format.
+
+See https://bittorrent.org/beps/bep_0052.html
+
+Only the meta info is supported: v2 torrents can be read and their info hash
+computed, but their pieces are not downloaded or verified. Hybrid torrents
+also carry v1 data and can be downloaded as v1 torrents.
+*/
+
+package torrent
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"slices"
+
+	"github.com/aescarias/apricot/torrent/bencode"
+)
+
+// A TreeFile represents a file described by the file tree of a v2 torrent.
+type TreeFile struct {
+	Path       []string // A slice of path parts ending with the filename.
+	Length     int64    // The length of the file in bytes.
+	PiecesRoot [32]byte // The root hash of the merkle tree of the file. Zero for empty files.
+}
+
+// IsV2 reports whether the info dictionary declares version 2 of the meta info
+// format, which includes hybrid torrents.
+func (i *Info) IsV2() bool {
+	return i.MetaVersion == 2
+}
+
+// IsHybrid reports whether the info dictionary describes both a v1 and a v2
+// torrent of the same contents.
+func (i *Info) IsHybrid() bool {
+	return i.IsV2() && len(i.Pieces) > 0
+}
+
+// TreeFiles returns the files described by the file tree of a v2 torrent, in
+// tree order. Returns an error if the file tree is missing or malformed.
+func (i *Info) TreeFiles() ([]TreeFile, error) {
+	if i.FileTree == nil {
+		return nil, fmt.Errorf("missing file tree")
+	}
+
+	var files []TreeFile
+	if err := walkFileTree(i.FileTree, nil, &files); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// walkFileTree appends the files within the file tree 'node' at 'path' to 'files'.
+// A node is either a directory mapping path parts to other nodes, or a file
+// holding a single entry with an empty key.
+func walkFileTree(node map[string]any, path []string, files *[]TreeFile) error {
+	if entry, ok := node[""]; ok {
+		if len(node) != 1 || len(path) == 0 {
+			return fmt.Errorf("invalid file entry at %q", path)
+		}
+
+		file := TreeFile{Path: path}
+
+		var contents struct {
+			Length     int64  `bencode:"length"`
+			PiecesRoot []byte `bencode:"pieces root,omitempty"`
+		}
+
+		if err := bencode.UnmarshalToken(entry, &contents); err != nil {
+			return fmt.Errorf("invalid file entry at %q: %w", path, err)
+		}
+
+		if contents.Length < 0 {
+			return fmt.Errorf("length of file %q must not be negative, got %d", path, contents.Length)
+		}
+
+		file.Length = contents.Length
+
+		if contents.Length > 0 {
+			if len(contents.PiecesRoot) != len(file.PiecesRoot) {
+				return fmt.Errorf("pieces root of file %q has %d bytes, expected 32", path, len(contents.PiecesRoot))
+			}
+
+			copy(file.PiecesRoot[:], contents.PiecesRoot)
+		}
+
+		*files = append(*files, file)
+		return nil
+	}
+
+	keys := make([]string, 0, len(node))
+	for key := range node {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		child, ok := node[key].(map[string]any)
+		if !ok {
+			return fmt.Errorf("file tree entry %q is not a dictionary", append(slices.Clone(path), key))
+		}
+
+		if err := walkFileTree(child, append(slices.Clone(path), key), files); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HashV2 returns the v2 info hash of the torrent, the SHA-256 hash of the info
+// dictionary. Returns an error if the torrent is not a v2 torrent.
+//
+// For hybrid torrents, Hash returns the v1 info hash of the same dictionary.
+func (i *Info) HashV2() ([32]byte, error) {
+	if !i.IsV2() {
+		return [32]byte{}, fmt.Errorf("torrent is not a v2 torrent")
+	}
+
+	bencoded, err := i.encode()
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("could not bencode data for info hash: %w", err)
+	}
+
+	return sha256.Sum256([]byte(bencoded)), nil
+}
@@ -0,0 +1,80 @@
+/* Verification of torrent data against piece hashes. */
+
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// VerifyPiece reports whether the SHA1 hash of 'data' matches the hash of the
+// piece at 'index'. Returns an error if the index is out of range.
+func (i *Info) VerifyPiece(index int, data []byte) (bool, error) {
+	hashes := i.PieceHashes()
+	if index < 0 || index >= len(hashes) {
+		return false, fmt.Errorf("piece index %d out of range", index)
+	}
+
+	sum := sha1.Sum(data)
+	return string(sum[:]) == hashes[index], nil
+}
+
+// VerifyFile checks the torrent data provided by 'r' against the piece hashes.
+// The data is expected to be the concatenated contents of the torrent, starting
+// at offset zero.
+//
+// Returns a slice reporting whether each piece is valid and an error if any.
+// The last piece is shorter than PieceLength unless the total length is a multiple
+// of it. Pieces that cannot be read in full because the data is too short are
+// reported as invalid rather than as an error.
+func (i *Info) VerifyFile(r io.ReaderAt) ([]bool, error) {
+	valid := make([]bool, i.NumPieces())
+	buf := make([]byte, i.PieceLength)
+
+	for index := range valid {
+		offset := int64(index) * i.PieceLength
+		size := min(i.PieceLength, int64(i.PieceSize(index)))
+
+		if size <= 0 {
+			continue
+		}
+
+		read, err := r.ReadAt(buf[:size], offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("could not read piece %d: %w", index, err)
+		}
+
+		if int64(read) < size {
+			continue
+		}
+
+		valid[index], err = i.VerifyPiece(index, buf[:size])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return valid, nil
+}
+
+// VerifyAll checks the torrent data provided by 'data' against the piece hashes
+// of 'info' in the same way as Info.VerifyFile.
+//
+// Returns a bit field where each verified piece is set and an error if any.
+func VerifyAll(info *Info, data io.ReaderAt) (BitField, error) {
+	valid, err := info.VerifyFile(data)
+	if err != nil {
+		return BitField{}, err
+	}
+
+	field := NewBitField(len(valid))
+	for index, ok := range valid {
+		if ok {
+			field.SetPiece(index)
+		}
+	}
+
+	return field, nil
+}
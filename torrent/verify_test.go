@@ -0,0 +1,62 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+)
+
+// newTestInfo returns a single file info describing 'contents' in pieces of
+// 'pieceLength' bytes.
+func newTestInfo(contents []byte, pieceLength int) *Info {
+	var pieces []byte
+	for offset := 0; offset < len(contents); offset += pieceLength {
+		sum := sha1.Sum(contents[offset:min(offset+pieceLength, len(contents))])
+		pieces = append(pieces, sum[:]...)
+	}
+
+	return &Info{Name: "data", PieceLength: int64(pieceLength), Pieces: string(pieces), Length: int64(len(contents))}
+}
+
+func TestVerifyAll(t *testing.T) {
+	contents := make([]byte, 4*1024+100)
+	for idx := range contents {
+		contents[idx] = byte(idx * 7)
+	}
+
+	info := newTestInfo(contents, 1024)
+
+	corrupted := bytes.Clone(contents)
+	corrupted[2*1024+5] ^= 0xff
+
+	field, err := VerifyAll(info, bytes.NewReader(corrupted))
+	if err != nil {
+		t.Fatalf("could not verify data: %v", err)
+	}
+
+	if field.Length != 5 {
+		t.Fatalf("bit field has %d pieces, expected 5", field.Length)
+	}
+
+	for index := range field.Length {
+		// The short final piece is verified like any other.
+		if field.HasPiece(index) != (index != 2) {
+			t.Errorf("piece %d reported as valid: %t", index, field.HasPiece(index))
+		}
+	}
+}
+
+func TestVerifyAllShortData(t *testing.T) {
+	contents := bytes.Repeat([]byte("apricot"), 500)
+	info := newTestInfo(contents, 1024)
+
+	field, err := VerifyAll(info, bytes.NewReader(contents[:2000]))
+	if err != nil {
+		t.Fatalf("could not verify data: %v", err)
+	}
+
+	// Only the first piece can be read in full.
+	if !field.HasPiece(0) || field.Count() != 1 {
+		t.Errorf("verified %d pieces of truncated data", field.Count())
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Torrent implementation dealing with HTTP web seeds.
+
+See https://bittorrent.org/beps/bep_0019.html
+*/
+
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A webSeedRange represents the bytes of a piece held by a single file on a
+// web seed.
+type webSeedRange struct {
+	url    string // The URL of the file on the web seed.
+	offset int64  // The offset of the range within the file.
+	length int64  // The number of bytes in the range.
+}
+
+// webSeedRanges returns the file ranges on the web seed at 'seed' covering the
+// 'length' bytes of the torrent starting at 'offset'.
+//
+// For single file torrents, a seed URL ending with '/' refers to a directory
+// holding the file and any other URL refers to the file itself. For multiple
+// file torrents, the seed URL refers to the directory holding the torrent
+// directory.
+func (i *Info) webSeedRanges(seed string, offset int64, length int64) []webSeedRange {
+	if len(i.Files) == 0 {
+		if strings.HasSuffix(seed, "/") {
+			seed += url.PathEscape(i.PreferredName())
+		}
+
+		return []webSeedRange{{url: seed, offset: offset, length: length}}
+	}
+
+	if !strings.HasSuffix(seed, "/") {
+		seed += "/"
+	}
+
+	var ranges []webSeedRange
+
+	for _, fileRange := range i.FileRanges() {
+		start := max(offset, fileRange.Offset)
+		end := min(offset+length, fileRange.Offset+fileRange.Length)
+
+		if start >= end {
+			continue
+		}
+
+		parts := []string{url.PathEscape(i.PreferredName())}
+		for _, part := range fileRange.File.PreferredPath() {
+			parts = append(parts, url.PathEscape(part))
+		}
+
+		ranges = append(ranges, webSeedRange{
+			url:    seed + strings.Join(parts, "/"),
+			offset: start - fileRange.Offset,
+			length: end - start,
+		})
+	}
+
+	return ranges
+}
+
+// fetchRange reads the bytes described by 'r' into 'buf' using a ranged HTTP GET.
+func (t *Torrent) fetchRange(r webSeedRange, buf []byte) error {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.offset, r.offset+r.length-1))
+
+	resp, err := t.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("request to web seed failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range, so skip to the requested offset.
+		if _, err := io.CopyN(io.Discard, resp.Body, r.offset); err != nil {
+			return fmt.Errorf("could not read from web seed: %w", err)
+		}
+	default:
+		return fmt.Errorf("request to web seed returned %s", resp.Status)
+	}
+
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return fmt.Errorf("could not read from web seed: %w", err)
+	}
+
+	return nil
+}
+
+// DownloadPieceHTTP downloads the piece at 'index' from the web seeds of the
+// torrent using ranged HTTP GET requests and verifies it against its hash.
+//
+// The web seeds are tried in order until one of them provides a valid piece.
+// Returns the piece or an error if no web seed could provide it.
+func (t *Torrent) DownloadPieceHTTP(index int) ([]byte, error) {
+	if len(t.WebSeeds) == 0 {
+		return nil, fmt.Errorf("torrent has no web seeds")
+	}
+
+	if index < 0 || index >= t.Info.NumPieces() {
+		return nil, fmt.Errorf("piece index %d out of range", index)
+	}
+
+	offset := int64(index) * t.Info.PieceLength
+	size := int64(t.Info.PieceSize(index))
+
+	var errs []error
+
+	for _, seed := range t.WebSeeds {
+		piece, err := t.downloadPieceFrom(seed, index, offset, size)
+		if err == nil {
+			return piece, nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", seed, err))
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// downloadPieceFrom downloads the piece at 'index', spanning 'size' bytes from
+// 'offset', from the web seed at 'seed' and verifies it.
+func (t *Torrent) downloadPieceFrom(seed string, index int, offset int64, size int64) ([]byte, error) {
+	piece := make([]byte, size)
+	var filled int64
+
+	for _, r := range t.Info.webSeedRanges(seed, offset, size) {
+		if err := t.fetchRange(r, piece[filled:filled+r.length]); err != nil {
+			return nil, err
+		}
+
+		filled += r.length
+	}
+
+	ok, err := t.Info.VerifyPiece(index, piece)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("piece %d failed verification", index)
+	}
+
+	return piece, nil
+}